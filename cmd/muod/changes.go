@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/state"
+)
+
+// hostState follows the up/down state of one host on the status line and
+// remembers its outages
+type hostState struct {
+	name    string
+	machine *state.Machine
+	outages []outage
+	records *recordWriter // Receives the transitions, nil with text output
+}
+
+// outage is an interval in which a host was down; end is zero while it lasts
+type outage struct {
+	start time.Time
+	end   time.Time
+}
+
+// observe records whether the round that started at start succeeded. It
+// returns a line for --changes if the host went up or down, or if this was
+// its first round.
+func (h *hostState) observe(start time.Time, ok bool) string {
+	first := h.machine.State() == state.Unknown
+	wasUp := h.machine.State().IsUp()
+	since := h.machine.Since()
+	if !h.machine.Observe(start, ok) && !first {
+		return ""
+	}
+
+	up := h.machine.State().IsUp()
+	if h.records != nil {
+		from := upDown(wasUp)
+		if first {
+			from, since = "unknown", time.Time{}
+		}
+		h.records.transition(start, h, from, upDown(up), since)
+	}
+	// An outage lasts from the first failed round to the first successful
+	// one, not only between the rounds that crossed the thresholds
+	if !up {
+		h.outages = append(h.outages, outage{start: h.machine.Started()})
+	} else if !first {
+		h.outages[len(h.outages)-1].end = h.machine.Started()
+	}
+
+	var line string
+	switch {
+	case up && !first && !wasUp:
+		o := h.outages[len(h.outages)-1]
+		line = fmt.Sprintf("%s%s UP after %v down%s", colorGreen, h.name, roundDuration(o.end.Sub(o.start)), colorReset)
+	case up:
+		line = fmt.Sprintf("%s%s UP%s", colorGreen, h.name, colorReset)
+	default:
+		line = fmt.Sprintf("%s%s DOWN%s", colorRed, h.name, colorReset)
+	}
+	if h.machine.Flapping() {
+		line += " (flapping)"
+	}
+	if !plainFlag {
+		line = start.Format("15:04:05") + " " + line
+	}
+	return line
+}
+
+// printOutages writes every outage of each host with its start, end and
+// duration. Outages still going on at end are shown as ongoing.
+func printOutages(w io.Writer, hosts []*hostState, end time.Time) {
+	fmt.Fprintf(w, "\n--- muod outages ---\n")
+	none := true
+	for _, h := range hosts {
+		if len(h.outages) == 0 {
+			continue
+		}
+		none = false
+		fmt.Fprintf(w, "%s\n", h.name)
+		for _, o := range h.outages {
+			until, stop := "ongoing", end
+			if !o.end.IsZero() {
+				until, stop = o.end.Format(time.DateTime), o.end
+			}
+			fmt.Fprintf(w, "  %s - %-19s  %v\n", o.start.Format(time.DateTime), until, roundDuration(stop.Sub(o.start)))
+		}
+	}
+	if none {
+		fmt.Fprintf(w, "No outages\n")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// command is a child process run while the hosts are monitored, given
+// after -- on the command line
+type command struct {
+	cmd  *exec.Cmd
+	done chan struct{} // Closed once the command has exited
+	code int           // Exit status, valid once done is closed
+}
+
+// stopGrace is how long a command still running at the end of the run has
+// to exit after stopSignal before it is killed
+const stopGrace = 5 * time.Second
+
+// splitCommand splits the arguments at the first --: muod's own flags and
+// targets before it, the command to run after it
+func splitCommand(args []string) (own, cmd []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
+
+// startCommand starts args with muod's standard input and error, and its
+// standard output written to stdout
+func startCommand(args []string, stdout io.Writer) (*command, error) {
+	c := &command{cmd: exec.Command(args[0], args[1:]...), done: make(chan struct{})}
+	c.cmd.Stdin, c.cmd.Stdout, c.cmd.Stderr = os.Stdin, stdout, os.Stderr
+	if err := c.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run %s: %v", args[0], err)
+	}
+	go func() {
+		c.cmd.Wait()
+		c.code = exitStatus(c.cmd.ProcessState)
+		close(c.done)
+	}()
+	return c, nil
+}
+
+// exitStatus returns the exit status of a process like a shell does: its
+// exit code, or 128 plus the signal that killed it
+func exitStatus(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
+
+// signalContext relays signals to the command while it runs and returns a
+// context that is cancelled by a signal once it has exited. Keys such as
+// Ctrl+C already reach the command from the terminal, since it runs in
+// muod's process group, so the first of those is left to the command and
+// only a second one cancels. A forwarded stopSignal cancels as well, so a
+// command that ignores it cannot keep muod running.
+func (c *command) signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, append(terminalSignals, forwardedSignals...)...)
+	go func() {
+		interrupts := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigs:
+				select {
+				case <-c.done:
+					cancel()
+					continue
+				default:
+				}
+				switch {
+				case isForwarded(sig):
+					debugPrint("Forwarding %v to the command", sig)
+					c.cmd.Process.Signal(sig)
+					if sig == stopSignal {
+						cancel()
+					}
+				default:
+					if interrupts++; interrupts > 1 {
+						cancel()
+					}
+				}
+			}
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+}
+
+// stop ends the command if it still runs: stopSignal first, then a kill if
+// it has not exited within grace
+func (c *command) stop(grace time.Duration) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	debugPrint("Stopping the command")
+	c.cmd.Process.Signal(stopSignal)
+	select {
+	case <-c.done:
+	case <-time.After(grace):
+		c.cmd.Process.Kill()
+		<-c.done
+	}
+}
+
+// isForwarded reports whether sig is relayed to the command
+func isForwarded(sig os.Signal) bool {
+	for _, s := range forwardedSignals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
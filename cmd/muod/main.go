@@ -1,34 +1,83 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fmattheus/muod/pkg/config"
 	"github.com/fmattheus/muod/pkg/ping"
+	"github.com/fmattheus/muod/pkg/probe"
+	"github.com/fmattheus/muod/pkg/state"
+	"github.com/fmattheus/muod/pkg/stats"
 )
 
 // Constants for output formatting
 const (
-	colorReset  = "\033[0m"
-	colorGreen  = "\033[32m"
-	colorRed    = "\033[31m"
+	colorReset   = "\033[0m"
+	colorGreen   = "\033[32m"
+	colorRed     = "\033[31m"
+	colorYellow  = "\033[33m"
+	colorBlue    = "\033[34m"
+	colorMagenta = "\033[35m"
+	colorCyan    = "\033[36m"
 	// Minimum timeout to prevent too frequent pings
 	minTimeout = 100 * time.Millisecond
+	// Window of flap detection unless configured
+	defaultFlapWindow = 5 * time.Minute
 )
 
 // Flag variables
 var (
-	debugFlag   bool
-	timeoutFlag string
-	plainFlag   bool
-	countFlag   int
-	configFlag  string
-	timeout     time.Duration
+	debugFlag    bool
+	timeoutFlag  string
+	plainFlag    bool
+	countFlag    int
+	configFlag   string
+	ipv4Flag     bool
+	ipv6Flag     bool
+	verboseFlag  bool
+	sizeFlag     int
+	patternFlag  string
+	verifyFlag   bool
+	ttlFlag      int
+	tosFlag      int
+	dscpFlag     int
+	dfFlag       bool
+	backendFlag  string
+	probesFlag   int
+	gapFlag      string
+	slowFlag     int
+	insecureFlag bool
+	downFlag     int
+	upFlag       int
+	flapFlag     int
+	flapWinFlag  string
+	changesFlag  bool
+	untilFlag    string
+	stableFlag   string
+	deadlineFlag string
+	anyFlag      bool
+	outputFlag   string
+	probeGap     time.Duration
+	timeout      time.Duration
+	probeOpts    ping.Options
+	untilCond    untilMode
+	stableFor    time.Duration
+	deadline     time.Duration
+	output       outputFormat
 )
 
 // parseTimeout converts a string timeout value to time.Duration
@@ -54,6 +103,33 @@ func debugPrint(format string, args ...interface{}) {
 	}
 }
 
+// preParseFlags scans the command line for the config and debug flags so the
+// config file can be loaded before the remaining flags are defined. Unknown
+// flags are skipped rather than rejected; flag.Parse validates them later.
+func preParseFlags(args []string) (configPath string, debug bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		switch name {
+		case "config", "f":
+			if !hasValue && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			configPath = value
+		case "debug", "d":
+			debug = !hasValue || value == "true" || value == "1"
+		}
+	}
+	return configPath, debug
+}
+
 func init() {
 	// First define the config file flag so we can load the right config
 	flag.StringVar(&configFlag, "config", "", "Path to config file (default: $XDG_CONFIG_HOME/muod/muod.yaml)")
@@ -64,11 +140,9 @@ func init() {
 	flag.BoolVar(&debugFlag, "d", false, "Enable debug output (shorthand)")
 
 	// Pre-parse just the config and debug flags
-	flag.Parse()
+	configFlag, debugFlag = preParseFlags(os.Args[1:])
 	// Set debug mode in config package
 	config.Debug = debugFlag
-	// Reset flag.Parsed() so we can parse again after setting up all flags
-	flag.CommandLine.Init(flag.CommandLine.Name(), flag.ContinueOnError)
 
 	// Load configuration
 	cfg, err := config.LoadConfig(configFlag)
@@ -86,64 +160,858 @@ func init() {
 
 	flag.IntVar(&countFlag, "count", cfg.DefaultCount, "Number of ping rounds to send (-1 for infinite, 0 to exit after DNS resolution)")
 	flag.IntVar(&countFlag, "c", cfg.DefaultCount, "Number of ping rounds to send (shorthand)")
+
+	flag.BoolVar(&ipv4Flag, "4", false, "Monitor IPv4 addresses (the default; with -6, both families)")
+	flag.BoolVar(&ipv6Flag, "6", false, "Monitor IPv6 addresses (with -4, both families)")
+
+	flag.BoolVar(&verboseFlag, "verbose", false, "Print reply details (source, size, seq, TTL, RTT, ICMP type/code) per host")
+	flag.BoolVar(&verboseFlag, "v", false, "Print reply details per host (shorthand)")
+
+	flag.IntVar(&sizeFlag, "size", 0, fmt.Sprintf("Echo payload size in bytes (up to %d)", ping.MaxSize))
+	flag.IntVar(&sizeFlag, "s", 0, "Echo payload size in bytes (shorthand)")
+	flag.StringVar(&patternFlag, "pattern", "zeros", "Payload fill pattern: zeros, random or hex bytes (e.g. deadbeef)")
+	flag.BoolVar(&verifyFlag, "verify", true, "Check that echoed payloads match byte for byte (--verify=false to disable)")
+
+	flag.IntVar(&ttlFlag, "ttl", 0, "IPv4 TTL or IPv6 hop limit of probes (default from config or system)")
+	flag.IntVar(&tosFlag, "tos", 0, "IPv4 TOS byte or IPv6 traffic class of probes (e.g. 0xb8)")
+	flag.IntVar(&dscpFlag, "dscp", 0, "DSCP code point of probes (e.g. 46 for EF), an alternative to --tos")
+	flag.BoolVar(&dfFlag, "df", false, "Set the Don't Fragment bit on probes")
+
+	flag.StringVar(&backendFlag, "backend", "auto", "Socket type: udp (unprivileged), raw (root or CAP_NET_RAW) or auto")
+
+	flag.IntVar(&probesFlag, "probes", 1, "Number of probes per host per round")
+	flag.StringVar(&gapFlag, "probe-gap", "0.2", "Seconds between the probes of a round")
+	flag.IntVar(&slowFlag, "slow", 0, "Show hosts whose median RTT exceeds this many milliseconds in yellow (0 to disable)")
+
+	flag.BoolVar(&insecureFlag, "insecure", false, "Skip certificate verification of https:// targets")
+	flag.BoolVar(&insecureFlag, "k", false, "Skip certificate verification of https:// targets (shorthand)")
+
+	flag.IntVar(&downFlag, "down-after", 1, "Consecutive failed rounds before a host is shown down")
+	flag.IntVar(&upFlag, "up-after", 1, "Consecutive successful rounds before a host is shown up again")
+	flag.IntVar(&flapFlag, "flap-count", 0, "Up/down changes within --flap-window that mark a host as flapping (0 to disable)")
+	flag.StringVar(&flapWinFlag, "flap-window", fmt.Sprintf("%.0f", defaultFlapWindow.Seconds()), "Seconds over which changes are counted for flap detection")
+
+	flag.BoolVar(&changesFlag, "changes", false, "Print only hosts going up or down, and every outage at exit")
+
+	flag.StringVar(&untilFlag, "until", "", "Exit once all hosts are up, down, or went down and came back up (cycle)")
+	flag.StringVar(&stableFlag, "stable-for", "0", "How long the --until condition must hold (e.g. 30s)")
+	flag.StringVar(&deadlineFlag, "deadline", "0", "Give up on --until after this long (e.g. 10m, 0 for never)")
+	flag.BoolVar(&anyFlag, "any", false, "Exit once any host meets the --until condition")
+
+	flag.StringVar(&outputFlag, "output", "text", "Output format: text, or json for one JSON object per probe and state change")
+	flag.StringVar(&outputFlag, "o", "text", "Output format: text or json (shorthand)")
 }
 
-func monitorHosts(resolvedHosts []ping.HostInfo) {
-	// If count is 0, return immediately after DNS resolution
-	if countFlag == 0 {
-		return
+// cliProbeOptions returns the IP options given on the command line. Only
+// flags that were set explicitly are returned, so they override the config.
+func cliProbeOptions() (config.ProbeOptions, error) {
+	var opts config.ProbeOptions
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ttl":
+			opts.TTL = &ttlFlag
+		case "tos":
+			opts.TOS = &tosFlag
+		case "dscp":
+			opts.DSCP = &dscpFlag
+		case "df":
+			opts.DontFragment = &dfFlag
+		}
+	})
+	switch {
+	case opts.TTL != nil && (ttlFlag < 1 || ttlFlag > 255):
+		err = fmt.Errorf("ttl must be between 1 and 255")
+	case opts.TOS != nil && (tosFlag < 0 || tosFlag > 255):
+		err = fmt.Errorf("tos must be between 0 and 255")
+	case opts.DSCP != nil && (dscpFlag < 0 || dscpFlag > 63):
+		err = fmt.Errorf("dscp must be between 0 and 63")
+	case opts.TOS != nil && opts.DSCP != nil:
+		err = fmt.Errorf("--tos and --dscp are mutually exclusive")
+	}
+	return opts, err
+}
+
+// cliStateOptions returns the up/down thresholds given on the command line.
+// Only flags that were set explicitly are returned, so they override the
+// config.
+func cliStateOptions() (config.StateOptions, error) {
+	var opts config.StateOptions
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "down-after":
+			opts.DownAfter = &downFlag
+		case "up-after":
+			opts.UpAfter = &upFlag
+		case "flap-count":
+			opts.FlapCount = &flapFlag
+		case "flap-window":
+			seconds, perr := strconv.ParseFloat(flapWinFlag, 64)
+			if perr != nil || seconds <= 0 {
+				err = fmt.Errorf("invalid flap window %q", flapWinFlag)
+				return
+			}
+			window := time.Duration(seconds * float64(time.Second))
+			opts.FlapWindow = &window
+		}
+	})
+	switch {
+	case err != nil:
+	case opts.DownAfter != nil && downFlag < 1:
+		err = fmt.Errorf("down-after must be at least 1")
+	case opts.UpAfter != nil && upFlag < 1:
+		err = fmt.Errorf("up-after must be at least 1")
+	case opts.FlapCount != nil && flapFlag < 0:
+		err = fmt.Errorf("flap-count must not be negative")
+	}
+	return opts, err
+}
+
+// thresholds returns the state machine settings for so, with defaults for
+// those that are unset
+func thresholds(so config.StateOptions) state.Thresholds {
+	th := state.Thresholds{DownAfter: 1, UpAfter: 1, FlapWindow: defaultFlapWindow}
+	if so.DownAfter != nil {
+		th.DownAfter = *so.DownAfter
+	}
+	if so.UpAfter != nil {
+		th.UpAfter = *so.UpAfter
+	}
+	if so.FlapCount != nil {
+		th.FlapCount = *so.FlapCount
+	}
+	if so.FlapWindow != nil {
+		th.FlapWindow = *so.FlapWindow
+	}
+	return th
+}
+
+// withProbeOptions returns base with the IP options in po applied
+func withProbeOptions(base ping.Options, po config.ProbeOptions) ping.Options {
+	if po.TTL != nil {
+		base.TTL = *po.TTL
+	}
+	if po.TOS != nil {
+		base.TOS = *po.TOS
+	}
+	if po.DSCP != nil {
+		base.TOS = *po.DSCP << 2
+	}
+	if po.DontFragment != nil {
+		base.DontFragment = *po.DontFragment
+	}
+	return base
+}
+
+// addressFamily returns the address family selected by the -4 and -6 flags.
+// Giving neither monitors IPv4 only, giving both every family a host has an
+// address for.
+func addressFamily() ping.Family {
+	switch {
+	case ipv4Flag && ipv6Flag:
+		return ping.DualStack
+	case ipv6Flag:
+		return ping.IPv6
+	default:
+		return ping.IPv4
+	}
+}
+
+// formatReply describes the outcome of one probe for verbose output
+func formatReply(t target, result ping.Result) string {
+	label := t.label
+	r := result.Reply
+	if r == nil {
+		return fmt.Sprintf("  %s: no reply from %v: %v", label, result.IP, result.Error)
+	}
+	if t.pinger != nil {
+		line := fmt.Sprintf("  %s: %v answered in %.3fms", label, r.From, float64(r.RTT.Microseconds())/1000)
+		if result.Error != nil {
+			line += fmt.Sprintf(": %v", result.Error)
+		}
+		return line
+	}
+	ttl := "?"
+	if r.TTL >= 0 {
+		ttl = strconv.Itoa(r.TTL)
+	}
+	line := fmt.Sprintf("  %s: %d bytes from %v: seq=%d ttl=%s time=%.3fms type=%d code=%d",
+		label, r.Size, r.From, r.Seq, ttl, float64(r.RTT.Microseconds())/1000, r.Type, r.Code)
+	if result.Error != nil {
+		line += fmt.Sprintf(": %v", result.Error)
+	}
+	return line
+}
+
+// errorClass is how a probe error is reported: its kind in the JSON records,
+// and its color and label suffix on the status line
+type errorClass struct {
+	kind  string
+	color string
+	match func(error) (suffix string, ok bool)
+}
+
+// errorClasses lists the errors probes fail with; the first that matches
+// wins. Timeouts are plain red without a suffix.
+var errorClasses = []errorClass{
+	{"timeout", colorRed, label(func(*ping.TimeoutError) string { return "" })},
+	{"corrupt", colorYellow, label(func(*ping.CorruptReplyError) string { return "(corrupt)" })},
+	{"unexpected_source", colorYellow, label(func(*ping.UnexpectedSourceError) string { return "(unexpected source)" })},
+	{"prohibited", colorBlue, label(func(*ping.AdminProhibitedError) string { return "(prohibited)" })},
+	{"unreachable", colorMagenta, label(func(*ping.DestinationUnreachableError) string { return "(unreachable)" })},
+	{"ttl_exceeded", colorCyan, label(func(*ping.TimeExceededError) string { return "(ttl exceeded)" })},
+	{"too_big", colorMagenta, label(func(*ping.PacketTooBigError) string { return "(too big)" })},
+	{"icmp", colorMagenta, label(func(e *ping.ICMPError) string { return fmt.Sprintf("(icmp %d/%d)", e.Type, e.Code) })},
+	{"refused", colorMagenta, label(func(*probe.RefusedError) string { return "(refused)" })},
+	{"connect", colorRed, label(func(*probe.ConnectError) string { return "(connect failed)" })},
+	{"http_status", colorRed, label(func(e *probe.StatusError) string { return fmt.Sprintf("(HTTP %d)", e.Status) })},
+	{"body_mismatch", colorRed, label(func(*probe.BodyError) string { return "(body mismatch)" })},
+	{"request", colorRed, label(func(*probe.RequestError) string { return "(request failed)" })},
+	{"rcode", colorRed, label(func(e *probe.RcodeError) string { return fmt.Sprintf("(%s)", e.RCode) })},
+	{"wrong_answer", colorRed, label(func(*probe.AnswerError) string { return "(wrong answer)" })},
+	{"query", colorRed, label(func(*probe.QueryError) string { return "(query failed)" })},
+	{"certificate", colorRed, label(func(e *probe.CertificateError) string { return fmt.Sprintf("(cert %s)", e.Problem) })},
+	{"cert_expiring", colorYellow, label(func(e *probe.ExpiringError) string {
+		return fmt.Sprintf("(cert expires in %.0fd)", e.Left.Hours()/24)
+	})},
+	{"handshake", colorRed, label(func(*probe.HandshakeError) string { return "(handshake failed)" })},
+	{"not_ready", colorRed, label(func(*probe.NotReadyError) string { return "(not ready)" })},
+	{"permission", colorRed, label(func(*ping.PermissionError) string { return "(permission denied)" })},
+	{"send", colorRed, label(func(*ping.SendError) string { return "(send failed)" })},
+}
+
+// label returns a match function for errors of type E, labelled by suffix
+func label[E error](suffix func(E) string) func(error) (string, bool) {
+	return func(err error) (string, bool) {
+		var e E
+		if !errors.As(err, &e) {
+			return "", false
+		}
+		return suffix(e), true
+	}
+}
+
+// classify returns the class of err and its label suffix. Errors of no
+// class are of kind other, plain red.
+func classify(err error) (errorClass, string) {
+	for _, c := range errorClasses {
+		if suffix, ok := c.match(err); ok {
+			return c, suffix
+		}
+	}
+	return errorClass{kind: "other", color: colorRed}, ""
+}
+
+// classifyError returns the color and label suffix for a failed probe, so a
+// host that is down can be told apart from one a router or firewall rejects
+func classifyError(err error) (color, suffix string) {
+	c, suffix := classify(err)
+	return c.color, suffix
+}
+
+// degraded reports whether err only warns about a reply, such as a
+// certificate about to expire, so the probe still counts as answered
+func degraded(reply *ping.Reply, err error) bool {
+	var expiringErr *probe.ExpiringError
+	return reply != nil && errors.As(err, &expiringErr)
+}
+
+// applyState overrides the color and suffix of a round while the host's
+// state disagrees with it: a failed round of a host that is still up is
+// shown as suspect, a good round of one still down as recovering, and a
+// host that keeps changing between the two as flapping.
+func applyState(m *state.Machine, color, suffix string) (string, string) {
+	switch {
+	case m.Flapping():
+		return colorYellow, "(flapping)"
+	case m.State() == state.Suspect:
+		return colorYellow, "(suspect)"
+	case m.State() == state.Recovering:
+		return colorYellow, "(recovering)"
+	default:
+		return color, suffix
 	}
+}
 
-	pinger, err := ping.New()
+// target is one monitored address of a host
+type target struct {
+	label  string
+	ip     net.IP
+	opts   ping.Options
+	pinger ping.Pinger // Probes the service; nil for ICMP echo with the shared pinger
+	stage  stageRef    // The pipeline stage the target checks, if any
+	states state.Thresholds
+}
+
+// buildTargets lists every address of every target with the probe options
+// that apply to it: command line flags, then the target's config, then the
+// global config. resolvedHosts holds the addresses of each of specs and
+// stages the pipeline stage each of them checks; the targets of a pipeline
+// get the up/down thresholds of its host.
+func buildTargets(specs []probe.Target, stages []stageRef, resolvedHosts []ping.HostInfo, cfg *config.Config, cli config.ProbeOptions, cliState config.StateOptions) ([]target, error) {
+	var targets []target
+	for i, spec := range specs {
+		host := resolvedHosts[i]
+		opts := withProbeOptions(probeOpts, cfg.HostOptions(spec.Raw).Merge(cli))
+		name := spec.Raw
+		if p := stages[i].pipeline; p != nil {
+			name = p.name
+		}
+		th := thresholds(cfg.HostStateOptions(name).Merge(cliState))
+		var pinger ping.Pinger
+		if spec.Kind != probe.ICMP {
+			serviceOpts, err := serviceOptions(cfg.Hosts[spec.Raw])
+			if err != nil {
+				return nil, fmt.Errorf("invalid config for %s: %v", spec.Raw, err)
+			}
+			if pinger, err = probe.New(spec, serviceOpts); err != nil {
+				return nil, err
+			}
+		}
+		for _, ip := range host.Addrs() {
+			targets = append(targets, target{label: hostLabel(spec.Raw, host, ip), ip: ip, opts: opts, pinger: pinger, stage: stages[i], states: th})
+		}
+	}
+	return targets, nil
+}
+
+// serviceOptions returns the settings of the service probes from a target's
+// config and the command line
+func serviceOptions(hc config.HostConfig) (probe.Options, error) {
+	h := hc.HTTP
+	opts := probe.Options{
+		HTTP: probe.HTTPOptions{
+			Method:   h.Method,
+			Status:   h.ExpectStatus,
+			Body:     h.ExpectBody,
+			Timeout:  h.Timeout,
+			Insecure: h.Insecure || insecureFlag,
+		},
+	}
+	if h.ExpectBodyRegex != "" {
+		re, err := regexp.Compile(h.ExpectBodyRegex)
+		if err != nil {
+			return opts, err
+		}
+		opts.HTTP.BodyRegexp = re
+	}
+
+	opts.TLS = probe.TLSOptions{ServerName: hc.TLS.ServerName, WarnDays: hc.TLS.WarnDays}
+	if hc.TLS.CAFile != "" {
+		pem, err := os.ReadFile(hc.TLS.CAFile)
+		if err != nil {
+			return opts, fmt.Errorf("failed to read ca_file: %v", err)
+		}
+		opts.TLS.RootCAs = x509.NewCertPool()
+		if !opts.TLS.RootCAs.AppendCertsFromPEM(pem) {
+			return opts, fmt.Errorf("no certificates found in %s", hc.TLS.CAFile)
+		}
+	}
+	return opts, nil
+}
+
+// parseTargets parses the targets given on the command line or in the config
+func parseTargets(args []string) ([]probe.Target, error) {
+	specs := make([]probe.Target, 0, len(args))
+	for _, arg := range args {
+		spec, err := probe.ParseTarget(arg)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// probeTargets sends probes probes to every target, gap apart, and returns
+// the results per target in the same order. ICMP targets are pinged with
+// pinger, others with their own. The probes of a round
+// are in flight concurrently; clk paces them. Later probes get less time
+// to be answered so that the round ends one timeout after it started. Once
+// ctx is done no more probes are sent and those in flight fail with
+// ctx.Err().
+func probeTargets(ctx context.Context, pinger ping.Pinger, clk clock, targets []target, probes int, gap time.Duration) [][]ping.Result {
+	results := make([][]ping.Result, len(targets))
+	for i := range results {
+		results[i] = make([]ping.Result, probes)
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < probes; n++ {
+		if n > 0 {
+			select {
+			case <-ctx.Done():
+			case <-clk.After(gap):
+			}
+		}
+		for i, t := range targets {
+			wg.Add(1)
+			go func(i, n int, t target) {
+				defer wg.Done()
+				opts := t.opts
+				opts.Timeout -= time.Duration(n) * gap
+				p := pinger
+				if t.pinger != nil {
+					p = t.pinger
+				}
+				reply, err := p.PingContext(ctx, t.ip, opts)
+				r := ping.Result{Host: t.label, IP: t.ip, Success: err == nil || degraded(reply, err), Error: err, Reply: reply}
+				if reply != nil {
+					r.RTT = reply.RTT
+				}
+				results[i][n] = r
+			}(i, n, t)
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+// roundSummary is the outcome of one round of probes to a target
+type roundSummary struct {
+	sent     int
+	received int
+	median   time.Duration // Median RTT of the replies, 0 if none
+	err      error         // Why probes failed, preferring errors other than timeouts
+	warn     error         // Why a reply was degraded, nil if none was
+}
+
+// summarize counts the replies of a round and finds their median RTT
+func summarize(results []ping.Result) roundSummary {
+	sum := roundSummary{sent: len(results)}
+	var rtts []time.Duration
+	for _, r := range results {
+		var timeout *ping.TimeoutError
+		switch {
+		case r.Success:
+			rtts = append(rtts, r.RTT)
+			if r.Error != nil {
+				sum.warn = r.Error
+			}
+		case sum.err == nil || !errors.As(r.Error, &timeout):
+			sum.err = r.Error
+		}
+	}
+	sum.received = len(rtts)
+	if len(rtts) > 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		sum.median = rtts[len(rtts)/2]
+		if len(rtts)%2 == 0 {
+			sum.median = (rtts[len(rtts)/2-1] + rtts[len(rtts)/2]) / 2
+		}
+	}
+	return sum
+}
+
+// loss returns the percentage of probes that got no valid reply
+func (s roundSummary) loss() float64 {
+	if s.sent == 0 {
+		return 0
+	}
+	return 100 * float64(s.sent-s.received) / float64(s.sent)
+}
+
+// classifyRound returns the color and label suffix for a round: the failure
+// color if every probe failed, yellow with the loss percentage if some did,
+// with the warning of a degraded reply, or if the median RTT is above slow,
+// green otherwise.
+func classifyRound(sum roundSummary, slow time.Duration) (color, suffix string) {
+	switch {
+	case sum.received == 0:
+		return classifyError(sum.err)
+	case sum.received < sum.sent:
+		return colorYellow, fmt.Sprintf("(%.0f%% loss)", sum.loss())
+	case sum.warn != nil:
+		return classifyError(sum.warn)
+	case slow > 0 && sum.median > slow:
+		return colorYellow, fmt.Sprintf("(%.0fms)", float64(sum.median.Microseconds())/1000)
+	default:
+		return colorGreen, ""
+	}
+}
+
+// hostLabel returns the name to display for one address of a target.
+// Dual-stack hosts get a /v4 or /v6 suffix so both families can be shown
+// side by side.
+func hostLabel(name string, host ping.HostInfo, ip net.IP) string {
+	if len(host.Addrs()) < 2 {
+		return name
+	}
+	if ip.To4() != nil {
+		return name + "/v4"
+	}
+	return name + "/v6"
+}
+
+// openPinger creates the pinger with the backend chosen by --backend or
+// exits with an explanation
+func openPinger() ping.Pinger {
+	backend, err := ping.ParseBackend(backendFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	pinger, err := ping.NewWithBackend(backend)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating pinger: %v\n", err)
+		var permErr *ping.PermissionError
+		if errors.As(err, &permErr) {
+			if backend != ping.BackendRaw {
+				fmt.Fprintf(os.Stderr, "Hint: allow unprivileged ICMP with: sysctl -w net.ipv4.ping_group_range=\"0 2147483647\"\n")
+			}
+			if backend != ping.BackendUDP {
+				fmt.Fprintf(os.Stderr, "Hint: raw sockets need root or CAP_NET_RAW (setcap cap_net_raw+ep muod)\n")
+			}
+		}
 		os.Exit(1)
 	}
-	defer pinger.Close()
+	if b, ok := pinger.(interface{ Backend() ping.Backend }); ok {
+		debugPrint("Using the %v backend", b.Backend())
+	}
+	return pinger
+}
 
-	start := time.Now()
+// clock is the source of time for the monitor loop, simulated in tests
+type clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+// realClock is the system clock
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// monitorHosts monitors the targets until the rounds run out, Ctrl+C or the
+// --until condition, and returns the exit code. If args is not empty it is
+// run as a command meanwhile; the --until condition is then waited for once
+// it has exited, and its exit status is returned if it failed. A command
+// still running when the run ends is stopped.
+func monitorHosts(targets []target, args []string) int {
+	// If count is 0, return immediately after DNS resolution
+	if countFlag == 0 {
+		return 0
+	}
+
+	// Service probes close their connections after every probe; only ICMP
+	// targets need a socket for the whole run
+	var pinger ping.Pinger
+	for _, t := range targets {
+		if t.pinger == nil {
+			pinger = openPinger()
+			defer pinger.Close()
+			break
+		}
+	}
+
+	// Report replies that arrived too late or did not match any probe
+	if reporter, ok := pinger.(ping.StrayReporter); ok && debugFlag {
+		go func() {
+			for stray := range reporter.Strays() {
+				debugPrint("Discarded %v reply from %v (seq %d, after %v)", stray.Reason, stray.From, stray.Seq, stray.RTT)
+			}
+		}()
+	}
+
+	// With --output json the records go to standard output and everything
+	// else to standard error
+	var w io.Writer = os.Stdout
+	var records *recordWriter
+	if output == outputJSON {
+		records, w = newRecordWriter(os.Stdout), os.Stderr
+	}
+
+	if len(args) == 0 {
+		// Stop on Ctrl+C and print the summary
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		return monitor(ctx, w, records, pinger, realClock{}, targets, nil)
+	}
+
+	child, err := startCommand(args, w)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	ctx, stop := child.signalContext()
+	defer stop()
+	code := monitor(ctx, w, records, pinger, realClock{}, targets, child)
+	select {
+	case <-child.done:
+		if child.code != 0 {
+			return child.code
+		}
+	default:
+		// The run ended first, after --count rounds, the deadline or a
+		// signal, and decided the exit code
+		child.stop(stopGrace)
+	}
+	return code
+}
+
+// monitor probes the targets every timeout and writes one line per round
+// to w; with records not nil the outcome of every probe goes to records
+// instead. ICMP targets are pinged with pinger, which may be nil if there
+// are none. Rounds go on until countFlag rounds have been done, forever if
+// countFlag is negative, or until ctx is done. It then writes per-host
+// statistics. With --until it stops as soon as the hosts meet the
+// condition, which applies once child has exited if it is not nil. It
+// returns the exit code.
+func monitor(ctx context.Context, w io.Writer, records *recordWriter, pinger ping.Pinger, clk clock, targets []target, child *command) int {
+	var set stats.Set
+	for _, t := range targets {
+		set.Get(t.label)
+	}
+
+	// The up/down state of each host on the status line
+	states := make(map[string]*hostState)
+	var hosts []*hostState
+	hostFor := func(name string, th state.Thresholds) *hostState {
+		if states[name] == nil {
+			states[name] = &hostState{name: name, machine: state.New(th), records: records}
+			hosts = append(hosts, states[name])
+		}
+		return states[name]
+	}
+	if changesFlag {
+		defer func() { printOutages(w, hosts, clk.Now()) }()
+	}
+	defer printSummary(w, &set)
+
+	start := clk.Now()
 	count := 0
 
+	// With --until the hosts still pending are named when the run ends
+	// without meeting the condition
+	untilFrom := start
+	interrupted := func() int {
+		if untilCond == untilNone {
+			return 0
+		}
+		return exitInterrupted
+	}
+	// With a command the condition applies once it has exited, and is met
+	// after the time from then on. The deadline still counts from the
+	// start, so that it also ends a command that hangs.
+	var gate chan struct{}
+	if child != nil {
+		gate = child.done
+	}
+	gated := func(at time.Time) bool {
+		if gate == nil {
+			return false
+		}
+		select {
+		case <-gate:
+			gate = nil
+			untilFrom = at
+			fmt.Fprintf(w, "Command exited with status %d\n", child.code)
+			return false
+		default:
+			return true
+		}
+	}
+	notMet := func(at time.Time) int {
+		waiting := gated(at)
+		pending := untilCond.pending(hosts, at, stableFor)
+		if waiting {
+			pending = append(pending, "the command")
+		}
+		fmt.Fprintf(w, "until %v: not met after %v by %s\n", untilCond, roundDuration(at.Sub(start)),
+			strings.Join(pending, ", "))
+		return exitDeadline
+	}
+	deadlineAt := start.Add(deadline)
+
 	for {
 		nextPingTime := start.Add(time.Duration(count) * timeout)
-		if wait := time.Until(nextPingTime); wait > 0 {
+		if untilCond != untilNone && deadline > 0 && !nextPingTime.Before(deadlineAt) {
+			select {
+			case <-ctx.Done():
+				return interrupted()
+			case <-clk.After(deadlineAt.Sub(clk.Now())):
+			}
+			return notMet(deadlineAt)
+		}
+		if wait := nextPingTime.Sub(clk.Now()); wait > 0 {
 			debugPrint("Waiting %v until next ping round", wait)
-			time.Sleep(wait)
+			select {
+			case <-ctx.Done():
+				return interrupted()
+			case <-clk.After(wait):
+			}
 		}
 
 		var parts []string
 
 		// Add timestamp unless plain output is requested
+		roundStart := clk.Now()
 		if !plainFlag {
-			timestamp := time.Now().Format("15:04:05")
+			timestamp := roundStart.Format("15:04:05")
 			parts = append(parts, timestamp)
 		}
 
-		// Ping each host
-		for _, host := range resolvedHosts {
-			rtt, err := pinger.Ping(host.IPAddr, timeout)
-			if err != nil {
-				debugPrint("[%s] Ping failed: %v", host.Hostname, err)
-				parts = append(parts, fmt.Sprintf("%s%s%s", colorRed, host.Hostname, colorReset))
-			} else {
-				debugPrint("[%s] Ping successful, RTT: %v", host.Hostname, rtt)
-				parts = append(parts, fmt.Sprintf("%s%s%s", colorGreen, host.Hostname, colorReset))
+		// A stage of a pipeline is only probed once the stages before it
+		// have passed
+		var probed []target
+		var indices []int
+		for i, t := range targets {
+			if p := t.stage.pipeline; p != nil && !p.attempts(t.stage.index) {
+				continue
+			}
+			probed = append(probed, t)
+			indices = append(indices, i)
+		}
+
+		// Ping every address of every host in parallel; a round cut short
+		// by Ctrl+C is not reported
+		rounds := probeTargets(ctx, pinger, clk, probed, max(probesFlag, 1), probeGap)
+		if ctx.Err() != nil {
+			return interrupted()
+		}
+		var details []string
+		sums := make([]roundSummary, len(targets))
+		for i, results := range rounds {
+			t := probed[i]
+			for n, result := range results {
+				set.Add(result)
+				if records != nil {
+					records.probe(roundStart.Add(time.Duration(n)*probeGap), t, result, count+1, n+1)
+				}
+				if verboseFlag {
+					details = append(details, formatReply(t, result))
+				}
+				if result.Error != nil {
+					debugPrint("[%s] Ping %s failed: %v", t.label, result.IP, result.Error)
+				} else {
+					debugPrint("[%s] Ping %s successful, RTT: %v", t.label, result.IP, result.RTT)
+				}
+			}
+			sums[indices[i]] = summarize(results)
+			if p := t.stage.pipeline; p != nil && sums[indices[i]].received == 0 {
+				p.fail(t.stage.index, sums[indices[i]].err)
 			}
 		}
 
-		// Print all hosts on one line with a newline at the end
-		fmt.Printf("%s\n", strings.Join(parts, " "))
+		// A pipeline is shown once, in place of its first target
+		var events, changes []string
+		finished := make(map[*pipeline]bool)
+		for i, t := range targets {
+			p := t.stage.pipeline
+			switch {
+			case p == nil:
+				h := hostFor(t.label, t.states)
+				if line := h.observe(roundStart, sums[i].received > 0); line != "" {
+					changes = append(changes, line)
+				}
+				color, suffix := classifyRound(sums[i], time.Duration(slowFlag)*time.Millisecond)
+				color, suffix = applyState(h.machine, color, suffix)
+				parts = append(parts, fmt.Sprintf("%s%s%s%s", color, t.label, suffix, colorReset))
+			case !finished[p]:
+				finished[p] = true
+				events = append(events, p.finish(roundStart)...)
+				h := hostFor(p.name, t.states)
+				if line := h.observe(roundStart, p.ready == len(p.stages)); line != "" {
+					changes = append(changes, line)
+				}
+				color, label := p.status()
+				if c, suffix := applyState(h.machine, color, ""); suffix != "" {
+					color, label = c, p.name+suffix
+				}
+				parts = append(parts, fmt.Sprintf("%s%s%s", color, label, colorReset))
+			}
+		}
+
+		// Print all hosts on one line with a newline at the end, or with
+		// --changes only the hosts that went up or down. The records
+		// replace both with --output json.
+		lines := append([]string{strings.Join(parts, " ")}, events...)
+		lines = append(lines, details...)
+		switch {
+		case records != nil:
+			lines = nil
+		case changesFlag:
+			lines = append(changes, events...)
+		}
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+		if records != nil && records.err != nil {
+			// Nobody reads the records any more, e.g. after | head
+			fmt.Fprintf(w, "Error: failed to write records: %v\n", records.err)
+			return 1
+		}
+
+		if untilCond != untilNone && !gated(roundStart) {
+			pending := untilCond.pending(hosts, roundStart, stableFor)
+			if len(pending) == 0 || anyFlag && len(pending) < len(hosts) {
+				fmt.Fprintf(w, "until %v: met after %v\n", untilCond, roundDuration(roundStart.Sub(untilFrom)))
+				return exitMet
+			}
+		}
 
 		count++
 		if countFlag > 0 && count >= countFlag {
 			break
 		}
 	}
+	if untilCond != untilNone {
+		return notMet(clk.Now())
+	}
+	return 0
+}
+
+// printSummary writes a table of per-host statistics, like ping does
+// when it finishes
+func printSummary(w io.Writer, set *stats.Set) {
+	hosts := set.Hosts()
+	width := len("Host")
+	for _, host := range hosts {
+		width = max(width, len(host))
+	}
+
+	fmt.Fprintf(w, "\n--- muod statistics ---\n")
+	fmt.Fprintf(w, "RTTs in milliseconds\n")
+	fmt.Fprintf(w, "%-*s %5s %5s %6s %7s %7s %7s %7s %7s %7s %7s %7s\n", width, "Host",
+		"Sent", "Recv", "Loss%", "Min", "Avg", "Max", "Mdev", "P50", "P95", "P99", "Jitter")
+	for _, host := range hosts {
+		s := set.Get(host).Summary()
+		if s.Received == 0 {
+			fmt.Fprintf(w, "%-*s %5d %5d %5.1f%%\n", width, host, s.Sent, s.Received, s.Loss)
+			continue
+		}
+		fmt.Fprintf(w, "%-*s %5d %5d %5.1f%% %7s %7s %7s %7s %7s %7s %7s %7s\n", width, host,
+			s.Sent, s.Received, s.Loss, ms(s.Min), ms(s.Avg), ms(s.Max), ms(s.Mdev),
+			ms(s.P50), ms(s.P95), ms(s.P99), ms(s.Jitter))
+	}
 }
 
 func main() {
+	// Subcommands have their own flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "mtu":
+			os.Exit(runMTU(os.Args[2:]))
+		case "trace":
+			os.Exit(runTrace(os.Args[2:]))
+		}
+	}
+
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] hostname1 [hostname2 ...]\n\n", "muod")
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] target1 [target2 ...]\n", "muod")
+		fmt.Fprintf(os.Stderr, "       %s [options] target1 [target2 ...] -- command [args ...]\n", "muod")
+		fmt.Fprintf(os.Stderr, "       %s mtu [options] hostname1 [hostname2 ...]\n", "muod")
+		fmt.Fprintf(os.Stderr, "       %s trace [options] hostname\n\n", "muod")
+		fmt.Fprintf(os.Stderr, "Targets:\n")
+		fmt.Fprintf(os.Stderr, "  hostname                    ICMP echo\n")
+		fmt.Fprintf(os.Stderr, "  host:port, tcp://host:port  TCP connect\n")
+		fmt.Fprintf(os.Stderr, "  http://..., https://...     HTTP request\n")
+		fmt.Fprintf(os.Stderr, "  dns://server/name?type=A    DNS query\n")
+		fmt.Fprintf(os.Stderr, "  tls://host:port             TLS handshake and certificate check\n")
+		fmt.Fprintf(os.Stderr, "  ssh://, smtp://, redis://,  Service greeting or readiness check\n")
+		fmt.Fprintf(os.Stderr, "  postgres://host[:port]\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nConfiguration:\n")
@@ -154,7 +1022,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "    default_count: -1\n")
 	}
 	
-	flag.Parse()
+	args, cmdArgs := splitCommand(os.Args[1:])
+	flag.CommandLine.Parse(args)
 
 	// Load configuration
 	cfg, err := config.LoadConfig(configFlag)
@@ -175,21 +1044,121 @@ func main() {
 		os.Exit(1)
 	}
 
+	pattern, err := ping.ParsePattern(patternFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if sizeFlag < 0 || sizeFlag > ping.MaxSize {
+		fmt.Fprintf(os.Stderr, "Error: size must be between 0 and %d\n", ping.MaxSize)
+		os.Exit(1)
+	}
+	probeOpts = ping.Options{Timeout: timeout, Size: sizeFlag, Pattern: pattern, Verify: verifyFlag}
+	if _, err := ping.ParseBackend(backendFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	gap, err := strconv.ParseFloat(gapFlag, 64)
+	if err != nil || gap < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid probe gap %q\n", gapFlag)
+		os.Exit(1)
+	}
+	probeGap = time.Duration(gap * float64(time.Second))
+	if probesFlag < 1 {
+		fmt.Fprintf(os.Stderr, "Error: probes must be at least 1\n")
+		os.Exit(1)
+	}
+	if spread := time.Duration(probesFlag-1) * probeGap; spread >= timeout {
+		fmt.Fprintf(os.Stderr, "Error: %d probes %v apart do not fit in a %v round; lower --probe-gap or raise --timeout\n",
+			probesFlag, probeGap, timeout)
+		os.Exit(1)
+	}
+
+	cliOpts, err := cliProbeOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	cliState, err := cliStateOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	untilCond, err = parseUntil(untilFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	output, err = parseOutput(outputFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	stableFor, err = parseDuration(stableFlag)
+	if err != nil || stableFor < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid --stable-for %q\n", stableFlag)
+		os.Exit(1)
+	}
+	deadline, err = parseDuration(deadlineFlag)
+	if err != nil || deadline < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid --deadline %q\n", deadlineFlag)
+		os.Exit(1)
+	}
+	if len(cmdArgs) > 0 && untilCond == untilNone {
+		// After a command, wait for the hosts to be back up
+		untilCond = untilUp
+	}
+	if untilCond == untilNone && (anyFlag || stableFor > 0 || deadline > 0) {
+		fmt.Fprintf(os.Stderr, "Error: --any, --stable-for and --deadline need --until\n")
+		os.Exit(1)
+	}
+
 	hosts := flag.Args()
+	if len(hosts) < 1 {
+		hosts = cfg.DefaultHosts
+	}
 	if len(hosts) < 1 {
 		flag.Usage()
 		os.Exit(1)
 	}
+	specs, err := parseTargets(hosts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	specs, stages, err := expandStages(specs, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
 	debugPrint("Resolving hosts...")
-	resolvedHosts, err := ping.ResolveHosts(hosts)
+	names := make([]string, len(specs))
+	for i, spec := range specs {
+		names[i] = spec.Host
+	}
+	resolvedHosts, err := ping.ResolveHostsFamily(names, addressFamily())
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
+	targets, err := buildTargets(specs, stages, resolvedHosts, cfg, cliOpts, cliState)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Standard output is left to the records with --output json
+	messages := os.Stdout
+	if output == outputJSON {
+		messages = os.Stderr
+	}
+
 	if countFlag == 0 {
-		fmt.Println("DNS resolution complete. Exiting as requested (count=0).")
+		fmt.Fprintln(messages, "DNS resolution complete. Exiting as requested (count=0).")
 		os.Exit(0)
 	}
 
@@ -204,12 +1173,15 @@ func main() {
 			status += "s"
 		}
 	}
+	if probesFlag > 1 {
+		status += fmt.Sprintf(" with %d probes each", probesFlag)
+	}
 	status += fmt.Sprintf(" (timeout: %.1fs) - Press Ctrl+C to stop", timeout.Seconds())
-	fmt.Println(status)
+	fmt.Fprintln(messages, status)
 
 	if debugFlag {
-		fmt.Println("Debug mode enabled")
+		fmt.Fprintln(messages, "Debug mode enabled")
 	}
 	
-	monitorHosts(resolvedHosts)
+	os.Exit(monitorHosts(targets, cmdArgs))
 } 
\ No newline at end of file
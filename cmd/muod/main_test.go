@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/config"
+	"github.com/fmattheus/muod/pkg/ping"
+	"github.com/fmattheus/muod/pkg/ping/pingtest"
+	"github.com/fmattheus/muod/pkg/probe"
+	"github.com/fmattheus/muod/pkg/state"
+)
+
+// TestMonitor runs the monitor loop against simulated hosts
+func TestMonitor(t *testing.T) {
+	up, flaky := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	clock := pingtest.NewClock(time.Time{})
+	pinger := pingtest.New(clock, 1)
+	defer pinger.Close()
+	pinger.SetHost(up, pingtest.Host{Latency: pingtest.Fixed(10 * time.Millisecond)})
+	pinger.SetHost(flaky, pingtest.Host{
+		Latency: pingtest.Fixed(10 * time.Millisecond),
+		Outages: []pingtest.Outage{{Start: clock.At(2 * time.Second), End: clock.At(4 * time.Second)}},
+	})
+
+	countFlag, timeout, plainFlag = 5, time.Second, true
+	targets := []target{
+		{label: "up", ip: up, opts: ping.Options{Timeout: time.Second}},
+		{label: "flaky", ip: flaky, opts: ping.Options{Timeout: time.Second}},
+	}
+	var out bytes.Buffer
+	monitor(context.Background(), &out, nil, pinger, clock, targets, nil)
+
+	green := func(label string) string { return colorGreen + label + colorReset }
+	red := func(label string) string { return colorRed + label + colorReset }
+	rounds, summary := splitSummary(t, out.String())
+	lines := strings.Split(rounds, "\n")
+	want := []string{
+		green("up") + " " + green("flaky"),
+		green("up") + " " + green("flaky"),
+		green("up") + " " + red("flaky"),
+		green("up") + " " + red("flaky"),
+		green("up") + " " + green("flaky"),
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d rounds, got %d:\n%s", len(want), len(lines), out.String())
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("Round %d: expected %q, got %q", i+1, want[i], lines[i])
+		}
+	}
+	if elapsed := clock.Elapsed(); elapsed != 4*time.Second {
+		t.Errorf("Expected the rounds to span 4s, got %v", elapsed)
+	}
+
+	// The summary has a header and one row per host
+	rows := strings.Split(summary, "\n")
+	if len(rows) != 3 || !strings.HasPrefix(rows[1], "up ") || !strings.HasPrefix(rows[2], "flaky ") {
+		t.Fatalf("Expected a summary row per host, got:\n%s", summary)
+	}
+	if fields := strings.Fields(rows[2]); fields[1] != "5" || fields[2] != "3" || fields[3] != "40.0%" || fields[5] != "10.0" {
+		t.Errorf("Expected 3 of 5 received from flaky with a 10ms average, got %v", fields)
+	}
+}
+
+// splitSummary splits monitor output into the round lines and the summary
+// table
+func splitSummary(t *testing.T, out string) (string, string) {
+	rounds, summary, ok := strings.Cut(out, "\n\n--- muod statistics ---\n")
+	if !ok {
+		t.Fatalf("Expected a summary after the rounds, got:\n%s", out)
+	}
+	summary = strings.TrimPrefix(summary, "RTTs in milliseconds\n")
+	return rounds, strings.TrimSuffix(summary, "\n")
+}
+
+// TestMonitorProbes tests that a round of several probes reports partial loss
+func TestMonitorProbes(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	host := pingtest.Host{Latency: pingtest.Fixed(10 * time.Millisecond), Loss: 0.5}
+	clock := pingtest.NewClock(time.Time{})
+	pinger := pingtest.New(clock, 7)
+	defer pinger.Close()
+	pinger.SetHost(ip, host)
+
+	// A twin with the same seed loses the same probes of each round
+	twin := pingtest.New(pingtest.NewClock(time.Time{}), 7)
+	twin.SetHost(ip, host)
+	var want string
+	for round := 0; round < 4; round++ {
+		received := 0
+		for n := 0; n < 5; n++ {
+			if _, err := twin.Ping(ip, time.Second); err == nil {
+				received++
+			}
+		}
+		switch received {
+		case 0:
+			want += colorRed + "host" + colorReset + "\n"
+		case 5:
+			want += colorGreen + "host" + colorReset + "\n"
+		default:
+			want += fmt.Sprintf("%shost(%d%% loss)%s\n", colorYellow, 100-20*received, colorReset)
+		}
+	}
+
+	countFlag, timeout, plainFlag = 4, time.Second, true
+	probesFlag, probeGap = 5, 100*time.Millisecond
+	defer func() { probesFlag, probeGap = 1, 0 }()
+	var out bytes.Buffer
+	monitor(context.Background(), &out, nil, pinger, clock, []target{{label: "host", ip: ip, opts: ping.Options{Timeout: time.Second}}}, nil)
+
+	if rounds, _ := splitSummary(t, out.String()); rounds+"\n" != want {
+		t.Errorf("Expected %q, got %q", want, rounds+"\n")
+	}
+	if !strings.Contains(want, "loss") {
+		t.Errorf("Expected the seed to give partial loss in some round")
+	}
+	if sent := pinger.Sent(ip); sent != 20 {
+		t.Errorf("Expected 20 probes, got %d", sent)
+	}
+}
+
+// cancelWriter cancels a context once a number of lines have been written
+type cancelWriter struct {
+	bytes.Buffer
+	lines  int
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	w.lines -= bytes.Count(p, []byte("\n"))
+	if w.lines <= 0 {
+		w.cancel()
+	}
+	return w.Buffer.Write(p)
+}
+
+// TestMonitorInterrupted tests that an endless run stops when its context
+// is cancelled and still prints the summary
+func TestMonitorInterrupted(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	clock := pingtest.NewClock(time.Time{})
+	pinger := pingtest.New(clock, 1)
+	defer pinger.Close()
+	pinger.SetHost(ip, pingtest.Host{Latency: pingtest.Fixed(10 * time.Millisecond)})
+
+	countFlag, timeout, plainFlag = -1, time.Second, true
+	ctx, cancel := context.WithCancel(context.Background())
+	out := &cancelWriter{lines: 3, cancel: cancel}
+	monitor(ctx, out, nil, pinger, clock, []target{{label: "host", ip: ip, opts: ping.Options{Timeout: time.Second}}}, nil)
+
+	rounds, summary := splitSummary(t, out.String())
+	if n := strings.Count(rounds, "\n") + 1; n != 3 {
+		t.Errorf("Expected 3 rounds before the interrupt, got %d", n)
+	}
+	if fields := strings.Fields(strings.Split(summary, "\n")[1]); fields[1] != "3" || fields[2] != "3" {
+		t.Errorf("Expected 3 of 3 received, got %v", fields)
+	}
+}
+
+// TestMonitorServiceTargets tests that targets with their own pinger are
+// probed with it rather than with the shared ICMP pinger
+func TestMonitorServiceTargets(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	clock := pingtest.NewClock(time.Time{})
+	icmp := pingtest.New(clock, 1)
+	defer icmp.Close()
+	icmp.SetHost(ip, pingtest.Host{Latency: pingtest.Fixed(10 * time.Millisecond)})
+	// The host answers pings but not on the service port
+	service := pingtest.New(clock, 1)
+	defer service.Close()
+	service.SetHost(ip, pingtest.Host{Loss: 1})
+
+	specs, err := parseTargets([]string{"192.0.2.1", "192.0.2.1:22"})
+	if err != nil {
+		t.Fatalf("Failed to parse targets: %v", err)
+	}
+	hosts := []ping.HostInfo{{Hostname: "192.0.2.1", IPAddr: ip}, {Hostname: "192.0.2.1", IPAddr: ip}}
+	probeOpts = ping.Options{Timeout: time.Second}
+	targets, err := buildTargets(specs, make([]stageRef, len(specs)), hosts, config.DefaultConfig(), config.ProbeOptions{}, config.StateOptions{})
+	if err != nil {
+		t.Fatalf("Failed to build targets: %v", err)
+	}
+	if len(targets) != 2 || targets[0].pinger != nil || targets[1].pinger == nil || targets[1].label != "192.0.2.1:22" {
+		t.Fatalf("Expected an ICMP target and a TCP target, got %+v", targets)
+	}
+	targets[1].pinger = service
+
+	countFlag, timeout, plainFlag = 1, time.Second, true
+	var out bytes.Buffer
+	monitor(context.Background(), &out, nil, icmp, clock, targets, nil)
+	rounds, _ := splitSummary(t, out.String())
+	if want := colorGreen + "192.0.2.1" + colorReset + " " + colorRed + "192.0.2.1:22" + colorReset; rounds != want {
+		t.Errorf("Expected %q, got %q", want, rounds)
+	}
+	if icmp.Sent(ip) != 1 || service.Sent(ip) != 1 {
+		t.Errorf("Expected one probe per pinger, got %d ICMP and %d service", icmp.Sent(ip), service.Sent(ip))
+	}
+}
+
+// TestMonitorHysteresis tests that a host is shown suspect and recovering
+// until enough rounds agree, and flapping once it changes too often
+func TestMonitorHysteresis(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	clock := pingtest.NewClock(time.Time{})
+	pinger := pingtest.New(clock, 1)
+	defer pinger.Close()
+	pinger.SetHost(ip, pingtest.Host{
+		Latency: pingtest.Fixed(10 * time.Millisecond),
+		Outages: []pingtest.Outage{
+			{Start: clock.At(time.Second), End: clock.At(2 * time.Second)},
+			{Start: clock.At(3 * time.Second), End: clock.At(5 * time.Second)},
+		},
+	})
+
+	countFlag, timeout, plainFlag = 7, time.Second, true
+	th := state.Thresholds{DownAfter: 2, UpAfter: 2, FlapCount: 2, FlapWindow: time.Minute}
+	var out bytes.Buffer
+	monitor(context.Background(), &out, nil, pinger, clock, []target{{label: "host", ip: ip, opts: ping.Options{Timeout: time.Second}, states: th}}, nil)
+
+	rounds, _ := splitSummary(t, out.String())
+	want := []string{
+		colorGreen + "host" + colorReset,
+		colorYellow + "host(suspect)" + colorReset,
+		colorGreen + "host" + colorReset,
+		colorYellow + "host(suspect)" + colorReset,
+		colorRed + "host" + colorReset,
+		colorYellow + "host(recovering)" + colorReset,
+		colorYellow + "host(flapping)" + colorReset,
+	}
+	if rounds != strings.Join(want, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(want, "\n"), rounds)
+	}
+}
+
+// expiringPinger answers like its Pinger, warning of a certificate about to
+// expire with every reply as a TLS probe does
+type expiringPinger struct {
+	ping.Pinger
+}
+
+func (p expiringPinger) PingContext(ctx context.Context, ip net.IP, opts ping.Options) (*ping.Reply, error) {
+	reply, err := p.Pinger.PingContext(ctx, ip, opts)
+	if err != nil {
+		return reply, err
+	}
+	return reply, &probe.ExpiringError{Server: ip, Subject: "bmc1", Left: 9 * 24 * time.Hour}
+}
+
+// TestMonitorExpiring tests that a target whose certificate is about to
+// expire is shown as a warning but stays up
+func TestMonitorExpiring(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	clock := pingtest.NewClock(time.Time{})
+	pinger := pingtest.New(clock, 1)
+	defer pinger.Close()
+	pinger.SetHost(ip, pingtest.Host{Latency: pingtest.Fixed(10 * time.Millisecond)})
+
+	countFlag, timeout, plainFlag = 2, time.Second, true
+	untilCond = untilUp
+	defer func() { untilCond = untilNone }()
+	var out bytes.Buffer
+	code := monitor(context.Background(), &out, nil, pinger, clock, []target{
+		{label: "tls://bmc1", ip: ip, opts: ping.Options{Timeout: time.Second}, pinger: expiringPinger{pinger}},
+	}, nil)
+
+	rounds, summary := splitSummary(t, out.String())
+	want := colorYellow + "tls://bmc1(cert expires in 9d)" + colorReset + "\nuntil up: met after 0s"
+	if code != exitMet || rounds != want {
+		t.Errorf("Expected exit %d after\n%s\ngot %d after\n%s", exitMet, want, code, rounds)
+	}
+	if !strings.Contains(summary, "tls://bmc1     1     1   0.0%") {
+		t.Errorf("Expected the reply to be counted as received, got\n%s", summary)
+	}
+}
+
+// TestMonitorChanges tests that --changes prints only the first state of
+// each host and its transitions, then every outage at exit
+func TestMonitorChanges(t *testing.T) {
+	up, db1, gone := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")
+	clock := pingtest.NewClock(time.Time{})
+	pinger := pingtest.New(clock, 1)
+	defer pinger.Close()
+	pinger.SetHost(up, pingtest.Host{Latency: pingtest.Fixed(10 * time.Millisecond)})
+	pinger.SetHost(db1, pingtest.Host{
+		Latency: pingtest.Fixed(10 * time.Millisecond),
+		Outages: []pingtest.Outage{{Start: clock.At(time.Second), End: clock.At(4 * time.Second)}},
+	})
+	pinger.SetHost(gone, pingtest.Host{Loss: 1})
+
+	countFlag, timeout, plainFlag, changesFlag = 6, time.Second, false, true
+	defer func() { plainFlag, changesFlag = true, false }()
+	opts := ping.Options{Timeout: time.Second}
+	var out bytes.Buffer
+	monitor(context.Background(), &out, nil, pinger, clock, []target{
+		{label: "up", ip: up, opts: opts},
+		{label: "db1", ip: db1, opts: opts},
+		{label: "gone", ip: gone, opts: opts},
+	}, nil)
+
+	rounds, summary := splitSummary(t, out.String())
+	want := []string{
+		"00:00:00 " + colorGreen + "up UP" + colorReset,
+		"00:00:00 " + colorGreen + "db1 UP" + colorReset,
+		"00:00:00 " + colorRed + "gone DOWN" + colorReset,
+		"00:00:01 " + colorRed + "db1 DOWN" + colorReset,
+		"00:00:04 " + colorGreen + "db1 UP after 3s down" + colorReset,
+	}
+	if rounds != strings.Join(want, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(want, "\n"), rounds)
+	}
+
+	_, outages, ok := strings.Cut(summary, "\n\n--- muod outages ---\n")
+	wantOutages := "db1\n" +
+		"  2000-01-01 00:00:01 - 2000-01-01 00:00:04  3s\n" +
+		"gone\n" +
+		"  2000-01-01 00:00:00 - ongoing              5s"
+	if !ok || outages != wantOutages {
+		t.Errorf("Expected outages\n%s\ngot\n%s", wantOutages, outages)
+	}
+}
+
+// TestMonitorChangesHysteresis tests that an outage is dated from the
+// first failed round to the first successful one, not by the rounds that
+// crossed --down-after and --up-after
+func TestMonitorChangesHysteresis(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	clock := pingtest.NewClock(time.Time{})
+	pinger := pingtest.New(clock, 1)
+	defer pinger.Close()
+	pinger.SetHost(ip, pingtest.Host{
+		Latency: pingtest.Fixed(10 * time.Millisecond),
+		Outages: []pingtest.Outage{{Start: clock.At(time.Second), End: clock.At(4 * time.Second)}},
+	})
+
+	countFlag, timeout, plainFlag, changesFlag = 7, time.Second, true, true
+	defer func() { changesFlag = false }()
+	th := state.Thresholds{DownAfter: 2, UpAfter: 2}
+	var out bytes.Buffer
+	monitor(context.Background(), &out, nil, pinger, clock, []target{{label: "db1", ip: ip, opts: ping.Options{Timeout: time.Second}, states: th}}, nil)
+
+	rounds, summary := splitSummary(t, out.String())
+	want := []string{
+		colorGreen + "db1 UP" + colorReset,
+		colorRed + "db1 DOWN" + colorReset,
+		colorGreen + "db1 UP after 3s down" + colorReset,
+	}
+	if rounds != strings.Join(want, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(want, "\n"), rounds)
+	}
+	if outage := "  2000-01-01 00:00:01 - 2000-01-01 00:00:04  3s"; !strings.HasSuffix(summary, outage) {
+		t.Errorf("Expected the outage %q, got\n%s", outage, summary)
+	}
+}
+
+// TestMonitorJSON checks the records of --output json, which scripts rely
+// on, field by field
+func TestMonitorJSON(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	clock := pingtest.NewClock(time.Time{})
+	pinger := pingtest.New(clock, 1)
+	defer pinger.Close()
+	pinger.SetHost(ip, pingtest.Host{
+		Latency: pingtest.Fixed(10 * time.Millisecond),
+		Outages: []pingtest.Outage{{Start: clock.At(time.Second), End: clock.At(3 * time.Second)}},
+	})
+
+	var out, text bytes.Buffer
+	countFlag, timeout = 4, time.Second
+	monitor(context.Background(), &text, newRecordWriter(&out), pinger, clock, []target{{label: "db1", ip: ip, opts: ping.Options{Timeout: time.Second}}}, nil)
+
+	want := []string{
+		`{"type":"probe","time":"2000-01-01T00:00:00Z","hostname":"db1","ip":"192.0.2.1","status":"up","rtt_ms":10,"round":1,"probe":1,"seq":1}`,
+		`{"type":"transition","time":"2000-01-01T00:00:00Z","hostname":"db1","from":"unknown","to":"up","flapping":false}`,
+		`{"type":"probe","time":"2000-01-01T00:00:01Z","hostname":"db1","ip":"192.0.2.1","status":"down","rtt_ms":null,"error":"timeout","message":"timeout after 1s waiting for a reply from 192.0.2.1","round":2,"probe":1}`,
+		`{"type":"transition","time":"2000-01-01T00:00:01Z","hostname":"db1","from":"up","to":"down","after_ms":1000,"flapping":false}`,
+		`{"type":"probe","time":"2000-01-01T00:00:02Z","hostname":"db1","ip":"192.0.2.1","status":"down","rtt_ms":null,"error":"timeout","message":"timeout after 1s waiting for a reply from 192.0.2.1","round":3,"probe":1}`,
+		`{"type":"probe","time":"2000-01-01T00:00:03Z","hostname":"db1","ip":"192.0.2.1","status":"up","rtt_ms":10,"round":4,"probe":1,"seq":4}`,
+		`{"type":"transition","time":"2000-01-01T00:00:03Z","hostname":"db1","from":"down","to":"up","after_ms":2000,"flapping":false}`,
+	}
+	if got := strings.TrimSpace(out.String()); got != strings.Join(want, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(want, "\n"), got)
+	}
+	if !strings.HasPrefix(text.String(), "\n--- muod statistics ---\n") {
+		t.Errorf("Expected only the summary besides the records, got %q", text.String())
+	}
+}
+
+// closedWriter fails every write like a pipe whose reader has gone
+type closedWriter struct{}
+
+func (closedWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+// TestMonitorJSONClosed tests that the run stops once the records cannot be
+// written
+func TestMonitorJSONClosed(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	clock := pingtest.NewClock(time.Time{})
+	pinger := pingtest.New(clock, 1)
+	defer pinger.Close()
+	pinger.SetHost(ip, pingtest.Host{Latency: pingtest.Fixed(10 * time.Millisecond)})
+
+	countFlag, timeout = 5, time.Second
+	var text bytes.Buffer
+	code := monitor(context.Background(), &text, newRecordWriter(closedWriter{}), pinger, clock, []target{{label: "db1", ip: ip, opts: ping.Options{Timeout: time.Second}}}, nil)
+
+	if want := "Error: failed to write records: broken pipe\n"; code != 1 || !strings.HasPrefix(text.String(), want) {
+		t.Errorf("Expected exit 1 after %q, got %d after %q", want, code, text.String())
+	}
+}
+
+// TestMonitorUntil tests that --until ends the run once the hosts meet the
+// condition, and fails naming the hosts that did not at the deadline
+func TestMonitorUntil(t *testing.T) {
+	up, db1, gone := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")
+	opts := ping.Options{Timeout: time.Second}
+	all := map[string]target{
+		"up":   {label: "up", ip: up, opts: opts},
+		"db1":  {label: "db1", ip: db1, opts: opts},
+		"gone": {label: "gone", ip: gone, opts: opts},
+	}
+	defer func() { untilCond, stableFor, deadline, anyFlag = untilNone, 0, 0, false }()
+
+	tests := []struct {
+		name     string
+		hosts    []string
+		until    untilMode
+		stable   time.Duration
+		deadline time.Duration
+		any      bool
+		code     int
+		last     string
+	}{
+		{"already up", []string{"up", "db1"}, untilUp, 0, 0, false, exitMet, "until up: met after 0s"},
+		{"down", []string{"db1"}, untilDown, 0, 0, false, exitMet, "until down: met after 2s"},
+		{"cycle held", []string{"db1"}, untilCycle, 2 * time.Second, 0, false, exitMet, "until cycle: met after 6s"},
+		{"deadline", []string{"up", "gone"}, untilUp, 0, 3 * time.Second, false, exitDeadline, "until up: not met after 3s by gone"},
+		{"any", []string{"up", "gone"}, untilUp, 0, 0, true, exitMet, "until up: met after 0s"},
+		{"rounds run out", []string{"up", "db1"}, untilCycle, 0, 0, false, exitDeadline, "until cycle: not met after 9s by up"},
+	}
+	for _, tt := range tests {
+		clock := pingtest.NewClock(time.Time{})
+		pinger := pingtest.New(clock, 1)
+		pinger.SetHost(up, pingtest.Host{Latency: pingtest.Fixed(10 * time.Millisecond)})
+		pinger.SetHost(db1, pingtest.Host{
+			Latency: pingtest.Fixed(10 * time.Millisecond),
+			Outages: []pingtest.Outage{{Start: clock.At(2 * time.Second), End: clock.At(4 * time.Second)}},
+		})
+		pinger.SetHost(gone, pingtest.Host{Loss: 1})
+		var targets []target
+		for _, name := range tt.hosts {
+			targets = append(targets, all[name])
+		}
+
+		countFlag, timeout, plainFlag = 10, time.Second, true
+		untilCond, stableFor, deadline, anyFlag = tt.until, tt.stable, tt.deadline, tt.any
+		var out bytes.Buffer
+		code := monitor(context.Background(), &out, nil, pinger, clock, targets, nil)
+		pinger.Close()
+
+		rounds, _ := splitSummary(t, out.String())
+		lines := strings.Split(rounds, "\n")
+		if code != tt.code || lines[len(lines)-1] != tt.last {
+			t.Errorf("%s: expected exit %d after %q, got %d after %q", tt.name, tt.code, tt.last, code, lines[len(lines)-1])
+		}
+	}
+}
+
+// TestMonitorCommand checks that --until only applies once the command has
+// exited
+func TestMonitorCommand(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	defer func() { untilCond, deadline = untilNone, 0 }()
+
+	tests := []struct {
+		name     string
+		exited   bool
+		deadline time.Duration
+		code     int
+		last     string
+	}{
+		{"running", false, 0, exitDeadline, "until up: not met after 2s by the command"},
+		{"exited", true, 0, exitMet, "Command exited with status 2\nuntil up: met after 0s"},
+		{"hung", false, time.Second, exitDeadline, "until up: not met after 1s by the command"},
+	}
+	for _, tt := range tests {
+		clock := pingtest.NewClock(time.Time{})
+		pinger := pingtest.New(clock, 1)
+		pinger.SetHost(ip, pingtest.Host{Latency: pingtest.Fixed(10 * time.Millisecond)})
+		child := &command{done: make(chan struct{}), code: 2}
+		if tt.exited {
+			close(child.done)
+		}
+
+		countFlag, timeout, plainFlag = 3, time.Second, true
+		untilCond, deadline = untilUp, tt.deadline
+		var out bytes.Buffer
+		code := monitor(context.Background(), &out, nil, pinger, clock, []target{{label: "web1", ip: ip, opts: ping.Options{Timeout: time.Second}}}, child)
+		pinger.Close()
+
+		rounds, _ := splitSummary(t, out.String())
+		if code != tt.code || !strings.HasSuffix(rounds, tt.last) {
+			t.Errorf("%s: expected exit %d after %q, got %d after %q", tt.name, tt.code, tt.last, code, rounds)
+		}
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	own, cmd := splitCommand([]string{"-c", "3", "web1", "--", "ansible-playbook", "--", "reboot.yml"})
+	if strings.Join(own, " ") != "-c 3 web1" || strings.Join(cmd, " ") != "ansible-playbook -- reboot.yml" {
+		t.Errorf("Expected own [-c 3 web1] and command [ansible-playbook -- reboot.yml], got %v and %v", own, cmd)
+	}
+	if own, cmd := splitCommand([]string{"web1"}); len(own) != 1 || cmd != nil {
+		t.Errorf("Expected no command, got %v and %v", own, cmd)
+	}
+}
+
+// TestAddressFamily tests that IPv4 stays the default and -4 -6 selects both
+func TestAddressFamily(t *testing.T) {
+	defer func() { ipv4Flag, ipv6Flag = false, false }()
+	tests := []struct {
+		v4, v6 bool
+		want   ping.Family
+	}{
+		{false, false, ping.IPv4},
+		{true, false, ping.IPv4},
+		{false, true, ping.IPv6},
+		{true, true, ping.DualStack},
+	}
+	for _, tt := range tests {
+		ipv4Flag, ipv6Flag = tt.v4, tt.v6
+		if got := addressFamily(); got != tt.want {
+			t.Errorf("-4=%v -6=%v: expected family %d, got %d", tt.v4, tt.v6, tt.want, got)
+		}
+	}
+}
+
+// TestMonitorStages follows a staged host through a reboot: the SSH stage
+// is only probed while ping passes, and each stage reports when it became
+// ready again
+func TestMonitorStages(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	clock := pingtest.NewClock(time.Time{})
+	icmp := pingtest.New(clock, 1)
+	defer icmp.Close()
+	icmp.SetHost(ip, pingtest.Host{
+		Latency: pingtest.Fixed(10 * time.Millisecond),
+		Outages: []pingtest.Outage{{Start: clock.At(time.Second), End: clock.At(3 * time.Second)}},
+	})
+	ssh := pingtest.New(clock, 1)
+	defer ssh.Close()
+	ssh.SetHost(ip, pingtest.Host{
+		Latency: pingtest.Fixed(10 * time.Millisecond),
+		Outages: []pingtest.Outage{{Start: clock.At(time.Second), End: clock.At(5 * time.Second)}},
+	})
+
+	cfg := config.DefaultConfig()
+	cfg.Hosts = map[string]config.HostConfig{"web1": {Stages: []config.StageConfig{
+		{Check: "192.0.2.1"},
+		{Name: "ssh", Check: "192.0.2.1:22"},
+	}}}
+	specs, err := parseTargets([]string{"web1"})
+	if err != nil {
+		t.Fatalf("Failed to parse targets: %v", err)
+	}
+	specs, stages, err := expandStages(specs, cfg)
+	if err != nil {
+		t.Fatalf("Failed to expand stages: %v", err)
+	}
+	hosts := []ping.HostInfo{{Hostname: "192.0.2.1", IPAddr: ip}, {Hostname: "192.0.2.1", IPAddr: ip}}
+	probeOpts = ping.Options{Timeout: time.Second}
+	targets, err := buildTargets(specs, stages, hosts, cfg, config.ProbeOptions{}, config.StateOptions{})
+	if err != nil {
+		t.Fatalf("Failed to build targets: %v", err)
+	}
+	if len(targets) != 2 || targets[0].pinger != nil || targets[1].stage.index != 1 {
+		t.Fatalf("Expected a ping stage and a TCP stage, got %+v", targets)
+	}
+	targets[1].pinger = ssh
+
+	countFlag, timeout, plainFlag = 6, time.Second, true
+	var out bytes.Buffer
+	monitor(context.Background(), &out, nil, icmp, clock, targets, nil)
+	rounds, _ := splitSummary(t, out.String())
+	want := []string{
+		colorGreen + "web1" + colorReset,
+		colorRed + "web1(ping waiting)" + colorReset,
+		colorRed + "web1(ping waiting)" + colorReset,
+		colorYellow + "web1(ping ok, ssh waiting)" + colorReset,
+		"  web1: ping ready after 2s",
+		colorYellow + "web1(ping ok, ssh waiting)" + colorReset,
+		colorGreen + "web1" + colorReset,
+		"  web1: ssh ready after 4s",
+	}
+	if rounds != strings.Join(want, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(want, "\n"), rounds)
+	}
+	if sent := ssh.Sent(ip); sent != 4 {
+		t.Errorf("Expected the SSH stage to be probed in 4 rounds, got %d", sent)
+	}
+}
+
+// TestClassifyRound tests classifying a host from loss and median RTT
+func TestClassifyRound(t *testing.T) {
+	ok := func(rtt time.Duration) ping.Result { return ping.Result{Success: true, RTT: rtt} }
+	lost := ping.Result{Error: &ping.TimeoutError{}}
+	unreachable := ping.Result{Error: &ping.DestinationUnreachableError{}}
+
+	tests := []struct {
+		name    string
+		results []ping.Result
+		color   string
+		suffix  string
+	}{
+		{"all replies", []ping.Result{ok(10 * time.Millisecond), ok(20 * time.Millisecond)}, colorGreen, ""},
+		{"partial loss", []ping.Result{ok(10 * time.Millisecond), lost, lost, ok(10 * time.Millisecond)}, colorYellow, "(50% loss)"},
+		{"all lost", []ping.Result{lost, unreachable, lost}, colorMagenta, "(unreachable)"},
+		{"port closed", []ping.Result{{Error: &probe.RefusedError{}}}, colorMagenta, "(refused)"},
+		{"answered by another address", []ping.Result{{Error: &ping.UnexpectedSourceError{}}}, colorYellow, "(unexpected source)"},
+		{"service starting", []ping.Result{{Error: &probe.NotReadyError{Service: "postgres", Reason: "starting up"}}}, colorRed, "(not ready)"},
+		{"slow median", []ping.Result{ok(10 * time.Millisecond), ok(300 * time.Millisecond), ok(400 * time.Millisecond)}, colorYellow, "(300ms)"},
+		{"one slow reply", []ping.Result{ok(10 * time.Millisecond), ok(20 * time.Millisecond), ok(400 * time.Millisecond)}, colorGreen, ""},
+	}
+	for _, tt := range tests {
+		color, suffix := classifyRound(summarize(tt.results), 200*time.Millisecond)
+		if color != tt.color || suffix != tt.suffix {
+			t.Errorf("%s: expected %q%s, got %q%s", tt.name, tt.color, tt.suffix, color, suffix)
+		}
+	}
+}
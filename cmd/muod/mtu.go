@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/config"
+	"github.com/fmattheus/muod/pkg/ping"
+	"github.com/fmattheus/muod/pkg/pmtu"
+)
+
+// mtuTarget is one address whose path MTU is measured
+type mtuTarget struct {
+	label     string
+	ip        net.IP
+	threshold int  // Alert below this MTU, 0 for no alerts
+	below     bool // Whether the last measurement was below threshold
+}
+
+// runMTU implements "muod mtu": it finds the path MTU to each host once, or
+// every interval with --watch, alerting when it drops below the threshold.
+// It returns the process exit code.
+func runMTU(args []string) int {
+	fs := flag.NewFlagSet("mtu", flag.ExitOnError)
+	var (
+		timeoutStr  string
+		intervalStr string
+		minMTU      int
+		maxMTU      int
+		threshold   int
+		watch       bool
+		count       int
+		v4, v6      bool
+	)
+	// Accepted here too so they can follow the subcommand; init has already
+	// applied them
+	fs.StringVar(&configFlag, "config", configFlag, "Path to config file")
+	fs.StringVar(&configFlag, "f", configFlag, "Path to config file (shorthand)")
+	fs.BoolVar(&debugFlag, "debug", debugFlag, "Enable debug output")
+	fs.BoolVar(&debugFlag, "d", debugFlag, "Enable debug output (shorthand)")
+	fs.StringVar(&backendFlag, "backend", "auto", "Socket type: udp, raw or auto")
+
+	fs.StringVar(&timeoutStr, "timeout", "1", "Timeout per probe in seconds")
+	fs.StringVar(&timeoutStr, "t", "1", "Timeout per probe in seconds (shorthand)")
+	fs.IntVar(&minMTU, "min", 0, "Smallest MTU to try (default 68 for IPv4, 1280 for IPv6)")
+	fs.IntVar(&maxMTU, "max", pmtu.DefaultMax, "Largest MTU to try")
+	fs.IntVar(&threshold, "threshold", 0, "Alert when the path MTU drops below this (default from config)")
+	fs.BoolVar(&watch, "watch", false, "Measure continuously")
+	fs.BoolVar(&watch, "w", false, "Measure continuously (shorthand)")
+	fs.StringVar(&intervalStr, "interval", "10", "Seconds between measurements with --watch")
+	fs.StringVar(&intervalStr, "i", "10", "Seconds between measurements (shorthand)")
+	fs.IntVar(&count, "count", -1, "Number of measurements with --watch (-1 for infinite)")
+	fs.IntVar(&count, "c", -1, "Number of measurements (shorthand)")
+	fs.BoolVar(&v4, "4", false, "Measure IPv4 paths (the default)")
+	fs.BoolVar(&v6, "6", false, "Measure IPv6 paths (with -4, both)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: muod mtu [options] hostname1 [hostname2 ...]\n\n")
+		fmt.Fprintf(os.Stderr, "Finds the largest packet that reaches each host without fragmentation.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	hosts := fs.Args()
+	if len(hosts) < 1 {
+		fs.Usage()
+		return 1
+	}
+	probeTimeout, err := parseTimeout(timeoutStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	interval, err := parseTimeout(intervalStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid interval: %v\n", err)
+		return 1
+	}
+	cfg, err := config.LoadConfig(configFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		return 1
+	}
+	ipv4Flag, ipv6Flag = v4, v6
+
+	resolvedHosts, err := ping.ResolveHostsFamily(hosts, addressFamily())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	var targets []*mtuTarget
+	for _, host := range resolvedHosts {
+		t := threshold
+		if t == 0 {
+			t = cfg.HostMTUThreshold(host.Hostname)
+		}
+		for _, ip := range host.Addrs() {
+			targets = append(targets, &mtuTarget{
+				label:     hostLabel(host.Hostname, host, ip),
+				ip:        ip,
+				threshold: t,
+			})
+		}
+	}
+
+	pinger := openPinger()
+	defer pinger.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	opts := pmtu.Options{Min: minMTU, Max: maxMTU, Timeout: probeTimeout}
+
+	if !watch {
+		status := 0
+		for _, t := range targets {
+			result, err := discover(ctx, pinger, t, opts)
+			if err != nil {
+				fmt.Printf("%s%s%s: %v\n", colorRed, t.label, colorReset, err)
+				status = 1
+				continue
+			}
+			color := colorGreen
+			if t.threshold > 0 && result.MTU < t.threshold {
+				color = colorRed
+				status = 1
+			}
+			fmt.Printf("%s%s%s: path MTU %d (%s)\n", color, t.label, colorReset, result.MTU, describeMTU(result))
+		}
+		return status
+	}
+
+	fmt.Printf("Watching path MTU to %d host(s) every %.1fs - Press Ctrl+C to stop\n", len(hosts), interval.Seconds())
+	start := time.Now()
+	for round := 0; count < 0 || round < count; round++ {
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-time.After(time.Until(start.Add(time.Duration(round) * interval))):
+		}
+
+		var parts []string
+		if !plainFlag {
+			parts = append(parts, time.Now().Format("15:04:05"))
+		}
+		var alerts []string
+		for _, t := range targets {
+			result, err := discover(ctx, pinger, t, opts)
+			if ctx.Err() != nil {
+				return 0
+			}
+			if err != nil {
+				debugPrint("[%s] Path MTU discovery failed: %v", t.label, err)
+				parts = append(parts, fmt.Sprintf("%s%s%s", colorRed, t.label, colorReset))
+				continue
+			}
+
+			below := t.threshold > 0 && result.MTU < t.threshold
+			color := colorGreen
+			if below {
+				color = colorRed
+			}
+			parts = append(parts, fmt.Sprintf("%s%s=%d%s", color, t.label, result.MTU, colorReset))
+			switch {
+			case below && !t.below:
+				alerts = append(alerts, fmt.Sprintf("ALERT: %s path MTU %d is below %d (%s)", t.label, result.MTU, t.threshold, describeMTU(result)))
+			case !below && t.below:
+				alerts = append(alerts, fmt.Sprintf("OK: %s path MTU back to %d", t.label, result.MTU))
+			}
+			t.below = below
+		}
+		fmt.Println(strings.Join(parts, " "))
+		for _, alert := range alerts {
+			fmt.Println(alert)
+		}
+	}
+	return 0
+}
+
+// discover runs a path MTU search to one target
+func discover(ctx context.Context, pinger ping.Pinger, t *mtuTarget, opts pmtu.Options) (*pmtu.Result, error) {
+	debugPrint("[%s] Discovering path MTU to %v", t.label, t.ip)
+	result, err := pmtu.Discover(ctx, pinger, t.ip, opts)
+	if err == nil {
+		debugPrint("[%s] Path MTU %d after %d probes", t.label, result.MTU, result.Probes)
+	}
+	return result, err
+}
+
+// describeMTU summarises how a path MTU was found
+func describeMTU(result *pmtu.Result) string {
+	desc := fmt.Sprintf("%d byte payload, %d probes", result.Payload, result.Probes)
+	if result.Reported > 0 {
+		if result.From != nil {
+			desc += fmt.Sprintf(", %v reported MTU %d", result.From, result.Reported)
+		} else {
+			desc += fmt.Sprintf(", local path MTU %d", result.Reported)
+		}
+	}
+	return desc
+}
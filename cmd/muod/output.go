@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// outputFormat is the format --output selects for the monitor loop
+type outputFormat int
+
+const (
+	outputText outputFormat = iota // Colored status line
+	outputJSON                     // One JSON object per line
+)
+
+// parseOutput parses the --output argument
+func parseOutput(s string) (outputFormat, error) {
+	switch strings.ToLower(s) {
+	case "", "text":
+		return outputText, nil
+	case "json":
+		return outputJSON, nil
+	default:
+		return outputText, fmt.Errorf("invalid --output %q (want text or json)", s)
+	}
+}
+
+// recordWriter writes records as newline-delimited JSON. The fields are
+// described in the README; add to them but do not rename or remove any.
+// After a write fails nothing more is written and err holds the error.
+type recordWriter struct {
+	enc *json.Encoder
+	err error
+}
+
+// probeRecord is the outcome of one probe
+type probeRecord struct {
+	Type     string   `json:"type"` // Always "probe"
+	Time     string   `json:"time"`
+	Hostname string   `json:"hostname"`
+	Stage    string   `json:"stage,omitempty"`
+	IP       string   `json:"ip"`
+	Status   string   `json:"status"`
+	RTT      *float64 `json:"rtt_ms"`
+	Error    string   `json:"error,omitempty"`
+	Message  string   `json:"message,omitempty"`
+	Round    int      `json:"round"`
+	Probe    int      `json:"probe"`
+	Seq      *int     `json:"seq,omitempty"`
+}
+
+// transitionRecord is a host going up or down
+type transitionRecord struct {
+	Type     string   `json:"type"` // Always "transition"
+	Time     string   `json:"time"`
+	Hostname string   `json:"hostname"`
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	After    *float64 `json:"after_ms,omitempty"`
+	Flapping bool     `json:"flapping"`
+}
+
+// newRecordWriter returns a recordWriter that writes to w
+func newRecordWriter(w io.Writer) *recordWriter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &recordWriter{enc: enc}
+}
+
+// probe writes the result of a target's n'th probe of a round, both counted
+// from 1, sent at at
+func (rw *recordWriter) probe(at time.Time, t target, result ping.Result, round, n int) {
+	rec := probeRecord{
+		Type:     "probe",
+		Time:     at.Format(time.RFC3339Nano),
+		Hostname: t.label,
+		IP:       result.IP.String(),
+		Status:   "down",
+		Round:    round,
+		Probe:    n,
+	}
+	if result.Reply != nil && t.pinger == nil {
+		// Only echo replies carry a sequence number
+		rec.Seq = &result.Reply.Seq
+	}
+	if p := t.stage.pipeline; p != nil {
+		rec.Hostname, rec.Stage = p.name, p.stages[t.stage.index]
+	}
+	if result.Success {
+		rec.Status = "up"
+		if result.Error != nil {
+			rec.Status = "degraded"
+		}
+		rtt := milliseconds(result.RTT)
+		rec.RTT = &rtt
+	}
+	if result.Error != nil {
+		rec.Error, rec.Message = errorKind(result.Error), result.Error.Error()
+	}
+	rw.write(rec)
+}
+
+// transition writes a change of h to up or down in the round that started
+// at at; since is when it entered the previous state, zero if it had none
+func (rw *recordWriter) transition(at time.Time, h *hostState, from, to string, since time.Time) {
+	rec := transitionRecord{
+		Type:     "transition",
+		Time:     at.Format(time.RFC3339Nano),
+		Hostname: h.name,
+		From:     from,
+		To:       to,
+		Flapping: h.machine.Flapping(),
+	}
+	if !since.IsZero() {
+		after := milliseconds(at.Sub(since))
+		rec.After = &after
+	}
+	rw.write(rec)
+}
+
+// write encodes rec on a line of its own unless a write failed before
+func (rw *recordWriter) write(rec any) {
+	if rw.err == nil {
+		rw.err = rw.enc.Encode(rec)
+	}
+}
+
+// milliseconds converts d to fractional milliseconds with microsecond
+// precision
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// upDown names a state for the records
+func upDown(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
+
+// errorKind returns a short, stable name for why a probe failed, from the
+// same classes as the suffixes of the status line
+func errorKind(err error) string {
+	c, _ := classify(err)
+	return c.kind
+}
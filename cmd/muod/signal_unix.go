@@ -0,0 +1,17 @@
+//go:build !windows
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// terminalSignals come from keys the terminal sends to the whole foreground
+// process group, the command included
+var terminalSignals = []os.Signal{os.Interrupt, syscall.SIGQUIT}
+
+// forwardedSignals are relayed to the command while it runs
+var forwardedSignals = []os.Signal{syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// stopSignal asks the command to exit when muod stops before it
+var stopSignal os.Signal = syscall.SIGTERM
@@ -0,0 +1,16 @@
+//go:build windows
+package main
+
+import "os"
+
+// terminalSignals come from keys the console sends to every process
+// attached to it, the command included
+var terminalSignals = []os.Signal{os.Interrupt}
+
+// forwardedSignals are relayed to the command while it runs; Windows cannot
+// send signals to other processes
+var forwardedSignals []os.Signal
+
+// stopSignal ends the command when muod stops before it; Windows can only
+// kill it
+var stopSignal = os.Kill
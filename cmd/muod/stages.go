@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/config"
+	"github.com/fmattheus/muod/pkg/probe"
+)
+
+// pipeline is a host checked in ordered stages, such as ping, then SSH,
+// then a health check, to follow it through a reboot. A stage is attempted
+// only once the stages before it passed in the last round.
+type pipeline struct {
+	name   string
+	stages []string  // Stage names in order
+	ready  int       // Number of leading stages that passed in the last round
+	downAt time.Time // Start of the round the host was first seen not ready, zero while it is
+	err    error     // Why the stage it is waiting for failed in the last round
+	failed []error   // Why each stage failed in the current round, nil if it did not
+}
+
+// stageRef places a target in a pipeline; the zero value is a target of its own
+type stageRef struct {
+	pipeline *pipeline
+	index    int
+}
+
+// newPipeline returns a pipeline with the named stages. Every stage is
+// attempted in the first round, since nothing is known about the host yet.
+func newPipeline(name string, stages []string) *pipeline {
+	return &pipeline{
+		name:   name,
+		stages: stages,
+		ready:  len(stages),
+		failed: make([]error, len(stages)),
+	}
+}
+
+// attempts reports whether stage is probed in the next round
+func (p *pipeline) attempts(stage int) bool {
+	return stage <= p.ready
+}
+
+// fail records that a target of stage got no reply this round
+func (p *pipeline) fail(stage int, err error) {
+	if err == nil {
+		err = errors.New("no reply")
+	}
+	p.failed[stage] = err
+}
+
+// finish ends the round that started at start. An attempted stage passed
+// unless a target of it failed. It returns a line for each stage that became
+// ready, with the time since the host went down.
+func (p *pipeline) finish(start time.Time) []string {
+	ready := 0
+	for ready < len(p.stages) && p.attempts(ready) && p.failed[ready] == nil {
+		ready++
+	}
+	p.err = nil
+	if ready < len(p.stages) {
+		p.err = p.failed[ready]
+	}
+	clear(p.failed)
+	var events []string
+	if !p.downAt.IsZero() {
+		for i := p.ready; i < ready; i++ {
+			events = append(events, fmt.Sprintf("  %s: %s ready after %v", p.name, p.stages[i], roundDuration(start.Sub(p.downAt))))
+		}
+	}
+	switch {
+	case ready == len(p.stages):
+		p.downAt = time.Time{}
+	case p.downAt.IsZero():
+		p.downAt = start
+	}
+	p.ready = ready
+	return events
+}
+
+// status returns the color and label of the host for the status line:
+// green once every stage is ready, otherwise the stages that passed and
+// the one it is waiting for, yellow if it got past the first stage
+func (p *pipeline) status() (color, label string) {
+	if p.ready == len(p.stages) {
+		return colorGreen, p.name
+	}
+	var parts []string
+	for _, name := range p.stages[:p.ready] {
+		parts = append(parts, name+" ok")
+	}
+	parts = append(parts, p.stages[p.ready]+" waiting")
+	color = colorYellow
+	if p.ready == 0 {
+		color, _ = classifyError(p.err)
+	}
+	return color, fmt.Sprintf("%s(%s)", p.name, strings.Join(parts, ", "))
+}
+
+// expandStages replaces each target whose config lists stages with the
+// targets of its stages. It returns the targets to build and, for each of
+// them, the pipeline stage it checks.
+func expandStages(specs []probe.Target, cfg *config.Config) ([]probe.Target, []stageRef, error) {
+	var expanded []probe.Target
+	var refs []stageRef
+	for _, spec := range specs {
+		stages := cfg.Hosts[spec.Raw].Stages
+		if len(stages) == 0 {
+			expanded = append(expanded, spec)
+			refs = append(refs, stageRef{})
+			continue
+		}
+		names := make([]string, len(stages))
+		p := newPipeline(spec.Raw, names)
+		for i, stage := range stages {
+			check, err := probe.ParseTarget(stage.Check)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid stage %d of %s: %v", i+1, spec.Raw, err)
+			}
+			names[i] = stage.Name
+			if names[i] == "" {
+				names[i] = stageName(check)
+			}
+			expanded = append(expanded, check)
+			refs = append(refs, stageRef{pipeline: p, index: i})
+		}
+	}
+	return expanded, refs, nil
+}
+
+// stageName names a stage after its check: ping for ICMP echo, tcp/port for
+// a TCP connect and the scheme otherwise
+func stageName(check probe.Target) string {
+	switch check.Kind {
+	case probe.ICMP:
+		return "ping"
+	case probe.TCP:
+		return fmt.Sprintf("tcp/%d", check.Port)
+	default:
+		return check.Kind.String()
+	}
+}
+
+// roundDuration rounds d for display, to the second once it is that long
+func roundDuration(d time.Duration) time.Duration {
+	if d >= time.Second {
+		return d.Round(time.Second)
+	}
+	return d.Round(time.Millisecond)
+}
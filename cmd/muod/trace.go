@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+	"github.com/fmattheus/muod/pkg/trace"
+)
+
+// Number of route changes kept on screen
+const maxShownChanges = 5
+
+// runTrace implements "muod trace": an mtr-style traceroute that redraws
+// per-hop loss and latency every round and flags route changes. It returns
+// the process exit code.
+func runTrace(args []string) int {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	var (
+		timeoutStr  string
+		intervalStr string
+		maxHops     int
+		count       int
+		size        int
+		report      bool
+		v4, v6      bool
+	)
+	// Accepted here too so they can follow the subcommand; init has already
+	// applied them
+	fs.StringVar(&configFlag, "config", configFlag, "Path to config file")
+	fs.StringVar(&configFlag, "f", configFlag, "Path to config file (shorthand)")
+	fs.BoolVar(&debugFlag, "debug", debugFlag, "Enable debug output")
+	fs.BoolVar(&debugFlag, "d", debugFlag, "Enable debug output (shorthand)")
+	fs.StringVar(&backendFlag, "backend", "auto", "Socket type: udp, raw or auto")
+
+	fs.StringVar(&timeoutStr, "timeout", "1", "Timeout per probe in seconds")
+	fs.StringVar(&timeoutStr, "t", "1", "Timeout per probe in seconds (shorthand)")
+	fs.StringVar(&intervalStr, "interval", "1", "Seconds between rounds")
+	fs.StringVar(&intervalStr, "i", "1", "Seconds between rounds (shorthand)")
+	fs.IntVar(&maxHops, "max-hops", trace.DefaultMaxHops, "Largest TTL to probe")
+	fs.IntVar(&maxHops, "m", trace.DefaultMaxHops, "Largest TTL to probe (shorthand)")
+	fs.IntVar(&count, "count", -1, "Number of rounds (-1 for infinite, 10 with --report)")
+	fs.IntVar(&count, "c", -1, "Number of rounds (shorthand)")
+	fs.IntVar(&size, "size", 0, "Echo payload size in bytes")
+	fs.IntVar(&size, "s", 0, "Echo payload size in bytes (shorthand)")
+	fs.BoolVar(&report, "report", false, "Print the table once after all rounds instead of redrawing it")
+	fs.BoolVar(&report, "r", false, "Print the table once after all rounds (shorthand)")
+	fs.BoolVar(&v4, "4", false, "Trace the IPv4 path (the default)")
+	fs.BoolVar(&v6, "6", false, "Trace the IPv6 path")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: muod trace [options] hostname\n\n")
+		fmt.Fprintf(os.Stderr, "Shows per-hop loss and latency to a host, updated every round.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+	probeTimeout, err := parseTimeout(timeoutStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	interval, err := parseTimeout(intervalStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid interval: %v\n", err)
+		return 1
+	}
+	if maxHops < 1 || maxHops > 255 {
+		fmt.Fprintf(os.Stderr, "Error: max-hops must be between 1 and 255\n")
+		return 1
+	}
+	if report && count < 0 {
+		count = 10
+	}
+	ipv4Flag, ipv6Flag = v4, v6
+
+	hosts, err := ping.ResolveHostsFamily(fs.Args(), addressFamily())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	host := hosts[0]
+	ip := host.Addrs()[0]
+
+	pinger := openPinger()
+	defer pinger.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	opts := trace.Options{MaxHops: maxHops, Timeout: probeTimeout, Probe: ping.Options{Size: size}}
+
+	// Redraw in place only on a terminal
+	redraw := !report && isTerminal(os.Stdout)
+
+	var path trace.Path
+	var changes []string
+	changed := make(map[int]bool)
+	start := time.Now()
+	for round := 0; count < 0 || round < count; round++ {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(start.Add(time.Duration(round) * interval))):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		probes := trace.Round(ctx, pinger, ip, opts)
+		if ctx.Err() != nil {
+			break
+		}
+		for _, c := range path.Record(probes) {
+			changed[c.TTL] = true
+			msg := fmt.Sprintf("%s hop %d changed from %v to %v", time.Now().Format("15:04:05"), c.TTL, c.From, c.To)
+			debugPrint("Route change: %s", msg)
+			changes = append(changes, msg)
+			if len(changes) > maxShownChanges {
+				changes = changes[1:]
+			}
+		}
+
+		if report {
+			continue
+		}
+		if redraw {
+			fmt.Print("\033[H\033[2J")
+		}
+		printTrace(host.Hostname, ip, &path, changed, changes)
+	}
+
+	if report || !redraw {
+		fmt.Println()
+		printTrace(host.Hostname, ip, &path, changed, changes)
+	}
+	return 0
+}
+
+// printTrace prints the hop table and recent route changes
+func printTrace(name string, ip net.IP, path *trace.Path, changed map[int]bool, changes []string) {
+	header := fmt.Sprintf("muod trace to %s (%v) - %d rounds", name, ip, path.Rounds)
+	if !plainFlag {
+		header += " - " + time.Now().Format("15:04:05")
+	}
+	fmt.Println(header)
+	fmt.Printf(" %3s  %-40s %6s %5s %7s %7s %7s %7s %7s\n", "Hop", "Address", "Loss%", "Snt", "Last", "Avg", "Best", "Wrst", "StDev")
+
+	for _, hop := range path.Hops() {
+		marker := " "
+		if changed[hop.TTL] {
+			marker = colorYellow + "*" + colorReset
+		}
+		if hop.Received() == 0 {
+			fmt.Printf("%s%3d  %-40s %5.1f%% %5d\n", marker, hop.TTL, "???", hop.Loss(), hop.Sent())
+			continue
+		}
+
+		addr := hop.Addr.String()
+		if n := len(hop.Addrs); n > 1 {
+			addr += fmt.Sprintf(" (+%d)", n-1)
+		}
+		color := colorGreen
+		switch {
+		case hop.Err != nil:
+			var suffix string
+			color, suffix = classifyError(hop.Err)
+			addr += " " + suffix
+		case hop.Loss() > 0:
+			color = colorYellow
+		}
+		fmt.Printf("%s%3d  %s%-40s%s %5.1f%% %5d %7s %7s %7s %7s %7s\n", marker, hop.TTL, color, addr, colorReset,
+			hop.Loss(), hop.Sent(), ms(hop.Last()), ms(hop.Avg()), ms(hop.Min()), ms(hop.Max()), ms(hop.Mdev()))
+	}
+	if !path.Reached() {
+		fmt.Println("  (destination not reached)")
+	}
+
+	if len(changes) > 0 {
+		fmt.Println("Route changes:")
+		for _, c := range changes {
+			fmt.Println("  " + c)
+		}
+	}
+}
+
+// ms formats a duration in milliseconds
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.1f", float64(d.Microseconds())/1000)
+}
+
+// isTerminal reports whether f is a character device
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
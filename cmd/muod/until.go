@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes of muod --until
+const (
+	exitMet         = 0   // Every host, or one with --any, met the condition
+	exitDeadline    = 3   // The deadline passed or the rounds ran out first
+	exitInterrupted = 130 // Ctrl+C before the condition was met
+)
+
+// untilMode is the condition --until waits for
+type untilMode int
+
+const (
+	untilNone  untilMode = iota
+	untilUp              // The host is up
+	untilDown            // The host is down
+	untilCycle           // The host went down and came back up
+)
+
+// parseUntil parses the --until argument
+func parseUntil(s string) (untilMode, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return untilNone, nil
+	case "up":
+		return untilUp, nil
+	case "down":
+		return untilDown, nil
+	case "cycle":
+		return untilCycle, nil
+	default:
+		return untilNone, fmt.Errorf("invalid --until %q (want up, down or cycle)", s)
+	}
+}
+
+func (u untilMode) String() string {
+	switch u {
+	case untilUp:
+		return "up"
+	case untilDown:
+		return "down"
+	case untilCycle:
+		return "cycle"
+	default:
+		return "none"
+	}
+}
+
+// met reports whether h has met the condition for at least stable at the
+// round that started at start. A cycle is met once a host that has been
+// seen down has been up again for stable.
+func (u untilMode) met(h *hostState, start time.Time, stable time.Duration) bool {
+	up := h.machine.State().IsUp()
+	held := start.Sub(h.machine.Since()) >= stable
+	switch u {
+	case untilUp:
+		return up && held
+	case untilDown:
+		return !up && held
+	case untilCycle:
+		return len(h.outages) > 0 && up && held
+	default:
+		return false
+	}
+}
+
+// pending returns the names of the hosts that have not met the condition
+func (u untilMode) pending(hosts []*hostState, start time.Time, stable time.Duration) []string {
+	var names []string
+	for _, h := range hosts {
+		if !u.met(h, start, stable) {
+			names = append(names, h.name)
+		}
+	}
+	return names
+}
+
+// parseDuration parses a duration such as 30s or 5m, or a number of seconds
+func parseDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -37,6 +38,228 @@ type Config struct {
 	
 	// Default number of ping rounds (-1 for infinite)
 	DefaultCount int `yaml:"default_count"`
+
+	// IP options for every probe, unless overridden per host
+	ProbeOptions `yaml:",inline"`
+
+	// Up/down thresholds and flap detection, unless overridden per host
+	StateOptions `yaml:",inline"`
+
+	// Path MTU below which "muod mtu --watch" alerts, 0 for no alerts
+	MTUThreshold int `yaml:"mtu_threshold,omitempty"`
+
+	// Per-host settings keyed by the target given on the command line
+	Hosts map[string]HostConfig `yaml:"hosts,omitempty"`
+
+	// Targets to monitor when none are given on the command line: hostnames
+	// for ICMP echo, host:port or tcp://host:port for a TCP connect
+	DefaultHosts []string `yaml:"default_hosts,omitempty"`
+}
+
+// ProbeOptions are IP-level options for outgoing echo requests. Unset
+// options fall back to the global setting, then to the system default.
+type ProbeOptions struct {
+	// IPv4 TTL or IPv6 hop limit (1-255)
+	TTL *int `yaml:"ttl,omitempty"`
+
+	// IPv4 TOS byte or IPv6 traffic class (0-255)
+	TOS *int `yaml:"tos,omitempty"`
+
+	// DSCP code point (0-63), an alternative to TOS
+	DSCP *int `yaml:"dscp,omitempty"`
+
+	// Whether to set the Don't Fragment bit
+	DontFragment *bool `yaml:"dont_fragment,omitempty"`
+}
+
+// StateOptions control when a host is shown as up or down. Unset options
+// fall back to the global setting, then to the default.
+type StateOptions struct {
+	// Consecutive failed rounds before a host is down (default 1)
+	DownAfter *int `yaml:"down_after,omitempty"`
+
+	// Consecutive successful rounds before a host is up again (default 1)
+	UpAfter *int `yaml:"up_after,omitempty"`
+
+	// Up/down changes within flap_window that mark a host as flapping (0 to disable)
+	FlapCount *int `yaml:"flap_count,omitempty"`
+
+	// Window over which changes are counted for flap detection
+	FlapWindow *time.Duration `yaml:"flap_window,omitempty"`
+}
+
+// HostConfig holds the settings for one host
+type HostConfig struct {
+	ProbeOptions `yaml:",inline"`
+	StateOptions `yaml:",inline"`
+
+	// Path MTU below which "muod mtu --watch" alerts, overriding the global one
+	MTUThreshold int `yaml:"mtu_threshold,omitempty"`
+
+	// Request settings of an http:// or https:// target
+	HTTP HTTPConfig `yaml:"http,omitempty"`
+
+	// Certificate checks of a tls:// target
+	TLS TLSConfig `yaml:"tls,omitempty"`
+
+	// Ordered readiness checks that replace the host's own probe. Each stage
+	// is attempted only once the stages before it pass.
+	Stages []StageConfig `yaml:"stages,omitempty"`
+}
+
+// StageConfig is one readiness check of a host. It can be written as just
+// the check target.
+type StageConfig struct {
+	// Name shown in the status line (default from the check, e.g. ping or ssh)
+	Name string `yaml:"name,omitempty"`
+
+	// Target to probe, e.g. web1, ssh://web1 or https://web1/healthz
+	Check string `yaml:"check"`
+}
+
+// UnmarshalYAML accepts either a mapping or a plain target
+func (s *StageConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		s.Name = ""
+		return node.Decode(&s.Check)
+	}
+	type plain StageConfig
+	return node.Decode((*plain)(s))
+}
+
+// HTTPConfig holds the settings of an HTTP probe
+type HTTPConfig struct {
+	// Request method (default GET)
+	Method string `yaml:"method,omitempty"`
+
+	// Accepted status codes (default 200-399)
+	ExpectStatus []int `yaml:"expect_status,omitempty"`
+
+	// Text the response body must contain
+	ExpectBody string `yaml:"expect_body,omitempty"`
+
+	// Regular expression the response body must match
+	ExpectBodyRegex string `yaml:"expect_body_regex,omitempty"`
+
+	// Time limit of a request, if shorter than the round timeout
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// Whether to skip verification of the server's certificate
+	Insecure bool `yaml:"insecure,omitempty"`
+}
+
+// TLSConfig holds the settings of a TLS probe
+type TLSConfig struct {
+	// Name to send as SNI and expect in the certificate (default: the target's host)
+	ServerName string `yaml:"server_name,omitempty"`
+
+	// Days before the certificate expires to warn (default 14, -1 to disable)
+	WarnDays int `yaml:"warn_days,omitempty"`
+
+	// PEM file of the certificate authorities to trust instead of the system ones
+	CAFile string `yaml:"ca_file,omitempty"`
+}
+
+// validate checks the HTTP settings
+func (h HTTPConfig) validate() error {
+	for _, status := range h.ExpectStatus {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("expect_status %d out of range (100-599)", status)
+		}
+	}
+	if _, err := regexp.Compile(h.ExpectBodyRegex); err != nil {
+		return fmt.Errorf("invalid expect_body_regex: %v", err)
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("negative http timeout %v", h.Timeout)
+	}
+	return nil
+}
+
+// validate checks that the options are in range
+func (o ProbeOptions) validate() error {
+	if o.TTL != nil && (*o.TTL < 1 || *o.TTL > 255) {
+		return fmt.Errorf("ttl %d out of range (1-255)", *o.TTL)
+	}
+	if o.TOS != nil && (*o.TOS < 0 || *o.TOS > 255) {
+		return fmt.Errorf("tos %d out of range (0-255)", *o.TOS)
+	}
+	if o.DSCP != nil && (*o.DSCP < 0 || *o.DSCP > 63) {
+		return fmt.Errorf("dscp %d out of range (0-63)", *o.DSCP)
+	}
+	if o.TOS != nil && o.DSCP != nil {
+		return fmt.Errorf("tos and dscp are mutually exclusive")
+	}
+	return nil
+}
+
+// validate checks that the thresholds are in range
+func (o StateOptions) validate() error {
+	if o.DownAfter != nil && *o.DownAfter < 1 {
+		return fmt.Errorf("down_after must be at least 1")
+	}
+	if o.UpAfter != nil && *o.UpAfter < 1 {
+		return fmt.Errorf("up_after must be at least 1")
+	}
+	if o.FlapCount != nil && *o.FlapCount < 0 {
+		return fmt.Errorf("negative flap_count %d", *o.FlapCount)
+	}
+	if o.FlapWindow != nil && *o.FlapWindow <= 0 {
+		return fmt.Errorf("flap_window must be positive")
+	}
+	return nil
+}
+
+// Merge returns o with the options set in override replacing its own
+func (o StateOptions) Merge(override StateOptions) StateOptions {
+	if override.DownAfter != nil {
+		o.DownAfter = override.DownAfter
+	}
+	if override.UpAfter != nil {
+		o.UpAfter = override.UpAfter
+	}
+	if override.FlapCount != nil {
+		o.FlapCount = override.FlapCount
+	}
+	if override.FlapWindow != nil {
+		o.FlapWindow = override.FlapWindow
+	}
+	return o
+}
+
+// Merge returns o with the options set in override replacing its own.
+// Setting either TOS or DSCP in override replaces both.
+func (o ProbeOptions) Merge(override ProbeOptions) ProbeOptions {
+	if override.TTL != nil {
+		o.TTL = override.TTL
+	}
+	if override.TOS != nil || override.DSCP != nil {
+		o.TOS, o.DSCP = override.TOS, override.DSCP
+	}
+	if override.DontFragment != nil {
+		o.DontFragment = override.DontFragment
+	}
+	return o
+}
+
+// HostOptions returns the probe options for host: the global options with
+// the host's own settings applied on top.
+func (c *Config) HostOptions(host string) ProbeOptions {
+	return c.ProbeOptions.Merge(c.Hosts[host].ProbeOptions)
+}
+
+// HostStateOptions returns the up/down thresholds for host: the global
+// options with the host's own settings applied on top.
+func (c *Config) HostStateOptions(host string) StateOptions {
+	return c.StateOptions.Merge(c.Hosts[host].StateOptions)
+}
+
+// HostMTUThreshold returns the path MTU alert threshold for host, 0 if none
+func (c *Config) HostMTUThreshold(host string) int {
+	if t := c.Hosts[host].MTUThreshold; t > 0 {
+		return t
+	}
+	return c.MTUThreshold
 }
 
 // DefaultConfig returns the default configuration
@@ -114,6 +337,29 @@ func LoadConfig(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %v", err)
 	}
 
+	if err := cfg.ProbeOptions.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	if err := cfg.StateOptions.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	for host, hc := range cfg.Hosts {
+		if err := hc.ProbeOptions.validate(); err != nil {
+			return nil, fmt.Errorf("invalid config for host %s: %v", host, err)
+		}
+		if err := hc.StateOptions.validate(); err != nil {
+			return nil, fmt.Errorf("invalid config for host %s: %v", host, err)
+		}
+		if err := hc.HTTP.validate(); err != nil {
+			return nil, fmt.Errorf("invalid config for host %s: %v", host, err)
+		}
+		for i, stage := range hc.Stages {
+			if stage.Check == "" {
+				return nil, fmt.Errorf("invalid config for host %s: stage %d has no check", host, i+1)
+			}
+		}
+	}
+
 	debugPrint("Successfully loaded config: timeout=%v, timestamps=%v, count=%d",
 		cfg.DefaultTimeout, cfg.ShowTimestamps, cfg.DefaultCount)
 	return cfg, nil
@@ -0,0 +1,224 @@
+package ping
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// TimeoutError is returned when no reply arrived within Options.Timeout.
+// Cancellation or expiry of the caller's context is reported as ctx.Err()
+// (context.Canceled or context.DeadlineExceeded) instead.
+type TimeoutError struct {
+	IP    net.IP        // The address that was pinged
+	After time.Duration // How long the probe waited
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timeout after %v waiting for a reply from %v", e.After, e.IP)
+}
+
+// Timeout reports true so TimeoutError satisfies net.Error-style checks.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// UnexpectedSourceError is returned when the only reply matching a probe's
+// ICMP ID, sequence number and payload came from an address other than the
+// one that was pinged, for example when a NAT or anycast address answers on
+// behalf of the destination.
+type UnexpectedSourceError struct {
+	Expected net.IP // The address that was pinged
+	Got      net.IP // The address the reply came from
+}
+
+func (e *UnexpectedSourceError) Error() string {
+	return fmt.Sprintf("reply from unexpected address %v (expected %v)", e.Got, e.Expected)
+}
+
+// CorruptReplyError is returned, together with the reply, when
+// Options.Verify is set and the echoed payload differs from the one sent.
+type CorruptReplyError struct {
+	IP     net.IP // The address that was pinged
+	Offset int    // Offset of the first byte that differs or is missing
+	Sent   int    // Payload bytes sent
+	Got    int    // Payload bytes received
+}
+
+func (e *CorruptReplyError) Error() string {
+	if e.Got != e.Sent && e.Offset == min(e.Got, e.Sent) {
+		return fmt.Sprintf("echo reply from %v has %d payload bytes, sent %d", e.IP, e.Got, e.Sent)
+	}
+	return fmt.Sprintf("corrupted echo reply from %v: payload differs at byte %d of %d", e.IP, e.Offset, e.Sent)
+}
+
+// ICMPError is returned when a probe was answered by an ICMP error message
+// that has no more specific error type. The specific types below embed it.
+type ICMPError struct {
+	From net.IP        // The router or host that sent the ICMP error, nil if generated locally
+	Type int           // ICMP type (ICMPv6 type for an IPv6 probe)
+	Code int           // ICMP code
+	RTT  time.Duration // Time from sending the probe to receiving the error
+
+	v6 bool // The probe was IPv6, so Type is an ICMPv6 type
+}
+
+func (e *ICMPError) Error() string {
+	return fmt.Sprintf("ICMP error type %d code %d %s", e.Type, e.Code, e.source())
+}
+
+// isIPv6 reports whether the error came in over ICMPv6.
+func (e *ICMPError) isIPv6() bool {
+	return e.v6 || (e.From != nil && e.From.To4() == nil)
+}
+
+// source names where the error came from for messages
+func (e *ICMPError) source() string {
+	if e.From == nil {
+		return "reported locally"
+	}
+	return fmt.Sprintf("from %v", e.From)
+}
+
+// DestinationUnreachableError is returned for ICMP Destination Unreachable
+// (ICMPv6 type 1) messages other than administrative prohibitions.
+type DestinationUnreachableError struct {
+	ICMPError
+}
+
+func (e *DestinationUnreachableError) Error() string {
+	return fmt.Sprintf("%s (%s)", unreachableText(e.Code, e.isIPv6()), e.source())
+}
+
+// unreachableText names a Destination Unreachable code.
+func unreachableText(code int, v6 bool) string {
+	if v6 {
+		switch code {
+		case 0:
+			return "no route to destination"
+		case 3:
+			return "destination address unreachable"
+		case 4:
+			return "destination port unreachable"
+		}
+	} else {
+		switch code {
+		case 0:
+			return "destination net unreachable"
+		case 1:
+			return "destination host unreachable"
+		case 2:
+			return "destination protocol unreachable"
+		case 3:
+			return "destination port unreachable"
+		case 4:
+			return "fragmentation needed"
+		case 6:
+			return "destination net unknown"
+		case 7:
+			return "destination host unknown"
+		}
+	}
+	return fmt.Sprintf("destination unreachable (code %d)", code)
+}
+
+// AdminProhibitedError is returned when a router or firewall reports the
+// probe as administratively prohibited (ICMP Destination Unreachable codes
+// 9, 10 and 13; ICMPv6 codes 1, 5 and 6).
+type AdminProhibitedError struct {
+	ICMPError
+}
+
+func (e *AdminProhibitedError) Error() string {
+	return fmt.Sprintf("communication administratively prohibited (code %d, %s)", e.Code, e.source())
+}
+
+// TimeExceededError is returned when the probe's TTL or hop limit expired in
+// transit (code 0) or fragment reassembly timed out (code 1).
+type TimeExceededError struct {
+	ICMPError
+}
+
+func (e *TimeExceededError) Error() string {
+	if e.Code == 1 {
+		return fmt.Sprintf("fragment reassembly time exceeded (%s)", e.source())
+	}
+	return fmt.Sprintf("time to live exceeded (%s)", e.source())
+}
+
+// PacketTooBigError is returned when a probe with Options.DontFragment set
+// is larger than the path MTU: a router answered with ICMP Fragmentation
+// Needed or ICMPv6 Packet Too Big, or the local host already knew the path
+// MTU was smaller and refused to send the probe, in which case From is nil.
+type PacketTooBigError struct {
+	ICMPError
+	MTU int // The MTU reported by the router or local host, 0 if unknown
+}
+
+func (e *PacketTooBigError) Error() string {
+	mtu := "unknown"
+	if e.MTU > 0 {
+		mtu = fmt.Sprint(e.MTU)
+	}
+	if e.From == nil {
+		return fmt.Sprintf("packet too big to send without fragmenting (path MTU %s)", mtu)
+	}
+	return fmt.Sprintf("packet too big (MTU %s, from %v)", mtu, e.From)
+}
+
+// newICMPError returns the most specific error for an ICMP error message of
+// the given type and code, an ICMPv6 one if v6 is set. from is nil if the
+// error was generated locally. mtu is the next-hop MTU carried by
+// Fragmentation Needed and Packet Too Big messages, 0 if unknown.
+func newICMPError(v6 bool, from net.IP, typ, code, mtu int, rtt time.Duration) error {
+	base := ICMPError{From: from, Type: typ, Code: code, RTT: rtt, v6: v6}
+	if !v6 {
+		switch {
+		case typ == 3 && code == 4:
+			return &PacketTooBigError{base, mtu}
+		case typ == 3 && (code == 9 || code == 10 || code == 13):
+			return &AdminProhibitedError{base}
+		case typ == 3:
+			return &DestinationUnreachableError{base}
+		case typ == 11:
+			return &TimeExceededError{base}
+		}
+	} else {
+		switch {
+		case typ == 1 && (code == 1 || code == 5 || code == 6):
+			return &AdminProhibitedError{base}
+		case typ == 1:
+			return &DestinationUnreachableError{base}
+		case typ == 2:
+			return &PacketTooBigError{base, mtu}
+		case typ == 3:
+			return &TimeExceededError{base}
+		}
+	}
+	return &base
+}
+
+// SendError is returned when the echo request could not be sent at all,
+// for example because the local host has no route to the destination.
+type SendError struct {
+	IP  net.IP // The address that was pinged
+	Err error  // The underlying error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("failed to send echo request to %v: %v", e.IP, e.Err)
+}
+
+func (e *SendError) Unwrap() error { return e.Err }
+
+// PermissionError is returned when the operating system refuses to open an
+// ICMP socket or send a probe. On Linux, unprivileged ICMP sockets require
+// the user's group to be within net.ipv4.ping_group_range.
+type PermissionError struct {
+	Op  string // What was being attempted
+	Err error  // The underlying error
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("permission denied %s: %v", e.Op, e.Err)
+}
+
+func (e *PermissionError) Unwrap() error { return e.Err }
@@ -0,0 +1,94 @@
+package ping
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestNewICMPError tests that ICMP errors map to the most specific type
+func TestNewICMPError(t *testing.T) {
+	v4 := net.ParseIP("192.0.2.1")
+	v6 := net.ParseIP("2001:db8::1")
+
+	tests := []struct {
+		from    net.IP
+		typ     int
+		code    int
+		want    string // Expected type
+		message string // Expected substring of the message
+	}{
+		{v4, 3, 1, "unreachable", "destination host unreachable"},
+		{v4, 3, 3, "unreachable", "destination port unreachable"},
+		{v4, 3, 13, "prohibited", "administratively prohibited"},
+		{v4, 3, 4, "too big", "MTU 1400"},
+		{v4, 11, 0, "exceeded", "time to live exceeded"},
+		{v4, 11, 1, "exceeded", "reassembly"},
+		{v4, 12, 0, "icmp", "type 12 code 0"},
+		{v6, 1, 0, "unreachable", "no route to destination"},
+		{v6, 1, 1, "prohibited", "administratively prohibited"},
+		{v6, 1, 4, "unreachable", "destination port unreachable"},
+		{v6, 2, 0, "too big", "MTU 1400"},
+		{v6, 3, 0, "exceeded", "time to live exceeded"},
+		{v6, 4, 0, "icmp", "type 4 code 0"},
+	}
+
+	for _, tt := range tests {
+		err := newICMPError(tt.from.To4() == nil, tt.from, tt.typ, tt.code, 1400, 0)
+		var got string
+		switch err.(type) {
+		case *DestinationUnreachableError:
+			got = "unreachable"
+		case *AdminProhibitedError:
+			got = "prohibited"
+		case *TimeExceededError:
+			got = "exceeded"
+		case *PacketTooBigError:
+			got = "too big"
+		case *ICMPError:
+			got = "icmp"
+		}
+		if got != tt.want {
+			t.Errorf("type %d code %d from %v: expected %s error, got %T", tt.typ, tt.code, tt.from, tt.want, err)
+		}
+		if !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("type %d code %d from %v: expected message containing %q, got %q", tt.typ, tt.code, tt.from, tt.message, err)
+		}
+		if !strings.Contains(err.Error(), tt.from.String()) {
+			t.Errorf("Expected message to name the reporting address: %q", err)
+		}
+	}
+}
+
+// TestLocalICMPError tests an ICMP error generated by the local host, which
+// has no reporting address
+func TestLocalICMPError(t *testing.T) {
+	err := newICMPError(true, nil, 1, 4, 0, 0)
+	var unreachable *DestinationUnreachableError
+	if !errors.As(err, &unreachable) || unreachable.From != nil {
+		t.Fatalf("Expected a local unreachable error, got %#v", err)
+	}
+	if msg := err.Error(); msg != "destination port unreachable (reported locally)" {
+		t.Errorf("Expected the ICMPv6 port unreachable text, got %q", msg)
+	}
+}
+
+// TestErrorUnwrap tests that wrapped errors remain reachable
+func TestErrorUnwrap(t *testing.T) {
+	cause := errors.New("network is unreachable")
+	var err error = &SendError{IP: net.ParseIP("192.0.2.1"), Err: cause}
+	if !errors.Is(err, cause) {
+		t.Error("Expected SendError to unwrap to its cause")
+	}
+
+	err = &PermissionError{Op: "opening ICMP socket", Err: cause}
+	if !errors.Is(err, cause) {
+		t.Error("Expected PermissionError to unwrap to its cause")
+	}
+
+	var timeout interface{ Timeout() bool }
+	if !errors.As(error(&TimeoutError{}), &timeout) || !timeout.Timeout() {
+		t.Error("Expected TimeoutError to report Timeout")
+	}
+}
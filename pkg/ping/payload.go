@@ -0,0 +1,89 @@
+package ping
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// MaxSize is the largest echo payload that fits in an IPv4 packet
+const MaxSize = 65535 - 20 - 8
+
+// Pattern selects how the echo payload is filled
+type Pattern struct {
+	Random bool   // Fresh random bytes for every probe
+	Fill   []byte // Repeated to fill the payload; zeros if empty
+}
+
+// ParsePattern parses a payload pattern: "zeros", "random" or a hex string
+// such as "deadbeef" or "0xa5", which is repeated to fill the payload.
+func ParsePattern(s string) (Pattern, error) {
+	switch strings.ToLower(s) {
+	case "", "zeros", "zero":
+		return Pattern{}, nil
+	case "random":
+		return Pattern{Random: true}, nil
+	}
+	fill, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(s), "0x"))
+	if err != nil || len(fill) == 0 {
+		return Pattern{}, fmt.Errorf("invalid payload pattern %q: expected zeros, random or hex bytes", s)
+	}
+	return Pattern{Fill: fill}, nil
+}
+
+func (p Pattern) String() string {
+	switch {
+	case p.Random:
+		return "random"
+	case len(p.Fill) > 0:
+		return "0x" + hex.EncodeToString(p.Fill)
+	default:
+		return "zeros"
+	}
+}
+
+// newPayload returns the payload for one probe: prefix, which identifies the
+// probe, followed by the pattern up to opts.Size bytes. The payload is never
+// shorter than prefix.
+func newPayload(prefix []byte, opts Options) ([]byte, error) {
+	if opts.Size < 0 || opts.Size > MaxSize {
+		return nil, fmt.Errorf("payload size %d out of range (0-%d)", opts.Size, MaxSize)
+	}
+	size := opts.Size
+	if size < len(prefix) {
+		size = len(prefix)
+	}
+
+	payload := make([]byte, size)
+	fill := payload[copy(payload, prefix):]
+	switch {
+	case opts.Pattern.Random:
+		if _, err := rand.Read(fill); err != nil {
+			return nil, fmt.Errorf("failed to generate random payload: %v", err)
+		}
+	case len(opts.Pattern.Fill) > 0:
+		for i := range fill {
+			fill[i] = opts.Pattern.Fill[i%len(opts.Pattern.Fill)]
+		}
+	}
+	return payload, nil
+}
+
+// verifyPayload compares an echoed payload with the one that was sent.
+func verifyPayload(ip net.IP, sent, got []byte) error {
+	for i := 0; i < len(sent) && i < len(got); i++ {
+		if sent[i] != got[i] {
+			return &CorruptReplyError{IP: ip, Offset: i, Sent: len(sent), Got: len(got)}
+		}
+	}
+	if len(sent) != len(got) {
+		offset := len(got)
+		if offset > len(sent) {
+			offset = len(sent)
+		}
+		return &CorruptReplyError{IP: ip, Offset: offset, Sent: len(sent), Got: len(got)}
+	}
+	return nil
+}
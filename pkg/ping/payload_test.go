@@ -0,0 +1,91 @@
+package ping
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// TestParsePattern tests parsing of payload patterns
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Pattern
+	}{
+		{"", Pattern{}},
+		{"zeros", Pattern{}},
+		{"random", Pattern{Random: true}},
+		{"deadbeef", Pattern{Fill: []byte{0xde, 0xad, 0xbe, 0xef}}},
+		{"0xA5", Pattern{Fill: []byte{0xa5}}},
+	}
+	for _, tt := range tests {
+		got, err := ParsePattern(tt.in)
+		if err != nil {
+			t.Errorf("ParsePattern(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got.Random != tt.want.Random || !bytes.Equal(got.Fill, tt.want.Fill) {
+			t.Errorf("ParsePattern(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"0x", "abc", "ones", "zz"} {
+		if _, err := ParsePattern(in); err == nil {
+			t.Errorf("Expected ParsePattern(%q) to fail", in)
+		}
+	}
+}
+
+// TestNewPayload tests that payloads carry the prefix and the pattern
+func TestNewPayload(t *testing.T) {
+	prefix := []byte{1, 2, 3}
+
+	payload, err := newPayload(prefix, Options{Size: 8, Pattern: Pattern{Fill: []byte{0xab, 0xcd}}})
+	if err != nil {
+		t.Fatalf("Failed to build payload: %v", err)
+	}
+	want := []byte{1, 2, 3, 0xab, 0xcd, 0xab, 0xcd, 0xab}
+	if !bytes.Equal(payload, want) {
+		t.Errorf("Expected payload %x, got %x", want, payload)
+	}
+
+	// Sizes smaller than the prefix are rounded up
+	payload, _ = newPayload(prefix, Options{Size: 1})
+	if !bytes.Equal(payload, prefix) {
+		t.Errorf("Expected payload %x, got %x", prefix, payload)
+	}
+
+	a, _ := newPayload(nil, Options{Size: 64, Pattern: Pattern{Random: true}})
+	b, _ := newPayload(nil, Options{Size: 64, Pattern: Pattern{Random: true}})
+	if bytes.Equal(a, b) {
+		t.Error("Expected random payloads to differ")
+	}
+
+	for _, size := range []int{-1, MaxSize + 1} {
+		if _, err := newPayload(prefix, Options{Size: size}); err == nil {
+			t.Errorf("Expected size %d to be rejected", size)
+		}
+	}
+}
+
+// TestVerifyPayload tests detection of corrupted and truncated replies
+func TestVerifyPayload(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	sent := []byte{1, 2, 3, 4, 5, 6}
+
+	if err := verifyPayload(ip, sent, []byte{1, 2, 3, 4, 5, 6}); err != nil {
+		t.Errorf("Expected identical payload to verify, got %v", err)
+	}
+
+	var corrupt *CorruptReplyError
+	err := verifyPayload(ip, sent, []byte{1, 2, 3, 0, 5, 6})
+	if !errors.As(err, &corrupt) || corrupt.Offset != 3 {
+		t.Errorf("Expected corruption at byte 3, got %v", err)
+	}
+
+	err = verifyPayload(ip, sent, sent[:4])
+	if !errors.As(err, &corrupt) || corrupt.Offset != 4 || corrupt.Got != 4 {
+		t.Errorf("Expected truncation at byte 4, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@
 //
 // On Unix-like systems (Linux, macOS, BSD), it uses unprivileged UDP sockets.
 // On Windows, it uses the Windows ICMP Helper API (iphlpapi.dll).
+// Both IPv4 (ICMP) and IPv6 (ICMPv6) destinations are supported.
 //
 // Example usage:
 //
@@ -18,76 +19,317 @@
 //	} else {
 //	    log.Printf("Host is up, RTT: %v", rtt)
 //	}
+//
+// A Pinger is safe for concurrent use; PingMany probes a batch of addresses
+// in parallel. PingContext ties a probe to a context so it can be cancelled:
+//
+//	reply, err := pinger.PingContext(ctx, ip, ping.Options{Timeout: timeout})
+//	if errors.Is(err, context.Canceled) {
+//	    return
+//	}
+//	log.Printf("%d bytes from %v: ttl=%d time=%v", reply.Size, reply.From, reply.TTL, reply.RTT)
 package ping
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
 // Result represents the result of a ping attempt
 type Result struct {
 	Host    string        // The hostname or IP address that was pinged
+	IP      net.IP        // The address that was pinged
 	Success bool          // Whether the ping was successful
 	RTT     time.Duration // Round-trip time if successful
 	Error   error        // Error message if unsuccessful
+	Reply   *Reply        // Details of the echo reply if successful
+}
+
+// Reply describes a received echo reply
+type Reply struct {
+	From net.IP        // The address the reply came from
+	RTT  time.Duration // Round-trip time
+	TTL  int           // IPv4 TTL or IPv6 hop limit of the reply, -1 if unknown
+	Size int           // Payload bytes received
+	Seq  int           // ICMP sequence number, 0 if the platform hides it
+	Type int           // ICMP type of the reply
+	Code int           // ICMP code of the reply
+}
+
+// Options controls a single echo request
+type Options struct {
+	// Timeout is how long to wait for a reply. Zero means wait until the
+	// context passed to PingContext is done.
+	Timeout time.Duration
+
+	// Size is the number of payload bytes to send, up to MaxSize. Sizes
+	// too small to carry the probe's identifying token are rounded up.
+	Size int
+
+	// Pattern fills the payload after the token. The zero Pattern fills
+	// it with zeros.
+	Pattern Pattern
+
+	// Verify checks that the echoed payload matches the one sent byte for
+	// byte. A mismatch is reported as a *CorruptReplyError.
+	Verify bool
+
+	// TTL is the IPv4 TTL or IPv6 hop limit of the echo request, 1-255.
+	// Zero uses the system default.
+	TTL int
+
+	// TOS is the IPv4 type-of-service byte or IPv6 traffic class of the
+	// echo request. The DSCP value is TOS >> 2. Zero sends unmarked probes.
+	TOS int
+
+	// DontFragment sets the IPv4 DF bit and disables fragmentation of IPv6
+	// probes, so probes larger than the path MTU fail rather than being
+	// fragmented. It is supported on Linux and Windows.
+	DontFragment bool
+}
+
+// validate checks that the IP-level options are in range
+func (o Options) validate() error {
+	if o.TTL < 0 || o.TTL > 255 {
+		return fmt.Errorf("TTL %d out of range (1-255)", o.TTL)
+	}
+	if o.TOS < 0 || o.TOS > 255 {
+		return fmt.Errorf("TOS %d out of range (0-255)", o.TOS)
+	}
+	return nil
 }
 
-// HostInfo represents a resolved host with its IPv4 address
+// HostInfo represents a resolved host with its IPv4 and IPv6 addresses
 type HostInfo struct {
-	Hostname string  // The original hostname provided
-	IPAddr   net.IP  // The resolved IPv4 address
+	Hostname string // The original hostname provided
+	IPAddr   net.IP // The resolved IPv4 address, nil if none was requested or found
+	IPv6Addr net.IP // The resolved IPv6 address, nil if none was requested or found
+}
+
+// Addrs returns the resolved addresses of the host, IPv4 first.
+func (h HostInfo) Addrs() []net.IP {
+	var addrs []net.IP
+	if h.IPAddr != nil {
+		addrs = append(addrs, h.IPAddr)
+	}
+	if h.IPv6Addr != nil {
+		addrs = append(addrs, h.IPv6Addr)
+	}
+	return addrs
+}
+
+// Family selects which address families are resolved and monitored.
+type Family int
+
+const (
+	// IPv4 selects IPv4 (A record) addresses only
+	IPv4 Family = 1 << iota
+	// IPv6 selects IPv6 (AAAA record) addresses only
+	IPv6
+	// DualStack selects every family a host has an address for
+	DualStack = IPv4 | IPv6
+)
+
+// Backend selects the kind of socket a Pinger uses on Unix-like systems.
+type Backend int
+
+const (
+	// BackendAuto uses unprivileged ICMP datagram sockets, falling back to
+	// raw sockets when the system denies those
+	BackendAuto Backend = iota
+	// BackendUDP uses unprivileged ICMP datagram sockets only
+	BackendUDP
+	// BackendRaw uses raw ICMP sockets only, which need root or CAP_NET_RAW
+	BackendRaw
+)
+
+func (b Backend) String() string {
+	switch b {
+	case BackendAuto:
+		return "auto"
+	case BackendUDP:
+		return "udp"
+	case BackendRaw:
+		return "raw"
+	default:
+		return fmt.Sprintf("Backend(%d)", int(b))
+	}
+}
+
+// ParseBackend parses a backend name: "auto", "udp" or "raw".
+func ParseBackend(s string) (Backend, error) {
+	for _, b := range []Backend{BackendAuto, BackendUDP, BackendRaw} {
+		if s == b.String() {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid backend %q (want auto, udp or raw)", s)
 }
 
 // Pinger defines the interface for platform-specific ping implementations.
 // Each platform (Unix-like systems and Windows) provides its own implementation
 // of this interface.
 type Pinger interface {
-	// Ping sends an ICMP echo request to the specified IP address and waits
-	// for a response up to the specified timeout duration. It returns the
-	// round-trip time if successful, or an error if the ping failed.
+	// Ping sends an ICMP echo request (ICMPv6 for IPv6 addresses) to the
+	// specified IP address and waits for a response up to the specified
+	// timeout duration. It returns the round-trip time if successful, or an
+	// error if the ping failed.
 	Ping(net.IP, time.Duration) (time.Duration, error)
-	
+
+	// PingContext is like Ping but returns the details of the echo reply,
+	// and returns as soon as ctx is done, in which case the error is
+	// ctx.Err(). A reply not arriving within opts.Timeout is reported as a
+	// *TimeoutError. A reply that fails verification is returned together
+	// with a *CorruptReplyError.
+	PingContext(ctx context.Context, ip net.IP, opts Options) (*Reply, error)
+
+	// PingMany pings all of the given IP addresses concurrently, waiting up
+	// to timeout for each, and returns one Result per address in the same
+	// order as the input.
+	PingMany([]net.IP, time.Duration) []Result
+
 	// Close releases any resources used by the Pinger.
 	// This method should always be called when done with the Pinger.
 	Close() error
 }
 
-// ResolveHosts converts a list of hostnames to their corresponding IPv4 addresses.
-// It returns a slice of HostInfo containing both the original hostname and its
-// resolved IPv4 address. If any hostname cannot be resolved or does not have
-// an IPv4 address, an error is returned.
+// ResolveHosts converts a list of hostnames to their corresponding IPv4 and
+// IPv6 addresses. It is equivalent to ResolveHostsFamily(hosts, DualStack).
 func ResolveHosts(hosts []string) ([]HostInfo, error) {
+	return ResolveHostsFamily(hosts, DualStack)
+}
+
+// ResolveHostsFamily converts a list of hostnames to their addresses in the
+// requested families. It returns a slice of HostInfo containing the original
+// hostname and the first resolved address of each requested family. If any
+// hostname cannot be resolved or has no address in the requested families,
+// an error is returned.
+func ResolveHostsFamily(hosts []string, family Family) ([]HostInfo, error) {
 	resolved := make([]HostInfo, 0, len(hosts))
-	
+
 	for _, host := range hosts {
 		ips, err := net.LookupIP(host)
 		if err != nil {
 			return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
 		}
 
-		var ipv4Addr net.IP
+		info := HostInfo{Hostname: host}
 		for _, ip := range ips {
-			if ip.To4() != nil {
-				ipv4Addr = ip
-				break
+			if ip4 := ip.To4(); ip4 != nil {
+				if family&IPv4 != 0 && info.IPAddr == nil {
+					info.IPAddr = ip4
+				}
+			} else if family&IPv6 != 0 && info.IPv6Addr == nil {
+				info.IPv6Addr = ip
 			}
 		}
 
-		if ipv4Addr == nil {
-			return nil, fmt.Errorf("no IPv4 address found for %s", host)
+		if info.IPAddr == nil && info.IPv6Addr == nil {
+			switch family {
+			case IPv4:
+				return nil, fmt.Errorf("no IPv4 address found for %s", host)
+			case IPv6:
+				return nil, fmt.Errorf("no IPv6 address found for %s", host)
+			default:
+				return nil, fmt.Errorf("no IPv4 or IPv6 address found for %s", host)
+			}
 		}
 
-		resolved = append(resolved, HostInfo{Hostname: host, IPAddr: ipv4Addr})
+		resolved = append(resolved, info)
 	}
-	
+
 	return resolved, nil
 }
 
+// StrayReason describes why a reply could not be matched to a probe.
+type StrayReason int
+
+const (
+	// StrayLate is a reply to a probe that had already timed out
+	StrayLate StrayReason = iota
+	// StrayDuplicate is a second reply to a probe that was already answered
+	StrayDuplicate
+	// StrayStale is a reply carrying our ICMP ID whose sequence number or
+	// payload matches no recent probe, such as one from a previous process
+	StrayStale
+)
+
+func (r StrayReason) String() string {
+	switch r {
+	case StrayLate:
+		return "late"
+	case StrayDuplicate:
+		return "duplicate"
+	case StrayStale:
+		return "stale"
+	default:
+		return fmt.Sprintf("StrayReason(%d)", int(r))
+	}
+}
+
+// Stray describes an echo reply that was discarded because it did not
+// belong to any in-flight probe.
+type Stray struct {
+	Reason StrayReason
+	From   net.IP        // The address the reply came from
+	Seq    int           // The ICMP sequence number of the reply
+	RTT    time.Duration // Time since the matching probe was sent, 0 if unknown
+}
+
+// StrayReporter is implemented by Pingers that can report discarded replies.
+// Strays are delivered on a buffered channel; if the channel is full further
+// strays are dropped rather than blocking the receiver.
+type StrayReporter interface {
+	Strays() <-chan Stray
+}
+
+// pingMany implements PingMany on top of a concurrency-safe Ping.
+func pingMany(p Pinger, ips []net.IP, timeout time.Duration) []Result {
+	return PingAll(context.Background(), p, ips, Options{Timeout: timeout})
+}
+
+// PingAll pings all of the given IP addresses concurrently with
+// p.PingContext and opts, and returns one Result per address in the same
+// order as the input.
+func PingAll(ctx context.Context, p Pinger, ips []net.IP, opts Options) []Result {
+	results := make([]Result, len(ips))
+
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func(i int, ip net.IP) {
+			defer wg.Done()
+			reply, err := p.PingContext(ctx, ip, opts)
+			results[i] = Result{
+				Host:    ip.String(),
+				IP:      ip,
+				Success: err == nil,
+				Error:   err,
+				Reply:   reply,
+			}
+			if reply != nil {
+				results[i].RTT = reply.RTT
+			}
+		}(i, ip)
+	}
+	wg.Wait()
+
+	return results
+}
+
 // New creates a new platform-specific Pinger implementation.
-// On Unix-like systems, it creates a UDP-based pinger.
+// On Unix-like systems, it creates a UDP-based pinger, or a raw socket one
+// if unprivileged ICMP is denied and the process may open raw sockets.
 // On Windows, it creates a pinger using the ICMP Helper API.
 func New() (Pinger, error) {
-	return newPinger()
+	return newPinger(BackendAuto)
+}
+
+// NewWithBackend is like New but forces the socket type on Unix-like
+// systems. Windows supports only BackendAuto.
+func NewWithBackend(backend Backend) (Pinger, error) {
+	return newPinger(backend)
 } 
\ No newline at end of file
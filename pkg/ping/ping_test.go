@@ -1,28 +1,17 @@
 package ping
 
 import (
+	"context"
+	"errors"
 	"net"
 	"runtime"
 	"testing"
 	"time"
 )
 
-// pinger defines the interface that both Unix and Windows implementations must satisfy
-type pinger interface {
-	Ping(net.IP, time.Duration) (time.Duration, error)
-	Close() error
-}
-
-// newPinger creates the appropriate pinger for the current OS
-func newPinger(t *testing.T) pinger {
-	var p pinger
-	var err error
-	
-	if runtime.GOOS == "windows" {
-		p, err = newWindowsPinger()
-	} else {
-		p, err = newUnixPinger()
-	}
+// newTestPinger creates the appropriate pinger for the current OS
+func newTestPinger(t *testing.T) Pinger {
+	p, err := New()
 	if err != nil {
 		t.Fatalf("Failed to create pinger: %v", err)
 	}
@@ -43,7 +32,7 @@ var testHosts = []struct {
 // TestHostResolution tests the host resolution functionality
 func TestHostResolution(t *testing.T) {
 	hosts := []string{"localhost", "google.com"}
-	resolved, err := resolveHosts(hosts)
+	resolved, err := ResolveHosts(hosts)
 	if err != nil {
 		t.Fatalf("Failed to resolve hosts: %v", err)
 	}
@@ -55,9 +44,9 @@ func TestHostResolution(t *testing.T) {
 	// Check localhost resolution
 	found := false
 	for _, host := range resolved {
-		if host.hostname == "localhost" {
-			if !host.ipAddr.Equal(net.ParseIP("127.0.0.1")) {
-				t.Errorf("Expected localhost to resolve to 127.0.0.1, got %v", host.ipAddr)
+		if host.Hostname == "localhost" {
+			if !host.IPAddr.Equal(net.ParseIP("127.0.0.1")) {
+				t.Errorf("Expected localhost to resolve to 127.0.0.1, got %v", host.IPAddr)
 			}
 			found = true
 			break
@@ -70,7 +59,7 @@ func TestHostResolution(t *testing.T) {
 
 // TestPingTimeout tests that pings timeout appropriately
 func TestPingTimeout(t *testing.T) {
-	p := newPinger(t)
+	p := newTestPinger(t)
 	defer p.Close()
 
 	// Test with very short timeout to unreachable host
@@ -85,7 +74,7 @@ func TestPingTimeout(t *testing.T) {
 
 // TestPingValidHost tests pinging a known good host
 func TestPingValidHost(t *testing.T) {
-	p := newPinger(t)
+	p := newTestPinger(t)
 	defer p.Close()
 
 	// Test localhost
@@ -102,20 +91,18 @@ func TestPingValidHost(t *testing.T) {
 // TestMultipleHosts tests pinging multiple hosts in sequence
 func TestMultipleHosts(t *testing.T) {
 	hosts := []string{"localhost", "127.0.0.1"}
-	resolved, err := resolveHosts(hosts)
+	resolved, err := ResolveHosts(hosts)
 	if err != nil {
 		t.Fatalf("Failed to resolve hosts: %v", err)
 	}
 
-	results := pingHosts(resolved)
-	if len(results) != len(hosts) {
-		t.Errorf("Expected %d results, got %d", len(hosts), len(results))
-	}
+	p := newTestPinger(t)
+	defer p.Close()
 
 	// At least one of the localhost pings should succeed
 	success := false
-	for _, result := range results {
-		if result.success {
+	for _, host := range resolved {
+		if _, err := p.Ping(host.IPAddr, time.Second); err == nil {
 			success = true
 			break
 		}
@@ -127,7 +114,7 @@ func TestMultipleHosts(t *testing.T) {
 
 // TestMultipleClose tests multiple Close() calls
 func TestMultipleClose(t *testing.T) {
-	p := newPinger(t)
+	p := newTestPinger(t)
 
 	// First close should succeed
 	if err := p.Close(); err != nil {
@@ -138,4 +125,209 @@ func TestMultipleClose(t *testing.T) {
 	if err := p.Close(); err != nil {
 		t.Errorf("Second close failed: %v", err)
 	}
-} 
\ No newline at end of file
+}
+
+// TestResolveHostsFamily tests address family selection during resolution
+func TestResolveHostsFamily(t *testing.T) {
+	resolved, err := ResolveHostsFamily([]string{"127.0.0.1"}, IPv4)
+	if err != nil {
+		t.Fatalf("Failed to resolve hosts: %v", err)
+	}
+	if !resolved[0].IPAddr.Equal(net.ParseIP("127.0.0.1")) || resolved[0].IPv6Addr != nil {
+		t.Errorf("Expected only IPv4 address, got %+v", resolved[0])
+	}
+
+	resolved, err = ResolveHostsFamily([]string{"::1"}, DualStack)
+	if err != nil {
+		t.Fatalf("Failed to resolve hosts: %v", err)
+	}
+	if resolved[0].IPAddr != nil || !resolved[0].IPv6Addr.Equal(net.IPv6loopback) {
+		t.Errorf("Expected only IPv6 address, got %+v", resolved[0])
+	}
+	if addrs := resolved[0].Addrs(); len(addrs) != 1 {
+		t.Errorf("Expected 1 address, got %d", len(addrs))
+	}
+
+	if _, err := ResolveHostsFamily([]string{"::1"}, IPv4); err == nil {
+		t.Error("Expected error resolving IPv6 literal with IPv4 only")
+	}
+}
+
+// TestParseBackend tests parsing backend names
+func TestParseBackend(t *testing.T) {
+	for _, b := range []Backend{BackendAuto, BackendUDP, BackendRaw} {
+		got, err := ParseBackend(b.String())
+		if err != nil || got != b {
+			t.Errorf("ParseBackend(%q) = %v, %v; expected %v", b.String(), got, err, b)
+		}
+	}
+	if _, err := ParseBackend("icmp"); err == nil {
+		t.Error("Expected error for unknown backend")
+	}
+}
+
+// TestPingIPv6Loopback tests pinging the IPv6 loopback address
+func TestPingIPv6Loopback(t *testing.T) {
+	p := newTestPinger(t)
+	defer p.Close()
+
+	rtt, err := p.Ping(net.IPv6loopback, time.Second)
+	if err != nil {
+		t.Skipf("IPv6 ping unavailable: %v", err)
+	}
+	if rtt <= 0 {
+		t.Error("Expected positive RTT for ::1")
+	}
+}
+
+// TestPingMany tests pinging a batch of addresses concurrently
+func TestPingMany(t *testing.T) {
+	p := newTestPinger(t)
+	defer p.Close()
+
+	ips := []net.IP{
+		net.ParseIP("127.0.0.1"),
+		net.ParseIP("127.0.0.2"),
+		net.ParseIP("127.0.0.3"),
+	}
+	results := p.PingMany(ips, time.Second)
+	if len(results) != len(ips) {
+		t.Fatalf("Expected %d results, got %d", len(ips), len(results))
+	}
+	for i, result := range results {
+		if !result.IP.Equal(ips[i]) {
+			t.Errorf("Result %d: expected IP %v, got %v", i, ips[i], result.IP)
+		}
+		if !result.Success {
+			t.Errorf("Result %d: failed to ping %v: %v", i, ips[i], result.Error)
+		} else if result.Reply == nil || result.Reply.RTT != result.RTT {
+			t.Errorf("Result %d: expected reply details matching RTT", i)
+		}
+	}
+}
+
+// skipIfRejected skips a test that needs an unanswered probe when the local
+// network rejects the test address with an ICMP error instead
+func skipIfRejected(t *testing.T, err error) {
+	var unreachable *DestinationUnreachableError
+	var prohibited *AdminProhibitedError
+	if errors.As(err, &unreachable) || errors.As(err, &prohibited) {
+		t.Skipf("Test address rejected by the network: %v", err)
+	}
+}
+
+// TestPingContextCanceled tests that cancelling the context stops a probe
+func TestPingContextCanceled(t *testing.T) {
+	p := newTestPinger(t)
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	unreachableIP := net.ParseIP("198.51.100.1") // TEST-NET-2 from RFC 5737
+	_, err := p.PingContext(ctx, unreachableIP, Options{Timeout: 5 * time.Second})
+	skipIfRejected(t, err)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected prompt return on cancel, took %v", elapsed)
+	}
+
+	// An already cancelled context fails without sending
+	if _, err := p.PingContext(ctx, net.ParseIP("127.0.0.1"), Options{Timeout: time.Second}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled for cancelled context, got %v", err)
+	}
+}
+
+// TestPingContextTimeout tests that a probe timeout is distinct from cancellation
+func TestPingContextTimeout(t *testing.T) {
+	p := newTestPinger(t)
+	defer p.Close()
+
+	unreachableIP := net.ParseIP("198.51.100.1") // TEST-NET-2 from RFC 5737
+	_, err := p.PingContext(context.Background(), unreachableIP, Options{Timeout: 100 * time.Millisecond})
+	skipIfRejected(t, err)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Expected *TimeoutError, got %v", err)
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected timeout not to be reported as a context error: %v", err)
+	}
+}
+
+// TestPingContextReply tests the details reported for an echo reply
+func TestPingContextReply(t *testing.T) {
+	p := newTestPinger(t)
+	defer p.Close()
+
+	ip := net.ParseIP("127.0.0.1")
+	reply, err := p.PingContext(context.Background(), ip, Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Failed to ping localhost: %v", err)
+	}
+	if !reply.From.Equal(ip) {
+		t.Errorf("Expected reply from %v, got %v", ip, reply.From)
+	}
+	if reply.RTT <= 0 {
+		t.Error("Expected positive RTT for localhost")
+	}
+	if reply.Size <= 0 {
+		t.Errorf("Expected positive reply size, got %d", reply.Size)
+	}
+	if reply.TTL == 0 {
+		t.Error("Expected non-zero TTL for localhost")
+	}
+	if reply.Type != 0 || reply.Code != 0 {
+		t.Errorf("Expected echo reply type 0 code 0, got type %d code %d", reply.Type, reply.Code)
+	}
+}
+
+// TestPingPayload tests large and patterned payloads with verification
+func TestPingPayload(t *testing.T) {
+	p := newTestPinger(t)
+	defer p.Close()
+
+	ip := net.ParseIP("127.0.0.1")
+	for _, pattern := range []Pattern{{}, {Random: true}, {Fill: []byte{0xde, 0xad}}} {
+		for _, size := range []int{0, 1400, 9000} {
+			opts := Options{Timeout: time.Second, Size: size, Pattern: pattern, Verify: true}
+			reply, err := p.PingContext(context.Background(), ip, opts)
+			if err != nil {
+				t.Errorf("Ping with %d bytes of %v failed: %v", size, pattern, err)
+				continue
+			}
+			if size > 0 && reply.Size != size {
+				t.Errorf("Expected %d byte reply, got %d", size, reply.Size)
+			}
+		}
+	}
+
+	if _, err := p.PingContext(context.Background(), ip, Options{Timeout: time.Second, Size: MaxSize + 1}); err == nil {
+		t.Error("Expected oversized payload to be rejected")
+	}
+}
+
+// TestPingIPOptions tests probes with TTL, TOS and don't-fragment set
+func TestPingIPOptions(t *testing.T) {
+	p := newTestPinger(t)
+	defer p.Close()
+
+	ip := net.ParseIP("127.0.0.1")
+	opts := Options{Timeout: time.Second, TTL: 5, TOS: 46 << 2, DontFragment: true}
+	if runtime.GOOS != "linux" && runtime.GOOS != "windows" {
+		opts.DontFragment = false
+	}
+	if _, err := p.PingContext(context.Background(), ip, opts); err != nil {
+		t.Errorf("Ping with IP options failed: %v", err)
+	}
+
+	for _, bad := range []Options{{TTL: 256}, {TTL: -1}, {TOS: 256}} {
+		bad.Timeout = time.Second
+		if _, err := p.PingContext(context.Background(), ip, bad); err == nil {
+			t.Errorf("Expected options %+v to be rejected", bad)
+		}
+	}
+}
@@ -2,76 +2,689 @@
 package ping
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
+	"runtime"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
+// unixPinger shares one socket per address family between all concurrent
+// Ping calls. A receive goroutine per socket reads every reply and hands it
+// to the waiting Ping call after checking the reply's ICMP ID, sequence
+// number, payload and source address.
 type unixPinger struct {
-	conn *icmp.PacketConn
+	conn  *icmpSocket // ICMPv4 socket, nil if unavailable
+	conn6 *icmpSocket // ICMPv6 socket, nil if unavailable
+	err   error       // Why conn could not be opened
+	err6  error       // Why conn6 could not be opened
+
+	mu     sync.Mutex
+	closed bool
+	seq    uint16         // Last sequence number handed out
+	token  uint64         // Last payload token handed out
+	probes map[int]*probe // In-flight probes by sequence number
+	recent map[int]*probe // Finished probes by sequence number with their token only, kept to classify strays
+	strays chan Stray
+	wg     sync.WaitGroup // Running receive goroutines
 }
 
-func newPinger() (Pinger, error) {
-	conn, err := icmp.ListenPacket("udp4", "")
-	if err != nil {
+// icmpSocket is one ICMP or ICMPv6 socket of a unixPinger
+type icmpSocket struct {
+	conn net.PacketConn
+	p4   *ipv4.PacketConn // Set for ICMPv4 sockets
+	p6   *ipv6.PacketConn // Set for ICMPv6 sockets
+	id   int              // ICMP echo ID of our replies on this socket
+	raw  bool             // A raw socket rather than an unprivileged datagram one
+
+	// recv replaces reading through p4 or p6 where ICMP errors are queued
+	// on the socket rather than delivered inline as ICMP messages. It
+	// passes every queued error it finds to onError before returning the
+	// next message.
+	recv func(b []byte, onError func(queuedError)) (int, int, net.IP, error)
+
+	// setDF turns the don't-fragment behaviour on or back to the system
+	// default. It is nil where the platform does not support it.
+	setDF func(on bool) error
+
+	// clearError resets an error left pending on the socket by an ICMP
+	// error for an earlier probe, which the next send would otherwise fail
+	// with. It is nil where errors are not left pending.
+	clearError func()
+
+	sendMu   sync.Mutex // Held while setting per-probe options and sending
+	defaults ipOptions  // The socket's options when it was opened
+	applied  ipOptions  // The options currently set on the socket
+}
+
+// ipOptions are the IP-level options of outgoing echo requests
+type ipOptions struct {
+	ttl int  // TTL or hop limit
+	tos int  // TOS byte or traffic class
+	df  bool // Don't fragment
+}
+
+// queuedError is an error for one of our probes taken from the socket error
+// queue.
+type queuedError struct {
+	seq      int
+	dst      net.IP        // Destination of the failed probe, nil if unknown
+	from     net.IP        // Sender of the ICMP error, nil for local errors
+	typ      int           // ICMP type, for errors from the network
+	code     int           // ICMP code, for errors from the network
+	mtu      int           // Next-hop or path MTU for packet too big errors, 0 if unknown
+	errno    syscall.Errno // Set for errors generated by the local host
+	received time.Time
+}
+
+// tokenSize is the length of the unique token that starts every payload
+const tokenSize = 8
+
+// probe is a single in-flight echo request
+type probe struct {
+	ip         net.IP
+	payload    []byte
+	sent       time.Time
+	answered   bool
+	replies    chan echoReply // The matching reply
+	errs       chan error     // An ICMP or local error for the probe
+	unexpected chan net.IP    // Matching replies from other addresses
+}
+
+// echoReply is what the receive goroutine hands to a waiting Ping call
+type echoReply struct {
+	received time.Time // When the reply was read from the socket
+	peer     net.IP    // Who sent the reply
+	ttl      int       // TTL or hop limit, -1 if unknown
+	echo     *icmp.Echo
+	typ      int
+	code     int
+}
+
+func newPinger(backend Backend) (Pinger, error) {
+	conn, err := listen(false, backend)
+	conn6, err6 := listen(true, backend)
+	if err != nil && err6 != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, &PermissionError{Op: "opening ICMP socket", Err: err}
+		}
 		return nil, err
 	}
-	return &unixPinger{conn: conn}, nil
+
+	up := &unixPinger{
+		conn:   conn,
+		conn6:  conn6,
+		err:    err,
+		err6:   err6,
+		token:  rand.Uint64(),
+		probes: make(map[int]*probe),
+		recent: make(map[int]*probe),
+		strays: make(chan Stray, 64),
+	}
+	if conn != nil {
+		up.wg.Add(1)
+		go up.receive(conn)
+	}
+	if conn6 != nil {
+		up.wg.Add(1)
+		go up.receive(conn6)
+	}
+	return up, nil
+}
+
+// listen opens the socket for one address family. BackendAuto falls back to
+// a raw socket only when the system denies unprivileged ICMP; if the raw
+// socket cannot be opened either, the datagram socket's error is returned.
+func listen(v6 bool, backend Backend) (*icmpSocket, error) {
+	switch backend {
+	case BackendUDP:
+		return listenDatagram(v6)
+	case BackendRaw:
+		return listenRaw(v6)
+	}
+
+	s, err := listenDatagram(v6)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		if raw, rawErr := listenRaw(v6); rawErr == nil {
+			return raw, nil
+		}
+	}
+	return s, err
+}
+
+// newICMPSocket wraps an ICMP or ICMPv6 packet connection and asks for the
+// TTL or hop limit of received packets where the platform supports it.
+func newICMPSocket(conn net.PacketConn, p4 *ipv4.PacketConn, p6 *ipv6.PacketConn) *icmpSocket {
+	s := &icmpSocket{conn: conn, p4: p4, p6: p6, id: echoID(conn)}
+	if p4 != nil {
+		p4.SetControlMessage(ipv4.FlagTTL, true)
+		s.defaults.ttl, _ = p4.TTL()
+		s.defaults.tos, _ = p4.TOS()
+	} else {
+		p6.SetControlMessage(ipv6.FlagHopLimit, true)
+		s.defaults.ttl, _ = p6.HopLimit()
+		s.defaults.tos, _ = p6.TrafficClass()
+	}
+	s.applied = s.defaults
+	return s
+}
+
+// send writes an echo request to ip with the IP options in opts. Options are
+// socket-wide, so sends are serialised and the options are changed only
+// when they differ from those of the previous send.
+func (s *icmpSocket) send(msg []byte, ip net.IP, opts Options) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	want := ipOptions{ttl: s.defaults.ttl, tos: s.defaults.tos, df: opts.DontFragment}
+	if opts.TTL > 0 {
+		want.ttl = opts.TTL
+	}
+	if opts.TOS > 0 {
+		want.tos = opts.TOS
+	}
+	if err := s.apply(want); err != nil {
+		return err
+	}
+
+	if s.raw {
+		_, err := s.conn.WriteTo(msg, &net.IPAddr{IP: ip})
+		return err
+	}
+	if s.clearError != nil {
+		s.clearError()
+	}
+	_, err := s.conn.WriteTo(msg, &net.UDPAddr{IP: ip})
+	return err
+}
+
+// apply sets the socket options that differ from those already applied.
+func (s *icmpSocket) apply(want ipOptions) error {
+	if want.ttl != s.applied.ttl {
+		var err error
+		if s.p4 != nil {
+			err = s.p4.SetTTL(want.ttl)
+		} else {
+			err = s.p6.SetHopLimit(want.ttl)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set TTL %d: %v", want.ttl, err)
+		}
+		s.applied.ttl = want.ttl
+	}
+	if want.tos != s.applied.tos {
+		var err error
+		if s.p4 != nil {
+			err = s.p4.SetTOS(want.tos)
+		} else {
+			err = s.p6.SetTrafficClass(want.tos)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set TOS %#x: %v", want.tos, err)
+		}
+		s.applied.tos = want.tos
+	}
+	if want.df != s.applied.df {
+		if s.setDF == nil {
+			return errors.New("don't fragment is not supported on this platform")
+		}
+		if err := s.setDF(want.df); err != nil {
+			return fmt.Errorf("failed to set don't fragment: %v", err)
+		}
+		s.applied.df = want.df
+	}
+	return nil
+}
+
+// echoID returns the ICMP echo ID replies on conn will carry. Linux rewrites
+// the ID of unprivileged echo requests to the socket's local port; other
+// systems send the ID unchanged.
+func echoID(conn net.PacketConn) int {
+	if runtime.GOOS == "linux" {
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			return addr.Port
+		}
+	}
+	return os.Getpid() & 0xffff
+}
+
+// read reads one ICMP message and returns its length, the TTL or hop limit
+// it arrived with (-1 if unknown) and its source address. Queued ICMP errors
+// found on the way are passed to onError.
+func (s *icmpSocket) read(b []byte, onError func(queuedError)) (int, int, net.IP, error) {
+	if s.recv != nil {
+		return s.recv(b, onError)
+	}
+
+	var n int
+	var peer net.Addr
+	var err error
+	ttl := -1
+	if s.p4 != nil {
+		var cm *ipv4.ControlMessage
+		n, cm, peer, err = s.p4.ReadFrom(b)
+		if cm != nil {
+			ttl = cm.TTL
+		}
+	} else {
+		var cm *ipv6.ControlMessage
+		n, cm, peer, err = s.p6.ReadFrom(b)
+		if cm != nil {
+			ttl = cm.HopLimit
+		}
+	}
+	return n, ttl, addrIP(peer), err
+}
+
+// addrIP returns the IP address of a socket address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// echoTypes returns the ICMP echo request and reply types for the socket.
+func (s *icmpSocket) echoTypes() (icmp.Type, icmp.Type) {
+	if s.p4 != nil {
+		return ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	}
+	return ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
 }
 
 func (up *unixPinger) Close() error {
+	up.mu.Lock()
+	if up.closed {
+		up.mu.Unlock()
+		return nil
+	}
+	up.closed = true
+	up.mu.Unlock()
+
+	var err error
 	if up.conn != nil {
-		return up.conn.Close()
+		err = up.conn.conn.Close()
 	}
-	return nil
+	if up.conn6 != nil {
+		if err6 := up.conn6.conn.Close(); err == nil {
+			err = err6
+		}
+	}
+	up.wg.Wait()
+	return err
+}
+
+// Backend reports the kind of socket in use: BackendRaw if any address
+// family fell back to a raw socket, BackendUDP otherwise.
+func (up *unixPinger) Backend() Backend {
+	for _, s := range []*icmpSocket{up.conn, up.conn6} {
+		if s != nil && s.raw {
+			return BackendRaw
+		}
+	}
+	return BackendUDP
 }
 
-func createICMPMessage(id, seq int) []byte {
+func (up *unixPinger) Strays() <-chan Stray {
+	return up.strays
+}
+
+func createICMPMessage(typ icmp.Type, id, seq int, payload []byte) []byte {
 	msg := icmp.Message{
-		Type: ipv4.ICMPTypeEcho,
+		Type: typ,
 		Code: 0,
 		Body: &icmp.Echo{
 			ID:   id,
 			Seq:  seq,
-			Data: []byte("ping"),
+			Data: payload,
 		},
 	}
-	
+
 	msgBytes, _ := msg.Marshal(nil)
 	return msgBytes
 }
 
-func (up *unixPinger) Ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
-	if err := up.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		return 0, err
+// socketFor returns the socket to use for ip.
+func (up *unixPinger) socketFor(ip net.IP) (*icmpSocket, error) {
+	if ip.To4() != nil {
+		if up.conn == nil {
+			return nil, fmt.Errorf("IPv4 ping socket unavailable: %v", up.err)
+		}
+		return up.conn, nil
 	}
+	if up.conn6 == nil {
+		return nil, fmt.Errorf("IPv6 ping socket unavailable: %v", up.err6)
+	}
+	return up.conn6, nil
+}
 
-	msg := createICMPMessage(os.Getpid()&0xffff, 1)
-	if _, err := up.conn.WriteTo(msg, &net.UDPAddr{IP: ip}); err != nil {
-		return 0, err
+// register allocates a sequence number that is not in flight and a payload
+// starting with a unique token for a probe to ip.
+func (up *unixPinger) register(ip net.IP, opts Options) (int, *probe, error) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	if up.closed {
+		return 0, nil, errors.New("pinger is closed")
+	}
+	if len(up.probes) > 0xffff {
+		return 0, nil, errors.New("too many probes in flight")
+	}
+
+	up.token++
+	payload, err := newPayload(binary.BigEndian.AppendUint64(nil, up.token), opts)
+	if err != nil {
+		return 0, nil, err
+	}
+	p := &probe{
+		ip:         ip,
+		payload:    payload,
+		replies:    make(chan echoReply, 1),
+		errs:       make(chan error, 1),
+		unexpected: make(chan net.IP, 1),
+	}
+	for {
+		up.seq++
+		seq := int(up.seq)
+		if _, busy := up.probes[seq]; !busy {
+			delete(up.recent, seq)
+			up.probes[seq] = p
+			return seq, p, nil
+		}
+	}
+}
+
+// unregister retires an in-flight probe; later replies to it are reported
+// as strays. Only the token of its payload is kept, since up to 65536
+// retired probes are.
+func (up *unixPinger) unregister(seq int) {
+	up.mu.Lock()
+	if p, ok := up.probes[seq]; ok {
+		delete(up.probes, seq)
+		up.recent[seq] = &probe{
+			ip:       p.ip,
+			payload:  bytes.Clone(p.payload[:tokenSize]),
+			sent:     p.sent,
+			answered: p.answered,
+		}
+	}
+	up.mu.Unlock()
+}
+
+// receive reads messages from s until it is closed. Echo replies carrying
+// our ICMP ID are dispatched to the Ping call waiting for them, as are ICMP
+// errors quoting one of our echo requests.
+func (up *unixPinger) receive(s *icmpSocket) {
+	defer up.wg.Done()
+
+	_, replyType := s.echoTypes()
+	buf := make([]byte, 65536)
+	for {
+		n, ttl, peer, err := s.read(buf, up.dispatchQueuedError)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		received := time.Now()
+
+		rm, err := icmp.ParseMessage(replyType.Protocol(), buf[:n])
+		if err != nil {
+			continue
+		}
+		if rm.Type != replyType {
+			up.dispatchICMPError(s, rm, buf[:n], peer, received)
+			continue
+		}
+		echo, ok := rm.Body.(*icmp.Echo)
+		if !ok || echo.ID != s.id {
+			continue
+		}
+
+		up.dispatch(echoReply{
+			received: received,
+			peer:     peer,
+			ttl:      ttl,
+			echo:     echo,
+			typ:      icmpTypeNumber(rm.Type),
+			code:     rm.Code,
+		})
+	}
+}
+
+// dispatch hands a received echo reply to its probe or reports it as a stray.
+func (up *unixPinger) dispatch(reply echoReply) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	echo, peer := reply.echo, reply.peer
+
+	p, inFlight := up.probes[echo.Seq]
+	if !inFlight {
+		p = up.recent[echo.Seq]
+	}
+	if p == nil || !bytes.HasPrefix(echo.Data, p.payload[:tokenSize]) {
+		up.stray(Stray{Reason: StrayStale, From: peer, Seq: echo.Seq})
+		return
+	}
+
+	rtt := reply.received.Sub(p.sent)
+	switch {
+	case !p.ip.Equal(peer):
+		if inFlight {
+			select {
+			case p.unexpected <- peer:
+			default:
+			}
+		}
+	case p.answered:
+		up.stray(Stray{Reason: StrayDuplicate, From: peer, Seq: echo.Seq, RTT: rtt})
+	case !inFlight:
+		up.stray(Stray{Reason: StrayLate, From: peer, Seq: echo.Seq, RTT: rtt})
+	default:
+		p.answered = true
+		p.replies <- reply
+	}
+}
+
+// dispatchICMPError hands an ICMP error message received inline to the probe
+// whose echo request it quotes. Messages quoting other packets are ignored.
+// b is the raw message rm was parsed from.
+func (up *unixPinger) dispatchICMPError(s *icmpSocket, rm *icmp.Message, b []byte, from net.IP, received time.Time) {
+	var quoted []byte
+	var mtu int
+	switch body := rm.Body.(type) {
+	case *icmp.DstUnreach:
+		quoted = body.Data
+		// Fragmentation Needed carries the next-hop MTU where DstUnreach
+		// has unused bytes
+		if s.p4 != nil && rm.Code == 4 && len(b) >= 8 {
+			mtu = int(binary.BigEndian.Uint16(b[6:8]))
+		}
+	case *icmp.TimeExceeded:
+		quoted = body.Data
+	case *icmp.PacketTooBig:
+		quoted, mtu = body.Data, body.MTU
+	case *icmp.ParamProb:
+		quoted = body.Data
+	default:
+		return
+	}
+
+	// Skip the quoted IP header to reach our echo request
+	var dst net.IP
+	if s.p4 != nil {
+		if len(quoted) < ipv4.HeaderLen {
+			return
+		}
+		dst = net.IP(quoted[16:20])
+		quoted = quoted[int(quoted[0]&0x0f)<<2:]
+	} else {
+		if len(quoted) < ipv6.HeaderLen {
+			return
+		}
+		dst = net.IP(quoted[24:40])
+		quoted = quoted[ipv6.HeaderLen:]
+	}
+	echoType, _ := s.echoTypes()
+	if len(quoted) < 8 || int(quoted[0]) != icmpTypeNumber(echoType) ||
+		int(binary.BigEndian.Uint16(quoted[4:6])) != s.id {
+		return
+	}
+
+	up.dispatchQueuedError(queuedError{
+		seq:      int(binary.BigEndian.Uint16(quoted[6:8])),
+		dst:      dst,
+		from:     from,
+		typ:      icmpTypeNumber(rm.Type),
+		code:     rm.Code,
+		mtu:      mtu,
+		received: received,
+	})
+}
+
+// dispatchQueuedError fails the in-flight probe an error belongs to. Errors
+// for probes that are no longer in flight are dropped.
+func (up *unixPinger) dispatchQueuedError(qe queuedError) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	p, ok := up.probes[qe.seq]
+	if !ok || (qe.dst != nil && !p.ip.Equal(qe.dst)) {
+		return
+	}
+
+	var err error
+	switch qe.errno {
+	case 0:
+		err = newICMPError(p.ip.To4() == nil, qe.from, qe.typ, qe.code, qe.mtu, qe.received.Sub(p.sent))
+	case syscall.EMSGSIZE:
+		err = &PacketTooBigError{MTU: qe.mtu}
+	default:
+		err = &SendError{IP: p.ip, Err: qe.errno}
+	}
+	select {
+	case p.errs <- err:
+	default:
+	}
+}
+
+// icmpTypeNumber returns the numeric value of an ICMP or ICMPv6 message type.
+func icmpTypeNumber(typ icmp.Type) int {
+	switch t := typ.(type) {
+	case ipv4.ICMPType:
+		return int(t)
+	case ipv6.ICMPType:
+		return int(t)
+	default:
+		return -1
 	}
+}
 
-	start := time.Now()
+// stray reports a discarded reply without blocking. Called with mu held.
+func (up *unixPinger) stray(s Stray) {
+	select {
+	case up.strays <- s:
+	default:
+	}
+}
 
-	reply := make([]byte, 1500)
-	n, _, err := up.conn.ReadFrom(reply)
+func (up *unixPinger) Ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	reply, err := up.PingContext(context.Background(), ip, Options{Timeout: timeout})
 	if err != nil {
 		return 0, err
 	}
+	return reply.RTT, nil
+}
+
+func (up *unixPinger) PingContext(ctx context.Context, ip net.IP, opts Options) (*Reply, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
 
-	rm, err := icmp.ParseMessage(ipv4.ICMPTypeEchoReply.Protocol(), reply[:n])
+	s, err := up.socketFor(ip)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	switch rm.Type {
-	case ipv4.ICMPTypeEchoReply:
-		return time.Since(start), nil
-	default:
-		return 0, fmt.Errorf("unexpected ICMP message type: %v", rm.Type)
+	seq, p, err := up.register(ip, opts)
+	if err != nil {
+		return nil, err
 	}
-} 
\ No newline at end of file
+	defer up.unregister(seq)
+
+	var expired <-chan time.Time
+	if opts.Timeout > 0 {
+		timer := time.NewTimer(opts.Timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	echoType, _ := s.echoTypes()
+	msg := createICMPMessage(echoType, s.id, seq, p.payload)
+	up.mu.Lock()
+	p.sent = time.Now()
+	up.mu.Unlock()
+	if err := s.send(msg, ip, opts); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, &PermissionError{Op: "sending echo request", Err: err}
+		}
+		if errors.Is(err, syscall.EMSGSIZE) && opts.DontFragment {
+			return nil, &PacketTooBigError{}
+		}
+		return nil, &SendError{IP: ip, Err: err}
+	}
+
+	var unexpected net.IP
+	for {
+		select {
+		case reply := <-p.replies:
+			r := &Reply{
+				From: reply.peer,
+				RTT:  reply.received.Sub(p.sent),
+				TTL:  reply.ttl,
+				Size: len(reply.echo.Data),
+				Seq:  reply.echo.Seq,
+				Type: reply.typ,
+				Code: reply.code,
+			}
+			if opts.Verify {
+				return r, verifyPayload(ip, p.payload, reply.echo.Data)
+			}
+			return r, nil
+		case err := <-p.errs:
+			return nil, err
+		case peer := <-p.unexpected:
+			unexpected = peer
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-expired:
+			if unexpected != nil {
+				return nil, &UnexpectedSourceError{Expected: ip, Got: unexpected}
+			}
+			return nil, &TimeoutError{IP: ip, After: opts.Timeout}
+		}
+	}
+}
+
+func (up *unixPinger) PingMany(ips []net.IP, timeout time.Duration) []Result {
+	return pingMany(up, ips, timeout)
+}
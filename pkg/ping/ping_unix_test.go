@@ -2,11 +2,26 @@
 package ping
 
 import (
+	"encoding/binary"
 	"net"
+	"sync"
 	"testing"
 	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
+// newUnixPinger creates a pinger and returns the Unix implementation
+func newUnixPinger() (*unixPinger, error) {
+	p, err := newPinger(BackendAuto)
+	if err != nil {
+		return nil, err
+	}
+	return p.(*unixPinger), nil
+}
+
 // TestUnixPingerCreation tests Unix-specific pinger creation details
 func TestUnixPingerCreation(t *testing.T) {
 	p, err := newUnixPinger()
@@ -41,10 +56,15 @@ func TestUnixSocketTimeout(t *testing.T) {
 
 // TestUnixICMPMessageCreation tests ICMP message creation
 func TestUnixICMPMessageCreation(t *testing.T) {
-	msg := createICMPMessage(1234, 5678)
+	msg := createICMPMessage(ipv4.ICMPTypeEcho, 1234, 5678, []byte("ping"))
 	if len(msg) == 0 {
 		t.Error("Expected non-empty ICMP message")
 	}
+
+	msg = createICMPMessage(ipv6.ICMPTypeEchoRequest, 1234, 5678, []byte("ping"))
+	if len(msg) == 0 || msg[0] != byte(ipv6.ICMPTypeEchoRequest) {
+		t.Error("Expected ICMPv6 echo request message")
+	}
 }
 
 // TestUnixMultipleClose tests multiple Close() calls
@@ -63,4 +83,232 @@ func TestUnixMultipleClose(t *testing.T) {
 	if err := pinger.Close(); err != nil {
 		t.Errorf("Second close failed: %v", err)
 	}
-} 
\ No newline at end of file
+}
+
+// TestUnixConcurrentPing tests that concurrent pings on one socket each get
+// their own reply
+func TestUnixConcurrentPing(t *testing.T) {
+	pinger, err := newUnixPinger()
+	if err != nil {
+		t.Fatalf("Failed to create Unix pinger: %v", err)
+	}
+	defer pinger.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pinger.Ping(net.ParseIP("127.0.0.1"), time.Second); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Concurrent ping failed: %v", err)
+	}
+	if len(pinger.probes) != 0 {
+		t.Errorf("Expected no in-flight probes, got %d", len(pinger.probes))
+	}
+}
+
+// TestUnixPingAfterClose tests that pinging a closed pinger fails
+func TestUnixPingAfterClose(t *testing.T) {
+	pinger, err := newUnixPinger()
+	if err != nil {
+		t.Fatalf("Failed to create Unix pinger: %v", err)
+	}
+	pinger.Close()
+
+	if _, err := pinger.Ping(net.ParseIP("127.0.0.1"), time.Second); err == nil {
+		t.Error("Expected error pinging with a closed pinger")
+	}
+}
+
+// TestUnixReplyMatching tests how received replies are matched to probes
+func TestUnixReplyMatching(t *testing.T) {
+	up := &unixPinger{
+		probes: make(map[int]*probe),
+		recent: make(map[int]*probe),
+		strays: make(chan Stray, 8),
+	}
+	target := net.ParseIP("192.0.2.10")
+	other := net.ParseIP("192.0.2.99")
+
+	seq, p, err := up.register(target, Options{})
+	if err != nil {
+		t.Fatalf("Failed to register probe: %v", err)
+	}
+	p.sent = time.Now()
+
+	expectStray := func(reason StrayReason) {
+		t.Helper()
+		select {
+		case s := <-up.strays:
+			if s.Reason != reason {
+				t.Errorf("Expected %v stray, got %v", reason, s.Reason)
+			}
+		default:
+			t.Errorf("Expected %v stray, got none", reason)
+		}
+	}
+
+	// Wrong payload for an in-flight sequence number
+	up.dispatch(echoReply{echo: &icmp.Echo{Seq: seq, Data: []byte("ping")}, peer: target, received: time.Now()})
+	expectStray(StrayStale)
+
+	// Unknown sequence number
+	up.dispatch(echoReply{echo: &icmp.Echo{Seq: seq + 1, Data: p.payload}, peer: target, received: time.Now()})
+	expectStray(StrayStale)
+
+	// Right probe, wrong source
+	up.dispatch(echoReply{echo: &icmp.Echo{Seq: seq, Data: p.payload}, peer: other, received: time.Now()})
+	select {
+	case got := <-p.unexpected:
+		if !got.Equal(other) {
+			t.Errorf("Expected unexpected source %v, got %v", other, got)
+		}
+	default:
+		t.Error("Expected reply from unexpected address to be surfaced")
+	}
+
+	// The real reply, then a duplicate
+	up.dispatch(echoReply{echo: &icmp.Echo{Seq: seq, Data: p.payload}, peer: target, received: time.Now()})
+	select {
+	case <-p.replies:
+	default:
+		t.Error("Expected matching reply to be delivered")
+	}
+	up.unregister(seq)
+	up.dispatch(echoReply{echo: &icmp.Echo{Seq: seq, Data: p.payload}, peer: target, received: time.Now()})
+	expectStray(StrayDuplicate)
+
+	// A reply to a probe that timed out, which is kept without its payload
+	seq, p, _ = up.register(target, Options{Size: 60000})
+	up.unregister(seq)
+	if n := len(up.recent[seq].payload); n != tokenSize {
+		t.Errorf("Expected a retired probe to keep %d bytes of payload, got %d", tokenSize, n)
+	}
+	up.dispatch(echoReply{echo: &icmp.Echo{Seq: seq, Data: p.payload}, peer: target, received: time.Now()})
+	expectStray(StrayLate)
+}
+
+// TestUnixSequenceNumbers tests that every probe gets its own sequence number
+func TestUnixSequenceNumbers(t *testing.T) {
+	up := &unixPinger{
+		probes: make(map[int]*probe),
+		recent: make(map[int]*probe),
+	}
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		seq, _, err := up.register(net.ParseIP("127.0.0.1"), Options{})
+		if err != nil {
+			t.Fatalf("Failed to register probe: %v", err)
+		}
+		if seen[seq] {
+			t.Fatalf("Sequence number %d handed out twice", seq)
+		}
+		seen[seq] = true
+	}
+}
+
+// TestUnixInlineICMPError tests that an ICMP error quoting one of our echo
+// requests fails the matching probe
+func TestUnixInlineICMPError(t *testing.T) {
+	up := &unixPinger{
+		probes: make(map[int]*probe),
+		recent: make(map[int]*probe),
+	}
+	s := &icmpSocket{p4: &ipv4.PacketConn{}, id: 1234}
+	target := net.ParseIP("192.0.2.10").To4()
+	router := net.ParseIP("198.51.100.254")
+
+	seq, p, err := up.register(target, Options{})
+	if err != nil {
+		t.Fatalf("Failed to register probe: %v", err)
+	}
+	p.sent = time.Now()
+
+	// The error quotes the IP header and first bytes of the echo request
+	header := make([]byte, ipv4.HeaderLen)
+	header[0] = 0x45
+	copy(header[16:20], target)
+	quoted := append(header, createICMPMessage(ipv4.ICMPTypeEcho, s.id, seq, p.payload)[:8]...)
+
+	// An error for another ICMP ID is ignored
+	other := append(append([]byte(nil), header...), createICMPMessage(ipv4.ICMPTypeEcho, s.id+1, seq, p.payload)[:8]...)
+	msg := &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 1, Body: &icmp.DstUnreach{Data: other}}
+	b, _ := msg.Marshal(nil)
+	up.dispatchICMPError(s, msg, b, router, time.Now())
+	select {
+	case err := <-p.errs:
+		t.Fatalf("Expected error for another ID to be ignored, got %v", err)
+	default:
+	}
+
+	msg = &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 1, Body: &icmp.DstUnreach{Data: quoted}}
+	b, _ = msg.Marshal(nil)
+	up.dispatchICMPError(s, msg, b, router, time.Now())
+	select {
+	case err := <-p.errs:
+		unreachable, ok := err.(*DestinationUnreachableError)
+		if !ok {
+			t.Fatalf("Expected *DestinationUnreachableError, got %T: %v", err, err)
+		}
+		if !unreachable.From.Equal(router) || unreachable.Code != 1 {
+			t.Errorf("Expected code 1 from %v, got code %d from %v", router, unreachable.Code, unreachable.From)
+		}
+	default:
+		t.Error("Expected ICMP error to be delivered to the probe")
+	}
+
+	// Fragmentation Needed carries the next-hop MTU in the ICMP header
+	msg = &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 4, Body: &icmp.DstUnreach{Data: quoted}}
+	b, _ = msg.Marshal(nil)
+	binary.BigEndian.PutUint16(b[6:8], 1400)
+	up.dispatchICMPError(s, msg, b, router, time.Now())
+	select {
+	case err := <-p.errs:
+		tooBig, ok := err.(*PacketTooBigError)
+		if !ok || tooBig.MTU != 1400 {
+			t.Errorf("Expected *PacketTooBigError with MTU 1400, got %T: %v", err, err)
+		}
+	default:
+		t.Error("Expected ICMP error to be delivered to the probe")
+	}
+}
+
+// TestUnixSocketOptions tests that per-probe IP options are applied to the
+// shared socket and restored for probes without them
+func TestUnixSocketOptions(t *testing.T) {
+	up, err := newUnixPinger()
+	if err != nil {
+		t.Fatalf("Failed to create pinger: %v", err)
+	}
+	defer up.Close()
+
+	s := up.conn
+	ip := net.ParseIP("127.0.0.1")
+	msg := createICMPMessage(ipv4.ICMPTypeEcho, s.id, 1, []byte("ping"))
+
+	if err := s.send(msg, ip, Options{TTL: 7, TOS: 0x20}); err != nil {
+		t.Fatalf("Failed to send with options: %v", err)
+	}
+	if ttl, _ := s.p4.TTL(); ttl != 7 {
+		t.Errorf("Expected socket TTL 7, got %d", ttl)
+	}
+	if tos, _ := s.p4.TOS(); tos != 0x20 {
+		t.Errorf("Expected socket TOS 0x20, got %#x", tos)
+	}
+
+	if err := s.send(msg, ip, Options{}); err != nil {
+		t.Fatalf("Failed to send without options: %v", err)
+	}
+	if s.applied != s.defaults {
+		t.Errorf("Expected default options %+v to be restored, got %+v", s.defaults, s.applied)
+	}
+}
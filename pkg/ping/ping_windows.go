@@ -2,9 +2,12 @@
 package ping
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -16,8 +19,31 @@ const (
 	ICMP_SUCCESS      = 0
 	IP_HEADER_LENGTH  = 20
 	ICMP_ECHO_REQUEST = 8
+	IP_REQ_TIMED_OUT  = 11010
+	IP_FLAG_DF        = 0x2
+	DEFAULT_TTL       = 128
 )
 
+// IP_STATUS values reported for ICMP errors. The IPv6 names that share a
+// value are noted alongside.
+const (
+	IP_DEST_NET_UNREACHABLE  = 11002 // IP_DEST_NO_ROUTE
+	IP_DEST_HOST_UNREACHABLE = 11003 // IP_DEST_ADDR_UNREACHABLE
+	IP_DEST_PROT_UNREACHABLE = 11004 // IP_DEST_PROHIBITED
+	IP_DEST_PORT_UNREACHABLE = 11005
+	IP_PACKET_TOO_BIG        = 11009
+	IP_TTL_EXPIRED_TRANSIT   = 11013 // IP_HOP_LIMIT_EXCEEDED
+	IP_TTL_EXPIRED_REASSEM   = 11014
+	IP_PARAM_PROBLEM         = 11015
+)
+
+// maxWaitMs is the largest timeout IcmpSendEcho takes
+const maxWaitMs = 0x7fffffff
+
+// maxWait bounds how long a request with a zero Options.Timeout waits for a
+// reply, since the blocking call cannot be cancelled and Close waits for it
+const maxWait = 30 * time.Second
+
 // IP_OPTION_INFORMATION structure
 type ipOptionInformation struct {
 	TTL         uint8
@@ -38,13 +64,33 @@ type icmpEchoReply struct {
 	Options       ipOptionInformation
 }
 
+// ICMPV6_ECHO_REPLY layout. The IPV6_ADDRESS_EX member is byte-packed
+// (26 bytes), so Status and RoundTripTime are read at fixed offsets rather
+// than through a Go struct.
+const (
+	icmpv6EchoReplySize         = 36
+	icmpv6EchoReplyStatusOffset = 28
+	icmpv6EchoReplyRTTOffset    = 32
+)
+
 type windowsPinger struct {
-	handle windows.Handle
-	dll    *windows.DLL
-	proc   *windows.Proc
+	handle  windows.Handle // IcmpCreateFile handle for IPv4
+	handle6 windows.Handle // Icmp6CreateFile handle for IPv6, 0 if unavailable
+	dll     *windows.DLL
+	proc    *windows.Proc
+	ttl     uint8 // System default IPv4 TTL
+	hops    uint8 // System default IPv6 hop limit
+
+	mu     sync.Mutex
+	closed bool
+	calls  sync.WaitGroup // ICMP Helper API calls in flight, abandoned ones included
 }
 
-func newPinger() (Pinger, error) {
+func newPinger(backend Backend) (Pinger, error) {
+	if backend != BackendAuto {
+		return nil, fmt.Errorf("the %v backend is not supported on Windows", backend)
+	}
+
 	dll, err := windows.LoadDLL("iphlpapi.dll")
 	if err != nil {
 		return nil, fmt.Errorf("failed to load iphlpapi.dll: %v", err)
@@ -62,36 +108,184 @@ func newPinger() (Pinger, error) {
 		return nil, fmt.Errorf("IcmpCreateFile failed: %v", err)
 	}
 
+	// IPv6 support is optional; hosts without an IPv6 stack still ping IPv4
+	var handle6 uintptr
+	if proc6, err := dll.FindProc("Icmp6CreateFile"); err == nil {
+		handle6, _, _ = proc6.Call()
+		if windows.Handle(handle6) == windows.InvalidHandle {
+			handle6 = 0
+		}
+	}
+
 	return &windowsPinger{
-		handle: windows.Handle(handle),
-		dll:    dll,
-		proc:   proc,
+		handle:  windows.Handle(handle),
+		handle6: windows.Handle(handle6),
+		dll:     dll,
+		proc:    proc,
+		ttl:     defaultTTL(dll, windows.AF_INET),
+		hops:    defaultTTL(dll, windows.AF_INET6),
 	}, nil
 }
 
+// defaultTTL returns the system's default TTL or hop limit for family, or
+// DEFAULT_TTL if it cannot be read
+func defaultTTL(dll *windows.DLL, family uint32) uint8 {
+	proc, err := dll.FindProc("GetIpStatisticsEx")
+	if err != nil {
+		return DEFAULT_TTL
+	}
+	var stats [23]uint32 // MIB_IPSTATS; dwDefaultTTL is the second member
+	ret, _, _ := proc.Call(uintptr(unsafe.Pointer(&stats[0])), uintptr(family))
+	if ret != 0 || stats[1] == 0 || stats[1] > 255 {
+		return DEFAULT_TTL
+	}
+	return uint8(stats[1])
+}
+
+// Close waits for calls still running, including those abandoned when their
+// context was done, before it frees the handles they use
 func (wp *windowsPinger) Close() error {
-	if wp.handle != 0 {
-		closeProc, err := wp.dll.FindProc("IcmpCloseHandle")
-		if err == nil {
+	wp.mu.Lock()
+	if wp.closed {
+		wp.mu.Unlock()
+		return nil
+	}
+	wp.closed = true
+	wp.mu.Unlock()
+	wp.calls.Wait()
+
+	closeProc, err := wp.dll.FindProc("IcmpCloseHandle")
+	if err == nil {
+		if wp.handle != 0 {
 			closeProc.Call(uintptr(wp.handle))
 		}
+		if wp.handle6 != 0 {
+			closeProc.Call(uintptr(wp.handle6))
+		}
 	}
-	return wp.dll.Release()
+	wp.handle, wp.handle6 = 0, 0
+	err = wp.dll.Release()
+	wp.dll = nil
+	return err
 }
 
 func (wp *windowsPinger) Ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
-	sendProc, err := wp.dll.FindProc("IcmpSendEcho")
+	reply, err := wp.PingContext(context.Background(), ip, Options{Timeout: timeout})
+	if err != nil {
+		return 0, err
+	}
+	return reply.RTT, nil
+}
+
+// pingResult carries the outcome of a blocking ICMP Helper API call
+type pingResult struct {
+	reply *Reply
+	err   error
+}
+
+// PingContext runs the blocking ICMP Helper API call on its own goroutine so
+// that it can return as soon as ctx is done. The abandoned call finishes in
+// the background once its own timeout expires. Without Options.Timeout the
+// call waits at most maxWait, or until the context's deadline if sooner.
+func (wp *windowsPinger) PingContext(ctx context.Context, ip net.IP, opts Options) (*Reply, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	wait := opts.Timeout
+	if wait <= 0 {
+		wait = maxWait
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		until := time.Until(deadline)
+		if until <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		wait = min(wait, until)
+	}
+	timeoutMs := uint32(max(1, min(wait.Milliseconds(), maxWaitMs)))
+
+	data, err := newPayload([]byte("ping"), opts)
 	if err != nil {
-		return 0, fmt.Errorf("failed to find IcmpSendEcho: %v", err)
+		return nil, err
+	}
+	ttl := wp.ttl
+	if ip.To4() == nil {
+		ttl = wp.hops
+	}
+	reqOpts := requestOptions(opts, ttl)
+
+	wp.mu.Lock()
+	if wp.closed {
+		wp.mu.Unlock()
+		return nil, errors.New("pinger is closed")
+	}
+	wp.calls.Add(1)
+	wp.mu.Unlock()
+
+	done := make(chan pingResult, 1)
+	go func() {
+		defer wp.calls.Done()
+		var r pingResult
+		var echoed []byte
+		if ip.To4() == nil {
+			r.reply, echoed, r.err = wp.ping6(ip, data, reqOpts, timeoutMs)
+		} else {
+			r.reply, echoed, r.err = wp.ping4(ip, data, reqOpts, timeoutMs)
+		}
+		if r.err == nil && opts.Verify {
+			r.err = verifyPayload(ip, data, echoed)
+		}
+		done <- r
+	}()
+
+	select {
+	case r := <-done:
+		if errors.Is(r.err, errTimedOut) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, &TimeoutError{IP: ip, After: wait}
+		}
+		return r.reply, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// requestOptions returns the IP_OPTION_INFORMATION for the IP-level options
+// in opts, or nil to send with the system defaults. The structure always
+// sets a TTL, so ttl, the system default, is used unless opts has one.
+func requestOptions(opts Options, ttl uint8) *ipOptionInformation {
+	if opts.TTL == 0 && opts.TOS == 0 && !opts.DontFragment {
+		return nil
+	}
+	info := &ipOptionInformation{TTL: ttl, TOS: uint8(opts.TOS)}
+	if opts.TTL > 0 {
+		info.TTL = uint8(opts.TTL)
 	}
+	if opts.DontFragment {
+		info.Flags = IP_FLAG_DF
+	}
+	return info
+}
 
-	timeoutMs := uint32(timeout.Milliseconds())
-	if timeoutMs < 1 {
-		timeoutMs = 1
+// errTimedOut is returned by ping4 and ping6 when no reply arrived in time
+var errTimedOut = errors.New("request timed out")
+
+// ping4 sends an ICMP echo request using IcmpSendEcho and returns the
+// reply and the echoed data.
+func (wp *windowsPinger) ping4(ip net.IP, data []byte, reqOpts *ipOptionInformation, timeoutMs uint32) (*Reply, []byte, error) {
+	sendProc, err := wp.dll.FindProc("IcmpSendEcho")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find IcmpSendEcho: %v", err)
 	}
 
-	data := []byte("ping")
-	replySize := uint32(unsafe.Sizeof(icmpEchoReply{})) + uint32(len(data))
+	// Room for the reply header, the echoed data and an ICMP error
+	replySize := uint32(unsafe.Sizeof(icmpEchoReply{})) + uint32(len(data)) + 8
 	replyBuf := make([]byte, replySize)
 
 	ipAddr := binary.LittleEndian.Uint32(ip.To4())
@@ -101,16 +295,195 @@ func (wp *windowsPinger) Ping(ip net.IP, timeout time.Duration) (time.Duration,
 		uintptr(ipAddr),
 		uintptr(unsafe.Pointer(&data[0])),
 		uintptr(len(data)),
+		uintptr(unsafe.Pointer(reqOpts)),
+		uintptr(unsafe.Pointer(&replyBuf[0])),
+		uintptr(replySize),
+		uintptr(timeoutMs),
+	)
+
+	reply := (*icmpEchoReply)(unsafe.Pointer(&replyBuf[0]))
+	if ret == 0 {
+		return nil, nil, sendEchoError(ip, err)
+	}
+	from := append(net.IP(nil), reply.Address[:]...)
+	rtt := time.Duration(reply.RoundTripTime) * time.Millisecond
+	if err := statusError(ip, reply.Status, from, rtt); err != nil {
+		return nil, nil, err
+	}
+	if !from.Equal(ip) {
+		return nil, nil, &UnexpectedSourceError{Expected: ip, Got: from}
+	}
+
+	// reply.Data points into replyBuf
+	var echoed []byte
+	offset := reply.Data - uintptr(unsafe.Pointer(&replyBuf[0]))
+	if end := offset + uintptr(reply.DataSize); offset < uintptr(len(replyBuf)) && end <= uintptr(len(replyBuf)) {
+		echoed = replyBuf[offset:end]
+	}
+	return &Reply{
+		From: from,
+		RTT:  rtt,
+		TTL:  int(reply.Options.TTL),
+		Size: int(reply.DataSize),
+		Type: 0, // Echo Reply
+	}, echoed, nil
+}
+
+func (wp *windowsPinger) PingMany(ips []net.IP, timeout time.Duration) []Result {
+	return pingMany(wp, ips, timeout)
+}
+
+// ping6 sends an ICMPv6 echo request using Icmp6SendEcho2 and returns the
+// reply and the echoed data.
+func (wp *windowsPinger) ping6(ip net.IP, data []byte, reqOpts *ipOptionInformation, timeoutMs uint32) (*Reply, []byte, error) {
+	if wp.handle6 == 0 {
+		return nil, nil, fmt.Errorf("IPv6 ICMP handle unavailable")
+	}
+
+	sendProc, err := wp.dll.FindProc("Icmp6SendEcho2")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find Icmp6SendEcho2: %v", err)
+	}
+
+	var source, dest windows.RawSockaddrInet6
+	source.Family = windows.AF_INET6
+	dest.Family = windows.AF_INET6
+	copy(dest.Addr[:], ip.To16())
+
+	// Room for the reply header, the echoed data, an ICMP error and an IO_STATUS_BLOCK
+	replySize := uint32(icmpv6EchoReplySize + len(data) + 8 + 16)
+	replyBuf := make([]byte, replySize)
+
+	// ICMPV6_ECHO_REPLY carries no data size, so the space for the echoed
+	// data is filled with the complement of the payload; the bytes the
+	// reply overwrote give its size
+	for i, b := range data {
+		replyBuf[icmpv6EchoReplySize+i] = ^b
+	}
+
+	ret, _, err := sendProc.Call(
+		uintptr(wp.handle6),
 		0,
+		0,
+		0,
+		uintptr(unsafe.Pointer(&source)),
+		uintptr(unsafe.Pointer(&dest)),
+		uintptr(unsafe.Pointer(&data[0])),
+		uintptr(len(data)),
+		uintptr(unsafe.Pointer(reqOpts)),
 		uintptr(unsafe.Pointer(&replyBuf[0])),
 		uintptr(replySize),
 		uintptr(timeoutMs),
 	)
 
 	if ret == 0 {
-		return 0, fmt.Errorf("IcmpSendEcho failed: %v", err)
+		return nil, nil, sendEchoError(ip, err)
 	}
 
-	reply := (*icmpEchoReply)(unsafe.Pointer(&replyBuf[0]))
-	return time.Duration(reply.RoundTripTime) * time.Millisecond, nil
-} 
\ No newline at end of file
+	// sin6_addr follows sin6_port and sin6_flowinfo in IPV6_ADDRESS_EX
+	from := append(net.IP(nil), replyBuf[6:22]...)
+	rtt := time.Duration(binary.LittleEndian.Uint32(replyBuf[icmpv6EchoReplyRTTOffset:])) * time.Millisecond
+	status := binary.LittleEndian.Uint32(replyBuf[icmpv6EchoReplyStatusOffset:])
+	if err := statusError(ip, status, from, rtt); err != nil {
+		return nil, nil, err
+	}
+	if !from.Equal(ip) {
+		return nil, nil, &UnexpectedSourceError{Expected: ip, Got: from}
+	}
+	// ICMPV6_ECHO_REPLY carries no hop limit; the echoed data follows it
+	echoed := replyBuf[icmpv6EchoReplySize : icmpv6EchoReplySize+len(data)]
+	echoed = echoed[:echoedSize(data, echoed)]
+	return &Reply{
+		From: from,
+		RTT:  rtt,
+		TTL:  -1,
+		Size: len(echoed),
+		Type: 129, // Echo Reply
+	}, echoed, nil
+}
+
+// echoedSize returns the number of bytes of buf, filled with the complement
+// of data before the request, that the reply overwrote
+func echoedSize(data, buf []byte) int {
+	for n := len(buf); n > 0; n-- {
+		if buf[n-1] != ^data[n-1] {
+			return n
+		}
+	}
+	return 0
+}
+
+// sendEchoError maps the error of a failed IcmpSendEcho or Icmp6SendEcho2
+// call. The last error is an IP_STATUS value when the request was sent but
+// failed, and a system error code otherwise.
+func sendEchoError(ip net.IP, err error) error {
+	errno, ok := err.(windows.Errno)
+	if !ok {
+		return &SendError{IP: ip, Err: err}
+	}
+	if errno == windows.ERROR_ACCESS_DENIED {
+		return &PermissionError{Op: "sending echo request", Err: err}
+	}
+	if statusErr := statusError(ip, uint32(errno), nil, 0); statusErr != nil {
+		return statusErr
+	}
+	return &SendError{IP: ip, Err: err}
+}
+
+// statusError maps an IP_STATUS value to the matching error type, or returns
+// nil for IP_SUCCESS. from is the address that reported the status, nil or
+// unspecified if the local host did.
+func statusError(ip net.IP, status uint32, from net.IP, rtt time.Duration) error {
+	v6 := ip.To4() == nil
+	if from.IsUnspecified() {
+		from = nil
+	}
+	icmpError := func(typ, code int) error {
+		return newICMPError(v6, from, typ, code, 0, rtt)
+	}
+
+	switch status {
+	case ICMP_SUCCESS:
+		return nil
+	case IP_REQ_TIMED_OUT:
+		return errTimedOut
+	case IP_DEST_NET_UNREACHABLE:
+		if v6 {
+			return icmpError(1, 0)
+		}
+		return icmpError(3, 0)
+	case IP_DEST_HOST_UNREACHABLE:
+		if v6 {
+			return icmpError(1, 3)
+		}
+		return icmpError(3, 1)
+	case IP_DEST_PROT_UNREACHABLE:
+		if v6 {
+			return icmpError(1, 1) // Administratively prohibited
+		}
+		return icmpError(3, 2)
+	case IP_DEST_PORT_UNREACHABLE:
+		if v6 {
+			return icmpError(1, 4)
+		}
+		return icmpError(3, 3)
+	case IP_PACKET_TOO_BIG:
+		if v6 {
+			return icmpError(2, 0)
+		}
+		return icmpError(3, 4)
+	case IP_TTL_EXPIRED_TRANSIT, IP_TTL_EXPIRED_REASSEM:
+		code := int(status - IP_TTL_EXPIRED_TRANSIT)
+		if v6 {
+			return icmpError(3, code)
+		}
+		return icmpError(11, code)
+	case IP_PARAM_PROBLEM:
+		if v6 {
+			return icmpError(4, 0)
+		}
+		return icmpError(12, 0)
+	default:
+		return &SendError{IP: ip, Err: windows.Errno(status)}
+	}
+}
@@ -2,11 +2,21 @@
 package ping
 
 import (
+	"errors"
 	"net"
 	"testing"
 	"time"
 )
 
+// newWindowsPinger creates a pinger and returns the Windows implementation
+func newWindowsPinger() (*windowsPinger, error) {
+	p, err := newPinger(BackendAuto)
+	if err != nil {
+		return nil, err
+	}
+	return p.(*windowsPinger), nil
+}
+
 // TestWindowsPingerCreation tests Windows-specific pinger creation details
 func TestWindowsPingerCreation(t *testing.T) {
 	p, err := newWindowsPinger()
@@ -111,4 +121,71 @@ func TestWindowsTimeoutHandling(t *testing.T) {
 	if err == nil {
 		t.Error("Expected timeout error for unreachable host")
 	}
-} 
\ No newline at end of file
+} 
+// TestWindowsPingAfterClose tests that a closed pinger fails instead of
+// using the released DLL
+func TestWindowsPingAfterClose(t *testing.T) {
+	pinger, err := newWindowsPinger()
+	if err != nil {
+		t.Fatalf("Failed to create Windows pinger: %v", err)
+	}
+	pinger.Close()
+
+	if _, err := pinger.Ping(net.ParseIP("127.0.0.1"), time.Second); err == nil {
+		t.Error("Expected an error when pinging with a closed pinger")
+	}
+}
+
+// TestEchoedSize tests that the size of an IPv6 reply is found from the
+// bytes it overwrote, a corrupted byte included
+func TestEchoedSize(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5, 6}
+	tests := []struct {
+		name string
+		buf  []byte
+		want int
+	}{
+		{"whole", []byte{1, 2, 3, 4, 5, 6}, 6},
+		{"truncated", []byte{1, 2, 3, ^byte(4), ^byte(5), ^byte(6)}, 3},
+		{"corrupt", []byte{1, 2, 3, 4, 9, 6}, 6},
+		{"nothing", []byte{^byte(1), ^byte(2), ^byte(3), ^byte(4), ^byte(5), ^byte(6)}, 0},
+	}
+	for _, tt := range tests {
+		if got := echoedSize(data, tt.buf); got != tt.want {
+			t.Errorf("%s: expected %d bytes, got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+// TestRequestOptions tests that only the options that were set override
+// the system defaults
+func TestRequestOptions(t *testing.T) {
+	if info := requestOptions(Options{}, 64); info != nil {
+		t.Errorf("Expected no options, got %+v", *info)
+	}
+	if info := requestOptions(Options{TOS: 0xb8}, 64); info.TTL != 64 || info.TOS != 0xb8 || info.Flags != 0 {
+		t.Errorf("Expected the default TTL 64 with TOS 0xb8, got %+v", *info)
+	}
+	if info := requestOptions(Options{TTL: 3, DontFragment: true}, 64); info.TTL != 3 || info.Flags != IP_FLAG_DF {
+		t.Errorf("Expected TTL 3 with Don't Fragment, got %+v", *info)
+	}
+}
+
+// TestStatusError tests that a status the local host reported keeps a nil
+// From and is still classified by the probe's address family
+func TestStatusError(t *testing.T) {
+	v6 := net.ParseIP("2001:db8::1")
+	var unreachable *DestinationUnreachableError
+	err := statusError(v6, IP_DEST_PORT_UNREACHABLE, net.IPv6zero, 0)
+	if !errors.As(err, &unreachable) || unreachable.From != nil || unreachable.Code != 4 {
+		t.Fatalf("Expected a local ICMPv6 port unreachable error, got %#v", err)
+	}
+	if msg := err.Error(); msg != "destination port unreachable (reported locally)" {
+		t.Errorf("Unexpected message %q", msg)
+	}
+
+	var tooBig *PacketTooBigError
+	if err := statusError(net.ParseIP("192.0.2.1"), IP_PACKET_TOO_BIG, nil, 0); !errors.As(err, &tooBig) || tooBig.From != nil {
+		t.Errorf("Expected a local packet too big error, got %#v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package pingtest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a simulated clock. Time only moves when Advance or Sleep is
+// called, so code that sleeps between ping rounds runs instantly and
+// deterministically in tests.
+type Clock struct {
+	mu    sync.Mutex
+	start time.Time
+	now   time.Time
+}
+
+// NewClock returns a clock reading start. The zero start means
+// 2000-01-01 00:00:00 UTC.
+func NewClock(start time.Time) *Clock {
+	if start.IsZero() {
+		start = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return &Clock{start: start, now: start}
+}
+
+// Now returns the current simulated time
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Since returns the simulated time elapsed since t
+func (c *Clock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Elapsed returns the simulated time elapsed since the clock was created
+func (c *Clock) Elapsed() time.Duration {
+	return c.Since(c.start)
+}
+
+// At returns the time d after the clock was created, for scheduling
+// outages relative to the start of a test.
+func (c *Clock) At(d time.Duration) time.Time {
+	return c.start.Add(d)
+}
+
+// Advance moves the clock forward by d. Negative durations are ignored.
+func (c *Clock) Advance(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Sleep advances the clock by d and returns immediately
+func (c *Clock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// After advances the clock by d and returns a channel that already holds
+// the new time
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.Advance(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
@@ -0,0 +1,284 @@
+// Package pingtest provides a simulated ping.Pinger for testing code that
+// monitors hosts, without network access or privileges.
+//
+// Each address is scripted with a Host: a latency distribution, a loss
+// rate, scheduled outages and the chance of duplicate or late replies.
+// Probes are answered instantly; their outcome depends on the simulated
+// Clock, which only moves when the test or the code under test advances
+// it, so a monitor loop sleeping between rounds runs as fast as the CPU
+// allows and gives the same results on every run.
+//
+// Example usage:
+//
+//	clock := pingtest.NewClock(time.Time{})
+//	pinger := pingtest.New(clock, 1)
+//	pinger.SetHost(ip, pingtest.Host{
+//	    Latency: pingtest.Normal(20*time.Millisecond, 5*time.Millisecond),
+//	    Loss:    0.1,
+//	    Outages: []pingtest.Outage{{Start: clock.At(time.Minute), End: clock.At(2 * time.Minute)}},
+//	})
+//	for i := 0; i < 180; i++ {
+//	    reply, err := pinger.PingContext(ctx, ip, ping.Options{Timeout: time.Second})
+//	    ...
+//	    clock.Sleep(time.Second)
+//	}
+package pingtest
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// Default TTL of simulated replies
+const DefaultTTL = 64
+
+// Latency draws a round-trip time from a distribution
+type Latency func(r *rand.Rand) time.Duration
+
+// Fixed returns a latency that is always d
+func Fixed(d time.Duration) Latency {
+	return func(*rand.Rand) time.Duration { return d }
+}
+
+// Uniform returns a latency spread evenly between min and max
+func Uniform(min, max time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(r.Int63n(int64(max-min)+1))
+	}
+}
+
+// Normal returns a normally distributed latency, never less than zero
+func Normal(mean, stddev time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		d := mean + time.Duration(r.NormFloat64()*float64(stddev))
+		if d < 0 {
+			return 0
+		}
+		return d
+	}
+}
+
+// Outage is a period during which a host does not answer
+type Outage struct {
+	Start time.Time // First moment the host is down
+	End   time.Time // Moment the host is back up; the zero End means never
+
+	// Err is returned for probes sent during the outage, such as a
+	// *ping.DestinationUnreachableError. Nil means the probes time out.
+	Err error
+}
+
+// covers reports whether t falls within the outage
+func (o Outage) covers(t time.Time) bool {
+	return !t.Before(o.Start) && (o.End.IsZero() || t.Before(o.End))
+}
+
+// Host scripts the behaviour of one simulated address. The zero Host
+// answers every probe instantly.
+type Host struct {
+	Latency   Latency  // Round-trip time of replies, zero if nil
+	Loss      float64  // Fraction of probes that get no reply, 0-1
+	Duplicate float64  // Fraction of replies that arrive twice, 0-1
+	Late      float64  // Fraction of replies that arrive after the timeout, 0-1
+	Outages   []Outage // Periods when the host is down
+	TTL       int      // TTL of replies, DefaultTTL if zero
+}
+
+// host is a scripted address with its own random source, so its outcomes
+// do not depend on how probes to other addresses interleave
+type host struct {
+	Host
+	rand *rand.Rand
+	sent int
+}
+
+// Pinger is a simulated ping.Pinger. Addresses without a Host never answer.
+// It is safe for concurrent use and implements ping.StrayReporter,
+// reporting duplicate and late replies.
+type Pinger struct {
+	clock *Clock
+	seed  int64
+
+	mu     sync.Mutex
+	hosts  map[string]*host
+	seq    int
+	closed bool
+	strays chan ping.Stray
+}
+
+// New creates a Pinger whose outages follow clock. Random outcomes are
+// drawn from sources derived from seed, so the same seed and the same
+// probes give the same results.
+func New(clock *Clock, seed int64) *Pinger {
+	return &Pinger{
+		clock:  clock,
+		seed:   seed,
+		hosts:  make(map[string]*host),
+		strays: make(chan ping.Stray, 64),
+	}
+}
+
+// SetHost scripts the behaviour of ip, replacing any earlier script
+func (p *Pinger) SetHost(ip net.IP, h Host) {
+	hash := fnv.New64a()
+	hash.Write([]byte(ip.String()))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hosts[ip.String()] = &host{Host: h, rand: rand.New(rand.NewSource(p.seed ^ int64(hash.Sum64())))}
+}
+
+// Sent returns how many probes have been sent to ip
+func (p *Pinger) Sent(ip net.IP) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h, ok := p.hosts[ip.String()]; ok {
+		return h.sent
+	}
+	return 0
+}
+
+// outcome is what happens to one probe
+type outcome struct {
+	reply *ping.Reply
+	err   error
+	stray *ping.Stray
+}
+
+// probe decides the fate of a probe sent to ip now
+func (p *Pinger) probe(ip net.IP, opts ping.Options) (outcome, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return outcome{}, fmt.Errorf("pinger is closed")
+	}
+	p.seq++
+	seq := p.seq
+
+	h, ok := p.hosts[ip.String()]
+	if !ok {
+		return outcome{}, nil
+	}
+	h.sent++
+	now := p.clock.Now()
+	for _, o := range h.Outages {
+		if o.covers(now) {
+			return outcome{err: o.Err}, nil
+		}
+	}
+
+	// Draw every random value on each probe so one setting does not shift
+	// the outcomes of another
+	lost := h.rand.Float64() < h.Loss
+	duplicate := h.rand.Float64() < h.Duplicate
+	late := h.rand.Float64() < h.Late
+	var rtt time.Duration
+	if h.Latency != nil {
+		rtt = h.Latency(h.rand)
+	}
+	if lost {
+		return outcome{}, nil
+	}
+
+	if late || (opts.Timeout > 0 && rtt > opts.Timeout) {
+		if late {
+			rtt += opts.Timeout
+		}
+		return outcome{stray: &ping.Stray{Reason: ping.StrayLate, From: ip, Seq: seq, RTT: rtt}}, nil
+	}
+
+	ttl := h.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	typ := 0 // Echo Reply
+	if ip.To4() == nil {
+		typ = 129
+	}
+	o := outcome{reply: &ping.Reply{From: ip, RTT: rtt, TTL: ttl, Size: opts.Size, Seq: seq, Type: typ}}
+	if duplicate {
+		o.stray = &ping.Stray{Reason: ping.StrayDuplicate, From: ip, Seq: seq, RTT: rtt}
+	}
+	return o, nil
+}
+
+// PingContext simulates an echo request to ip. Replies are returned at
+// once with a simulated RTT; probes that get no reply fail at once with a
+// *ping.TimeoutError, or block until ctx is done if opts.Timeout is zero.
+func (p *Pinger) PingContext(ctx context.Context, ip net.IP, opts ping.Options) (*ping.Reply, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	o, err := p.probe(ip, opts)
+	if err != nil {
+		return nil, err
+	}
+	if o.stray != nil {
+		p.report(*o.stray)
+	}
+	switch {
+	case o.reply != nil:
+		return o.reply, nil
+	case o.err != nil:
+		return nil, o.err
+	case opts.Timeout == 0:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	default:
+		return nil, &ping.TimeoutError{IP: ip, After: opts.Timeout}
+	}
+}
+
+// Ping simulates an echo request to ip and returns its RTT
+func (p *Pinger) Ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	reply, err := p.PingContext(context.Background(), ip, ping.Options{Timeout: timeout})
+	if err != nil {
+		return 0, err
+	}
+	return reply.RTT, nil
+}
+
+// PingMany simulates echo requests to every address concurrently
+func (p *Pinger) PingMany(ips []net.IP, timeout time.Duration) []ping.Result {
+	return ping.PingAll(context.Background(), p, ips, ping.Options{Timeout: timeout})
+}
+
+// Strays returns the channel on which duplicate and late replies are
+// reported. It is closed by Close.
+func (p *Pinger) Strays() <-chan ping.Stray {
+	return p.strays
+}
+
+// report delivers a stray without blocking
+func (p *Pinger) report(s ping.Stray) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.strays <- s:
+	default:
+	}
+}
+
+// Close stops the Pinger; later probes fail
+func (p *Pinger) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.strays)
+	}
+	return nil
+}
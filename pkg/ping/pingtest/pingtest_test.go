@@ -0,0 +1,184 @@
+package pingtest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+var (
+	hostA = net.ParseIP("192.0.2.1")
+	hostB = net.ParseIP("2001:db8::1")
+)
+
+// TestClock tests that simulated time only moves when told to
+func TestClock(t *testing.T) {
+	clock := NewClock(time.Time{})
+	start := clock.Now()
+	clock.Sleep(5 * time.Second)
+	clock.Advance(-time.Second)
+	if got := clock.Since(start); got != 5*time.Second {
+		t.Errorf("Expected 5s to have passed, got %v", got)
+	}
+	if !clock.At(5*time.Second).Equal(clock.Now()) || clock.Elapsed() != 5*time.Second {
+		t.Errorf("Expected At(5s) to be now, got %v and %v", clock.At(5*time.Second), clock.Now())
+	}
+	if now := <-clock.After(time.Second); !now.Equal(clock.At(6 * time.Second)) {
+		t.Errorf("Expected After to fire at 6s, got %v", now)
+	}
+}
+
+// TestLatency tests the latency distributions
+func TestLatency(t *testing.T) {
+	clock := NewClock(time.Time{})
+	p := New(clock, 1)
+	p.SetHost(hostA, Host{Latency: Uniform(10*time.Millisecond, 20*time.Millisecond), TTL: 57})
+	p.SetHost(hostB, Host{Latency: Fixed(30 * time.Millisecond)})
+
+	for i := 0; i < 100; i++ {
+		reply, err := p.PingContext(context.Background(), hostA, ping.Options{Timeout: time.Second, Size: 56})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reply.RTT < 10*time.Millisecond || reply.RTT > 20*time.Millisecond {
+			t.Errorf("RTT %v outside 10-20ms", reply.RTT)
+		}
+		if reply.TTL != 57 || reply.Size != 56 || !reply.From.Equal(hostA) {
+			t.Errorf("Unexpected reply %+v", reply)
+		}
+	}
+
+	rtt, err := p.Ping(hostB, time.Second)
+	if err != nil || rtt != 30*time.Millisecond {
+		t.Errorf("Expected 30ms from %v, got %v, %v", hostB, rtt, err)
+	}
+	if sent := p.Sent(hostA); sent != 100 {
+		t.Errorf("Expected 100 probes sent to %v, got %d", hostA, sent)
+	}
+}
+
+// TestLoss tests that the loss rate is applied and reproducible
+func TestLoss(t *testing.T) {
+	run := func() []bool {
+		p := New(NewClock(time.Time{}), 42)
+		p.SetHost(hostA, Host{Loss: 0.3})
+		var results []bool
+		for i := 0; i < 1000; i++ {
+			_, err := p.PingContext(context.Background(), hostA, ping.Options{Timeout: time.Second})
+			var timeout *ping.TimeoutError
+			if err != nil && !errors.As(err, &timeout) {
+				t.Fatalf("Expected a timeout, got %v", err)
+			}
+			results = append(results, err == nil)
+		}
+		return results
+	}
+
+	first, second := run(), run()
+	lost := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Probe %d differs between runs with the same seed", i)
+		}
+		if !first[i] {
+			lost++
+		}
+	}
+	if lost < 250 || lost > 350 {
+		t.Errorf("Expected about 300 of 1000 probes lost, got %d", lost)
+	}
+}
+
+// TestOutage tests that a host is down only during its outages
+func TestOutage(t *testing.T) {
+	clock := NewClock(time.Time{})
+	p := New(clock, 1)
+	unreachable := &ping.DestinationUnreachableError{ICMPError: ping.ICMPError{From: hostA, Type: 3, Code: 1}}
+	p.SetHost(hostA, Host{Outages: []Outage{
+		{Start: clock.At(10 * time.Second), End: clock.At(20 * time.Second)},
+		{Start: clock.At(30 * time.Second), End: clock.At(40 * time.Second), Err: unreachable},
+	}})
+
+	tests := []struct {
+		at   time.Duration
+		want error
+	}{
+		{0, nil},
+		{10 * time.Second, &ping.TimeoutError{}},
+		{19 * time.Second, &ping.TimeoutError{}},
+		{20 * time.Second, nil},
+		{35 * time.Second, unreachable},
+		{40 * time.Second, nil},
+	}
+	for _, tt := range tests {
+		clock.Advance(clock.At(tt.at).Sub(clock.Now()))
+		_, err := p.PingContext(context.Background(), hostA, ping.Options{Timeout: time.Second})
+		switch want := tt.want.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("At %v: expected a reply, got %v", tt.at, err)
+			}
+		case *ping.TimeoutError:
+			if !errors.As(err, &want) {
+				t.Errorf("At %v: expected a timeout, got %v", tt.at, err)
+			}
+		default:
+			if err != tt.want {
+				t.Errorf("At %v: expected %v, got %v", tt.at, tt.want, err)
+			}
+		}
+	}
+}
+
+// TestStrays tests that duplicate and late replies are reported
+func TestStrays(t *testing.T) {
+	p := New(NewClock(time.Time{}), 1)
+	p.SetHost(hostA, Host{Latency: Fixed(time.Millisecond), Duplicate: 1})
+	p.SetHost(hostB, Host{Latency: Fixed(time.Millisecond), Late: 1})
+
+	if _, err := p.PingContext(context.Background(), hostA, ping.Options{Timeout: time.Second}); err != nil {
+		t.Errorf("Expected the duplicated probe to succeed, got %v", err)
+	}
+	_, err := p.PingContext(context.Background(), hostB, ping.Options{Timeout: time.Second})
+	var timeout *ping.TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Errorf("Expected the late probe to time out, got %v", err)
+	}
+	p.Close()
+
+	var strays []ping.Stray
+	for s := range p.Strays() {
+		strays = append(strays, s)
+	}
+	if len(strays) != 2 {
+		t.Fatalf("Expected 2 strays, got %+v", strays)
+	}
+	if strays[0].Reason != ping.StrayDuplicate || !strays[0].From.Equal(hostA) {
+		t.Errorf("Expected a duplicate from %v, got %+v", hostA, strays[0])
+	}
+	if strays[1].Reason != ping.StrayLate || strays[1].RTT != time.Second+time.Millisecond {
+		t.Errorf("Expected a late reply after 1.001s, got %+v", strays[1])
+	}
+}
+
+// TestUnknownHost tests that unscripted addresses never answer
+func TestUnknownHost(t *testing.T) {
+	p := New(NewClock(time.Time{}), 1)
+	defer p.Close()
+
+	results := p.PingMany([]net.IP{hostA}, time.Second)
+	if results[0].Success {
+		t.Errorf("Expected no reply from an unknown host")
+	}
+
+	// Without a timeout the probe waits for the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.PingContext(ctx, hostA, ping.Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+//go:build !windows
+package ping
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// listenRaw opens a raw ICMP or ICMPv6 socket, which needs root or
+// CAP_NET_RAW. Raw sockets receive every ICMP message for the host, so
+// where the platform supports it a kernel filter passes only echo replies
+// carrying our ID and ICMP errors, which may quote our echo requests.
+func listenRaw(v6 bool) (*icmpSocket, error) {
+	network, address := "ip4:icmp", "0.0.0.0"
+	if v6 {
+		network, address = "ip6:ipv6-icmp", "::"
+	}
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var s *icmpSocket
+	if v6 {
+		s = newICMPSocket(conn, nil, ipv6.NewPacketConn(conn))
+	} else {
+		s = newICMPSocket(conn, ipv4.NewPacketConn(conn), nil)
+	}
+	s.raw = true
+
+	// The filter only saves waking up for other processes' traffic, so
+	// it is fine for the platform not to support it
+	if prog, err := bpf.Assemble(echoFilter(s.id, v6)); err == nil {
+		if v6 {
+			s.p6.SetBPF(prog)
+		} else {
+			s.p4.SetBPF(prog)
+		}
+	}
+	if rc, err := conn.(syscall.Conn).SyscallConn(); err == nil {
+		configureRaw(s, rc, v6)
+	}
+	return s, nil
+}
+
+// echoFilter returns a BPF program accepting echo replies with the given ID
+// and ICMP error messages. IPv4 raw sockets see the IP header first; IPv6
+// ones start at the ICMPv6 header.
+func echoFilter(id int, v6 bool) []bpf.Instruction {
+	reply := uint32(ipv4.ICMPTypeEchoReply)
+	errorTypes := []uint32{
+		uint32(ipv4.ICMPTypeDestinationUnreachable),
+		uint32(ipv4.ICMPTypeTimeExceeded),
+		uint32(ipv4.ICMPTypeParameterProblem),
+	}
+	if v6 {
+		reply = uint32(ipv6.ICMPTypeEchoReply)
+		errorTypes = []uint32{
+			uint32(ipv6.ICMPTypeDestinationUnreachable),
+			uint32(ipv6.ICMPTypePacketTooBig),
+			uint32(ipv6.ICMPTypeTimeExceeded),
+			uint32(ipv6.ICMPTypeParameterProblem),
+		}
+	}
+	n := uint8(len(errorTypes))
+
+	var prog []bpf.Instruction
+	if !v6 {
+		// X = length of the IPv4 header
+		prog = append(prog, bpf.LoadMemShift{Off: 0})
+	}
+	prog = append(prog,
+		bpf.LoadIndirect{Off: 0, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: reply, SkipFalse: 2},
+		bpf.LoadIndirect{Off: 4, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(id), SkipTrue: n + 1, SkipFalse: n},
+	)
+	for i, typ := range errorTypes {
+		prog = append(prog, bpf.JumpIf{Cond: bpf.JumpEqual, Val: typ, SkipTrue: n - uint8(i)})
+	}
+	return append(prog,
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 0xffffffff},
+	)
+}
@@ -0,0 +1,77 @@
+//go:build !windows
+package ping
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// TestEchoFilter runs the raw socket filter over sample packets
+func TestEchoFilter(t *testing.T) {
+	const id = 0x1234
+	header := make([]byte, ipv4.HeaderLen)
+	header[0] = 0x45
+
+	tests := []struct {
+		name   string
+		v6     bool
+		packet []byte
+		accept bool
+	}{
+		{"v4 reply with our ID", false, append(header, createICMPMessage(ipv4.ICMPTypeEchoReply, id, 1, nil)...), true},
+		{"v4 reply with another ID", false, append(header, createICMPMessage(ipv4.ICMPTypeEchoReply, id+1, 1, nil)...), false},
+		{"v4 echo request", false, append(header, createICMPMessage(ipv4.ICMPTypeEcho, id, 1, nil)...), false},
+		{"v4 time exceeded", false, append(header, 11, 0, 0, 0, 0, 0, 0, 0), true},
+		{"v4 redirect", false, append(header, 5, 0, 0, 0, 0, 0, 0, 0), false},
+		{"v4 header with options", false, append([]byte{0x46}, append(make([]byte, 23), createICMPMessage(ipv4.ICMPTypeEchoReply, id, 1, nil)...)...), true},
+		{"v6 reply with our ID", true, createICMPMessage(ipv6.ICMPTypeEchoReply, id, 1, nil), true},
+		{"v6 reply with another ID", true, createICMPMessage(ipv6.ICMPTypeEchoReply, id+1, 1, nil), false},
+		{"v6 packet too big", true, []byte{2, 0, 0, 0, 0, 0, 5, 0}, true},
+		{"v6 neighbor solicitation", true, []byte{135, 0, 0, 0, 0, 0, 0, 0}, false},
+	}
+	for _, tt := range tests {
+		vm, err := bpf.NewVM(echoFilter(id, tt.v6))
+		if err != nil {
+			t.Fatalf("Invalid filter: %v", err)
+		}
+		n, err := vm.Run(tt.packet)
+		if err != nil {
+			t.Fatalf("%s: filter failed: %v", tt.name, err)
+		}
+		if accepted := n > 0; accepted != tt.accept {
+			t.Errorf("%s: expected accept=%v, got %v", tt.name, tt.accept, accepted)
+		}
+	}
+}
+
+// TestRawBackend pings localhost over a raw socket where the process may
+// open one
+func TestRawBackend(t *testing.T) {
+	p, err := newPinger(BackendRaw)
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("Raw sockets need root or CAP_NET_RAW")
+	}
+	if err != nil {
+		t.Fatalf("Failed to create raw pinger: %v", err)
+	}
+	defer p.Close()
+
+	up := p.(*unixPinger)
+	if up.conn == nil || !up.conn.raw || up.Backend() != BackendRaw {
+		t.Fatalf("Expected a raw IPv4 socket")
+	}
+	rtt, err := p.Ping(net.ParseIP("127.0.0.1"), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to ping localhost over a raw socket: %v", err)
+	}
+	if rtt <= 0 {
+		t.Errorf("Expected positive RTT, got %v", rtt)
+	}
+}
@@ -0,0 +1,240 @@
+package ping
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// sizeofSockExtendedErr is the size of struct sock_extended_err
+const sizeofSockExtendedErr = 16
+
+// listenDatagram opens an unprivileged ICMP or ICMPv6 socket. It is created
+// by hand rather than with icmp.ListenPacket so that IP_RECVERR can be
+// enabled: Linux only reports ICMP errors for ping sockets through the
+// socket error queue.
+func listenDatagram(v6 bool) (*icmpSocket, error) {
+	family, proto, level := unix.AF_INET, unix.IPPROTO_ICMP, unix.IPPROTO_IP
+	recvErr, recvTTL := unix.IP_RECVERR, unix.IP_RECVTTL
+	var sa unix.Sockaddr = &unix.SockaddrInet4{}
+	if v6 {
+		family, proto, level = unix.AF_INET6, unix.IPPROTO_ICMPV6, unix.IPPROTO_IPV6
+		recvErr, recvTTL = unix.IPV6_RECVERR, unix.IPV6_RECVHOPLIMIT
+		sa = &unix.SockaddrInet6{}
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	for _, opt := range []int{recvErr, recvTTL} {
+		if err := unix.SetsockoptInt(fd, level, opt, 1); err != nil {
+			unix.Close(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "datagram-oriented icmp")
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var s *icmpSocket
+	if v6 {
+		s = newICMPSocket(conn, nil, ipv6.NewPacketConn(conn))
+	} else {
+		s = newICMPSocket(conn, ipv4.NewPacketConn(conn), nil)
+	}
+	s.recv = errQueueReader(rc)
+	s.setDF = pmtuDiscoverSetter(rc, v6)
+	s.clearError = pendingErrorClearer(rc)
+	return s, nil
+}
+
+// configureRaw sets up the Linux specifics of a raw socket. ICMP errors
+// arrive inline on raw sockets, so only don't-fragment needs setting up.
+func configureRaw(s *icmpSocket, rc syscall.RawConn, v6 bool) {
+	s.setDF = pmtuDiscoverSetter(rc, v6)
+}
+
+// pmtuDiscoverSetter returns an icmpSocket.setDF function that switches
+// path MTU discovery between IP_PMTUDISC_DO, which sets DF and fails sends
+// larger than the known path MTU with EMSGSIZE, and the socket's default.
+func pmtuDiscoverSetter(rc syscall.RawConn, v6 bool) func(bool) error {
+	level, opt, do := unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO
+	if v6 {
+		level, opt, do = unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO
+	}
+
+	def := unix.IP_PMTUDISC_WANT
+	rc.Control(func(fd uintptr) {
+		if v, err := unix.GetsockoptInt(int(fd), level, opt); err == nil {
+			def = v
+		}
+	})
+	return func(on bool) error {
+		value := def
+		if on {
+			value = do
+		}
+		var err error
+		if cerr := rc.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), level, opt, value)
+		}); cerr != nil {
+			return cerr
+		}
+		return os.NewSyscallError("setsockopt", err)
+	}
+}
+
+// pendingErrorClearer returns an icmpSocket.clearError function. With
+// IP_RECVERR, Linux both queues an ICMP error and leaves it pending on the
+// socket, where it fails the next send; reading SO_ERROR resets it. The
+// queued copy is still dispatched by the receive loop.
+func pendingErrorClearer(rc syscall.RawConn) func() {
+	return func() {
+		rc.Control(func(fd uintptr) {
+			unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		})
+	}
+}
+
+// errQueueReader returns an icmpSocket.recv function that drains the socket
+// error queue every time the socket becomes readable, before reading the
+// next message. Draining on every wakeup matters because the pending error
+// that signals a queued ICMP error may be cleared before a concurrent send.
+func errQueueReader(rc syscall.RawConn) func([]byte, func(queuedError)) (int, int, net.IP, error) {
+	errBuf := make([]byte, 1500)
+	oob := make([]byte, 512)
+	return func(b []byte, onError func(queuedError)) (int, int, net.IP, error) {
+		var n, oobn int
+		var from unix.Sockaddr
+		var recvErr error
+		err := rc.Read(func(fd uintptr) bool {
+			for {
+				en, eoobn, _, dst, err := unix.Recvmsg(int(fd), errBuf, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+				if err != nil {
+					break
+				}
+				if qe, ok := parseQueuedError(errBuf[:en], oob[:eoobn], dst); ok {
+					qe.received = time.Now()
+					onError(qe)
+				}
+			}
+
+			n, oobn, _, from, recvErr = unix.Recvmsg(int(fd), b, oob, unix.MSG_DONTWAIT)
+			return recvErr != unix.EAGAIN
+		})
+		if err != nil {
+			return 0, -1, nil, err
+		}
+		if recvErr != nil {
+			return 0, -1, nil, os.NewSyscallError("recvmsg", recvErr)
+		}
+		return n, parseTTL(oob[:oobn]), sockaddrIP(from), nil
+	}
+}
+
+// parseTTL returns the TTL or hop limit from received control messages, or
+// -1 if there is none.
+func parseTTL(oob []byte) int {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1
+	}
+	for _, m := range msgs {
+		isTTL := (m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TTL) ||
+			(m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_HOPLIMIT)
+		if isTTL && len(m.Data) >= 4 {
+			return int(int32(binary.NativeEndian.Uint32(m.Data[0:4])))
+		}
+	}
+	return -1
+}
+
+// parseQueuedError decodes one error queue entry. The payload is the echo
+// request that failed, the control message holds a sock_extended_err
+// followed by the address of the host that reported the error, and dst is
+// the destination the echo request was sent to.
+func parseQueuedError(payload, oob []byte, dst unix.Sockaddr) (queuedError, bool) {
+	var qe queuedError
+	if len(payload) < 8 {
+		return qe, false
+	}
+	qe.seq = int(binary.BigEndian.Uint16(payload[6:8]))
+	qe.dst = sockaddrIP(dst)
+
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return qe, false
+	}
+	for _, m := range msgs {
+		isErr := (m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_RECVERR) ||
+			(m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_RECVERR)
+		if !isErr || len(m.Data) < sizeofSockExtendedErr {
+			continue
+		}
+
+		// struct sock_extended_err: errno, origin, type, code, pad, info, data
+		switch m.Data[4] {
+		case unix.SO_EE_ORIGIN_ICMP, unix.SO_EE_ORIGIN_ICMP6:
+			qe.typ = int(m.Data[5])
+			qe.code = int(m.Data[6])
+			qe.mtu = int(binary.NativeEndian.Uint32(m.Data[8:12]))
+			qe.from = offenderIP(m.Data[sizeofSockExtendedErr:])
+		case unix.SO_EE_ORIGIN_LOCAL:
+			qe.errno = syscall.Errno(binary.NativeEndian.Uint32(m.Data[0:4]))
+			qe.mtu = int(binary.NativeEndian.Uint32(m.Data[8:12]))
+		default:
+			continue
+		}
+		return qe, true
+	}
+	return qe, false
+}
+
+// offenderIP decodes the sockaddr that follows a sock_extended_err.
+func offenderIP(b []byte) net.IP {
+	if len(b) < 2 {
+		return nil
+	}
+	switch binary.NativeEndian.Uint16(b[0:2]) {
+	case unix.AF_INET:
+		if len(b) >= 8 {
+			return net.IP(append([]byte(nil), b[4:8]...))
+		}
+	case unix.AF_INET6:
+		if len(b) >= 24 {
+			return net.IP(append([]byte(nil), b[8:24]...))
+		}
+	}
+	return nil
+}
+
+// sockaddrIP returns the IP address of a socket address
+func sockaddrIP(sa unix.Sockaddr) net.IP {
+	switch a := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(append([]byte(nil), a.Addr[:]...))
+	case *unix.SockaddrInet6:
+		return net.IP(append([]byte(nil), a.Addr[:]...))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package ping
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// errQueueMessage builds the control message Linux attaches to an error
+// queue entry: a sock_extended_err followed by the offender's address
+func errQueueMessage(origin, typ, code uint8, errno, info uint32, offender net.IP) []byte {
+	data := make([]byte, sizeofSockExtendedErr+unix.SizeofSockaddrInet4)
+	binary.NativeEndian.PutUint32(data[0:4], errno)
+	data[4], data[5], data[6] = origin, typ, code
+	binary.NativeEndian.PutUint32(data[8:12], info)
+	if offender != nil {
+		binary.NativeEndian.PutUint16(data[16:18], unix.AF_INET)
+		copy(data[20:24], offender.To4())
+	}
+
+	b := make([]byte, unix.CmsgSpace(len(data)))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = unix.IPPROTO_IP
+	h.Type = unix.IP_RECVERR
+	h.SetLen(unix.CmsgLen(len(data)))
+	copy(b[unix.CmsgLen(0):], data)
+	return b
+}
+
+// TestParseQueuedError tests decoding of error queue entries
+func TestParseQueuedError(t *testing.T) {
+	payload := createICMPMessage(ipv4.ICMPTypeEcho, 1, 4242, []byte("ping"))
+	dst := &unix.SockaddrInet4{Addr: [4]byte{192, 0, 2, 10}}
+	router := net.ParseIP("198.51.100.254")
+
+	oob := errQueueMessage(unix.SO_EE_ORIGIN_ICMP, 3, 13, uint32(unix.EHOSTUNREACH), 0, router)
+	qe, ok := parseQueuedError(payload, oob, dst)
+	if !ok {
+		t.Fatal("Expected ICMP error to be decoded")
+	}
+	if qe.seq != 4242 || qe.typ != 3 || qe.code != 13 || qe.errno != 0 {
+		t.Errorf("Unexpected decoded error: %+v", qe)
+	}
+	if !qe.from.Equal(router) || !qe.dst.Equal(net.ParseIP("192.0.2.10")) {
+		t.Errorf("Expected error from %v for 192.0.2.10, got from %v for %v", router, qe.from, qe.dst)
+	}
+
+	// Locally generated errors carry an errno instead, and the path MTU for
+	// EMSGSIZE
+	oob = errQueueMessage(unix.SO_EE_ORIGIN_LOCAL, 0, 0, uint32(unix.EMSGSIZE), 1280, nil)
+	qe, ok = parseQueuedError(payload, oob, dst)
+	if !ok || qe.errno != syscall.EMSGSIZE || qe.mtu != 1280 {
+		t.Errorf("Expected local EMSGSIZE error, got %+v (ok=%v)", qe, ok)
+	}
+
+	if _, ok := parseQueuedError(payload[:4], oob, dst); ok {
+		t.Error("Expected truncated payload to be rejected")
+	}
+}
+
+// TestPendingErrorClearer tests that an error left pending by an ICMP error
+// no longer fails the next send once cleared. A connected UDP socket gets
+// one from the port unreachable answering a send to a closed port.
+func TestPendingErrorClearer(t *testing.T) {
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Cannot open UDP socket: %v", err)
+	}
+	addr := closed.LocalAddr().(*net.UDPAddr)
+	closed.Close()
+
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		t.Skipf("Cannot open UDP socket: %v", err)
+	}
+	defer conn.Close()
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clear := pendingErrorClearer(rc)
+
+	conn.Write([]byte("ping"))
+	time.Sleep(50 * time.Millisecond)
+	if _, err := conn.Write([]byte("ping")); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Skipf("Expected the port unreachable to be left pending, got %v", err)
+	}
+
+	// The failed send consumed that error; leave another one pending
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Expected the send after the failed one to succeed, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	clear()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Errorf("Expected the send after clearing to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux && !windows
+package ping
+
+import (
+	"syscall"
+
+	"golang.org/x/net/icmp"
+)
+
+// listenDatagram opens an unprivileged ICMP or ICMPv6 socket. ICMP errors
+// for our probes are delivered inline as ICMP messages on these platforms.
+func listenDatagram(v6 bool) (*icmpSocket, error) {
+	network := "udp4"
+	if v6 {
+		network = "udp6"
+	}
+	conn, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		return nil, err
+	}
+	return newICMPSocket(conn, conn.IPv4PacketConn(), conn.IPv6PacketConn()), nil
+}
+
+// configureRaw sets up the platform specifics of a raw socket; there are
+// none here.
+func configureRaw(s *icmpSocket, rc syscall.RawConn, v6 bool) {}
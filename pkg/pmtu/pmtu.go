@@ -0,0 +1,184 @@
+// Package pmtu discovers the path MTU to a host with unprivileged echo
+// requests. It sends probes with the Don't Fragment bit set and binary
+// searches for the largest one that is answered.
+//
+// Example usage:
+//
+//	pinger, err := ping.New()
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer pinger.Close()
+//
+//	result, err := pmtu.Discover(ctx, pinger, ip, pmtu.Options{})
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	log.Printf("path MTU to %v is %d", ip, result.MTU)
+package pmtu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// Header overhead of an echo request: the IP header plus the 8-byte ICMP
+// echo header.
+const (
+	overhead4 = 20 + 8
+	overhead6 = 40 + 8
+)
+
+// Defaults for the zero Options
+const (
+	DefaultMax     = 9000
+	DefaultTimeout = time.Second
+	DefaultRetries = 2
+)
+
+// Options controls a path MTU search
+type Options struct {
+	// Min is the smallest MTU to try; it must get through. Defaults to 68
+	// for IPv4 and 1280 for IPv6, the minimums the protocols guarantee.
+	Min int
+
+	// Max is the largest MTU to try, DefaultMax if zero.
+	Max int
+
+	// Timeout is how long to wait for each probe, DefaultTimeout if zero.
+	Timeout time.Duration
+
+	// Retries is how many times an unanswered size is retried before it is
+	// considered too big, so that ordinary packet loss does not shrink the
+	// result. DefaultRetries if zero; negative means no retries.
+	Retries int
+}
+
+// Result is the outcome of a path MTU search
+type Result struct {
+	MTU      int    // Largest packet that got through, including IP and ICMP headers
+	Payload  int    // Echo payload bytes of the largest packet that got through
+	Probes   int    // Echo requests sent
+	Reported int    // Smallest MTU a router or the local host reported, 0 if none
+	From     net.IP // Router that reported Reported, nil for the local host or none
+}
+
+// Overhead returns the IP and ICMP header bytes of an echo request to ip.
+func Overhead(ip net.IP) int {
+	if ip.To4() != nil {
+		return overhead4
+	}
+	return overhead6
+}
+
+// Discover finds the path MTU to ip. It fails if a probe of opts.Min bytes
+// is not answered, or if a probe fails for a reason other than its size.
+func Discover(ctx context.Context, p ping.Pinger, ip net.IP, opts Options) (*Result, error) {
+	opts = withDefaults(ip, opts)
+	overhead := Overhead(ip)
+	if opts.Min > opts.Max {
+		return nil, fmt.Errorf("minimum MTU %d is larger than maximum %d", opts.Min, opts.Max)
+	}
+	if opts.Max-overhead > ping.MaxSize {
+		return nil, fmt.Errorf("maximum MTU %d is too large", opts.Max)
+	}
+
+	s := &search{ctx: ctx, p: p, ip: ip, opts: opts}
+	lo, hi := opts.Min-overhead, opts.Max-overhead
+	fits, err := s.fits(lo)
+	if err != nil {
+		return nil, err
+	}
+	if !fits {
+		return nil, fmt.Errorf("no reply from %v to %d byte probes", ip, opts.Min)
+	}
+
+	// lo always fits; find the largest size up to hi that does
+	for lo < hi {
+		if s.result.Reported > 0 && s.result.Reported-overhead < hi {
+			// Don't search above an MTU a router told us about
+			hi = max(s.result.Reported-overhead, lo)
+			if hi == lo {
+				break
+			}
+		}
+		mid := lo + (hi-lo+1)/2
+		fits, err := s.fits(mid)
+		if err != nil {
+			return nil, err
+		}
+		if fits {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	s.result.Payload = lo
+	s.result.MTU = lo + overhead
+	return &s.result, nil
+}
+
+// withDefaults fills in the zero fields of opts
+func withDefaults(ip net.IP, opts Options) Options {
+	if opts.Min == 0 {
+		opts.Min = 68
+		if ip.To4() == nil {
+			opts.Min = 1280
+		}
+	}
+	if opts.Max == 0 {
+		opts.Max = DefaultMax
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	} else if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	return opts
+}
+
+// search holds the state of one Discover call
+type search struct {
+	ctx    context.Context
+	p      ping.Pinger
+	ip     net.IP
+	opts   Options
+	result Result
+}
+
+// fits reports whether a DF probe with size payload bytes gets through.
+// Unanswered probes are retried; errors that say nothing about the size
+// end the search.
+func (s *search) fits(size int) (bool, error) {
+	opts := ping.Options{Timeout: s.opts.Timeout, Size: size, DontFragment: true}
+	for attempt := 0; attempt <= s.opts.Retries; attempt++ {
+		s.result.Probes++
+		_, err := s.p.PingContext(s.ctx, s.ip, opts)
+
+		var tooBig *ping.PacketTooBigError
+		var timeout *ping.TimeoutError
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.As(err, &tooBig):
+			if tooBig.MTU > 0 && (s.result.Reported == 0 || tooBig.MTU < s.result.Reported) {
+				s.result.Reported, s.result.From = tooBig.MTU, tooBig.From
+			}
+			return false, nil
+		case errors.As(err, &timeout):
+			continue
+		default:
+			return false, err
+		}
+	}
+	return false, nil
+}
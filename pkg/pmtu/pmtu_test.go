@@ -0,0 +1,128 @@
+package pmtu
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// pathPinger simulates a path with a fixed MTU
+type pathPinger struct {
+	mtu       int  // Path MTU
+	report    bool // Whether too-big probes get ICMP Fragmentation Needed, otherwise they vanish
+	loseFirst bool // Drop the first probe of every size once
+	seen      map[int]bool
+	sent      int
+}
+
+func (p *pathPinger) PingContext(ctx context.Context, ip net.IP, opts ping.Options) (*ping.Reply, error) {
+	p.sent++
+	if !opts.DontFragment {
+		return nil, errors.New("probe without DF")
+	}
+	if p.loseFirst && !p.seen[opts.Size] {
+		p.seen[opts.Size] = true
+		return nil, &ping.TimeoutError{IP: ip, After: opts.Timeout}
+	}
+	if opts.Size+Overhead(ip) > p.mtu {
+		if p.report {
+			return nil, &ping.PacketTooBigError{ICMPError: ping.ICMPError{From: net.ParseIP("192.0.2.254"), Type: 3, Code: 4}, MTU: p.mtu}
+		}
+		return nil, &ping.TimeoutError{IP: ip, After: opts.Timeout}
+	}
+	return &ping.Reply{From: ip, Size: opts.Size}, nil
+}
+
+func (p *pathPinger) Ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	_, err := p.PingContext(context.Background(), ip, ping.Options{Timeout: timeout})
+	return 0, err
+}
+
+func (p *pathPinger) PingMany(ips []net.IP, timeout time.Duration) []ping.Result {
+	return ping.PingAll(context.Background(), p, ips, ping.Options{Timeout: timeout})
+}
+
+func (p *pathPinger) Close() error { return nil }
+
+// TestDiscover tests the search on paths that do and don't report their MTU
+func TestDiscover(t *testing.T) {
+	v4 := net.ParseIP("192.0.2.1")
+	v6 := net.ParseIP("2001:db8::1")
+
+	tests := []struct {
+		name string
+		ip   net.IP
+		path *pathPinger
+		want int
+	}{
+		{"blackhole", v4, &pathPinger{mtu: 1400}, 1400},
+		{"reported", v4, &pathPinger{mtu: 1420, report: true}, 1420},
+		{"lossy", v4, &pathPinger{mtu: 1500, loseFirst: true, seen: map[int]bool{}}, 1500},
+		{"jumbo", v4, &pathPinger{mtu: 9000}, 9000},
+		{"ipv6", v6, &pathPinger{mtu: 1280, report: true}, 1280},
+	}
+	for _, tt := range tests {
+		result, err := Discover(context.Background(), tt.path, tt.ip, Options{Timeout: time.Millisecond})
+		if err != nil {
+			t.Errorf("%s: Discover failed: %v", tt.name, err)
+			continue
+		}
+		if result.MTU != tt.want {
+			t.Errorf("%s: Expected MTU %d, got %d", tt.name, tt.want, result.MTU)
+		}
+		if result.Payload != tt.want-Overhead(tt.ip) {
+			t.Errorf("%s: Expected payload %d, got %d", tt.name, tt.want-Overhead(tt.ip), result.Payload)
+		}
+		if result.Probes != tt.path.sent {
+			t.Errorf("%s: Expected %d probes counted, got %d", tt.name, tt.path.sent, result.Probes)
+		}
+		if tt.path.report && result.Reported != tt.want {
+			t.Errorf("%s: Expected reported MTU %d, got %d", tt.name, tt.want, result.Reported)
+		}
+	}
+}
+
+// TestDiscoverReportedShortcut tests that a reported MTU limits the search
+func TestDiscoverReportedShortcut(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	blind := &pathPinger{mtu: 1400}
+	told := &pathPinger{mtu: 1400, report: true}
+	Discover(context.Background(), blind, ip, Options{Timeout: time.Millisecond})
+	Discover(context.Background(), told, ip, Options{Timeout: time.Millisecond})
+	if told.sent >= blind.sent {
+		t.Errorf("Expected fewer probes with a reported MTU, got %d vs %d", told.sent, blind.sent)
+	}
+}
+
+// TestDiscoverUnreachable tests that a host not answering minimum-size
+// probes is an error
+func TestDiscoverUnreachable(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	if _, err := Discover(context.Background(), &pathPinger{mtu: 60}, ip, Options{Timeout: time.Millisecond}); err == nil {
+		t.Error("Expected error when minimum-size probes get no reply")
+	}
+	if _, err := Discover(context.Background(), &pathPinger{mtu: 1500}, ip, Options{Min: 1500, Max: 1400}); err == nil {
+		t.Error("Expected error for minimum above maximum")
+	}
+}
+
+// TestDiscoverLocalhost tests discovery against the loopback interface
+func TestDiscoverLocalhost(t *testing.T) {
+	p, err := ping.New()
+	if err != nil {
+		t.Skipf("Cannot create pinger: %v", err)
+	}
+	defer p.Close()
+
+	result, err := Discover(context.Background(), p, net.ParseIP("127.0.0.1"), Options{Max: 1500})
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	if result.MTU != 1500 {
+		t.Errorf("Expected loopback to pass 1500 byte probes, got MTU %d", result.MTU)
+	}
+}
@@ -0,0 +1,278 @@
+package probe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// maxLine is the longest greeting line a banner probe reads
+const maxLine = 1024
+
+// BannerPinger probes a service by connecting to it and checking that it
+// greets or answers like a ready server of its kind would:
+//
+//   - SSH: the server sends its SSH-2.0 version banner
+//   - SMTP: the server greets with 220
+//   - Redis: PING is answered with +PONG, or with NOAUTH by a server that
+//     requires a password
+//   - PostgreSQL: a startup message is answered with an authentication
+//     request, or with any error other than "the database system is
+//     starting up" (57P03), as pg_isready does. An SSLRequest is sent first
+//     and TLS is used if the server offers it.
+//
+// A service that accepts the connection but answers otherwise, or closes it,
+// fails with a *NotReadyError. The RTT is the time from the start of the
+// connect until the service answered. Connect failures are reported as by
+// TCPPinger.
+type BannerPinger struct {
+	kind Kind
+	tcp  *TCPPinger
+}
+
+// NewBanner returns a Pinger checking a service of the given kind, which
+// must be SSH, SMTP, Redis or Postgres, on port
+func NewBanner(kind Kind, port int) (*BannerPinger, error) {
+	switch kind {
+	case SSH, SMTP, Redis, Postgres:
+		return &BannerPinger{kind: kind, tcp: NewTCP(port)}, nil
+	default:
+		return nil, fmt.Errorf("no banner probe for %v targets", kind)
+	}
+}
+
+// PingContext connects to the service at ip and checks its answer
+func (p *BannerPinger) PingContext(ctx context.Context, ip net.IP, opts ping.Options) (*ping.Reply, error) {
+	probeCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		probeCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	conn, _, err := p.tcp.connect(probeCtx, ip, 0)
+	if err == nil {
+		stop := context.AfterFunc(probeCtx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+		err = p.check(conn)
+		stop()
+		conn.Close()
+	}
+	rtt := time.Since(start)
+
+	var notReady *NotReadyError
+	switch {
+	case err == nil:
+		return &ping.Reply{From: ip, RTT: rtt, TTL: -1}, nil
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case probeCtx.Err() != nil:
+		return nil, &ping.TimeoutError{IP: ip, After: opts.Timeout}
+	case errors.As(err, &notReady):
+		notReady.IP, notReady.Service = ip, p.kind.String()
+		return nil, notReady
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return nil, &NotReadyError{IP: ip, Service: p.kind.String(), Reason: "connection closed"}
+	default:
+		var refused *RefusedError
+		var connectErr *ConnectError
+		if errors.As(err, &refused) || errors.As(err, &connectErr) {
+			return nil, err
+		}
+		return nil, &NotReadyError{IP: ip, Service: p.kind.String(), Reason: err.Error()}
+	}
+}
+
+// check talks to the service on conn
+func (p *BannerPinger) check(conn net.Conn) error {
+	switch p.kind {
+	case SSH:
+		return checkSSH(conn)
+	case SMTP:
+		return checkSMTP(conn)
+	case Redis:
+		return checkRedis(conn)
+	default:
+		return checkPostgres(conn)
+	}
+}
+
+// notReady returns a *NotReadyError for an unexpected answer
+func notReady(format string, args ...interface{}) error {
+	return &NotReadyError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// readLine reads a line without its line ending
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", notReady("line longer than %d bytes", maxLine)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// checkSSH reads the version banner. Servers may send other lines first.
+func checkSSH(conn net.Conn) error {
+	r := bufio.NewReaderSize(conn, maxLine)
+	for i := 0; i < 10; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "SSH-") {
+			return nil
+		}
+	}
+	return notReady("no SSH version banner")
+}
+
+// checkSMTP reads the greeting and says goodbye
+func checkSMTP(conn net.Conn) error {
+	line, err := readLine(bufio.NewReaderSize(conn, maxLine))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "220") {
+		return notReady("greeting %q", line)
+	}
+	fmt.Fprintf(conn, "QUIT\r\n")
+	return nil
+}
+
+// checkRedis sends PING and reads the answer
+func checkRedis(conn net.Conn) error {
+	if _, err := fmt.Fprintf(conn, "PING\r\n"); err != nil {
+		return err
+	}
+	line, err := readLine(bufio.NewReaderSize(conn, maxLine))
+	if err != nil {
+		return err
+	}
+	if line != "+PONG" && !strings.HasPrefix(line, "-NOAUTH") {
+		return notReady("answered PING with %q", line)
+	}
+	return nil
+}
+
+// PostgreSQL protocol constants
+const (
+	pgSSLRequest      = 80877103
+	pgProtocolVersion = 3 << 16
+	pgCannotConnect   = "57P03"
+)
+
+// checkPostgres asks for TLS, then sends a startup message and reads the
+// first message of the answer
+func checkPostgres(conn net.Conn) error {
+	var req [8]byte
+	binary.BigEndian.PutUint32(req[0:4], 8)
+	binary.BigEndian.PutUint32(req[4:8], pgSSLRequest)
+	if _, err := conn.Write(req[:]); err != nil {
+		return err
+	}
+	var answer [1]byte
+	if _, err := io.ReadFull(conn, answer[:]); err != nil {
+		return err
+	}
+	switch answer[0] {
+	case 'S':
+		// Only whether the server answers matters, not who it is
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			return notReady("TLS handshake failed: %v", err)
+		}
+		conn = tlsConn
+	case 'N':
+	default:
+		return notReady("answered SSLRequest with %q", answer[0])
+	}
+
+	var startup bytes.Buffer
+	binary.Write(&startup, binary.BigEndian, uint32(0))
+	binary.Write(&startup, binary.BigEndian, uint32(pgProtocolVersion))
+	startup.WriteString("user\x00muod\x00database\x00postgres\x00\x00")
+	msg := startup.Bytes()
+	binary.BigEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	var header [5]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	switch header[0] {
+	case 'R':
+		// An authentication request: the server accepts connections
+		return nil
+	case 'E':
+		length := binary.BigEndian.Uint32(header[1:5])
+		if length < 4 || length > 8192 {
+			return notReady("error message of %d bytes", length)
+		}
+		body := make([]byte, length-4)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return err
+		}
+		code, message := pgError(body)
+		if code == pgCannotConnect {
+			return notReady("%s", message)
+		}
+		// Errors such as a failed authentication come from a server that
+		// is up
+		return nil
+	default:
+		return notReady("answered the startup message with %q", header[0])
+	}
+}
+
+// pgError returns the SQLSTATE code and message of an ErrorResponse body
+func pgError(body []byte) (code, message string) {
+	for len(body) > 1 {
+		field := body[0]
+		value, rest, ok := bytes.Cut(body[1:], []byte{0})
+		if !ok {
+			break
+		}
+		switch field {
+		case 'C':
+			code = string(value)
+		case 'M':
+			message = string(value)
+		}
+		body = rest
+	}
+	return code, message
+}
+
+// Ping checks the service at ip and returns how long it took to answer
+func (p *BannerPinger) Ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	reply, err := p.PingContext(context.Background(), ip, ping.Options{Timeout: timeout})
+	if err != nil {
+		return 0, err
+	}
+	return reply.RTT, nil
+}
+
+// PingMany checks the services at all of the addresses concurrently
+func (p *BannerPinger) PingMany(ips []net.IP, timeout time.Duration) []ping.Result {
+	return ping.PingAll(context.Background(), p, ips, ping.Options{Timeout: timeout})
+}
+
+// Close does nothing; connections are closed after every probe
+func (p *BannerPinger) Close() error {
+	return nil
+}
@@ -0,0 +1,131 @@
+package probe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// serveOnce accepts connections and hands each to handle
+func serveOnce(t *testing.T, handle func(net.Conn)) int {
+	t.Helper()
+	ln, port := listenLocal(t)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return port
+}
+
+// greet sends lines as soon as a client connects
+func greet(lines string) func(net.Conn) {
+	return func(conn net.Conn) {
+		io.WriteString(conn, lines)
+		// Wait for the client to hang up
+		io.Copy(io.Discard, conn)
+	}
+}
+
+// redisServer answers one command with answer
+func redisServer(answer string) func(net.Conn) {
+	return func(conn net.Conn) {
+		if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil && line == "PING\r\n" {
+			io.WriteString(conn, answer)
+		}
+	}
+}
+
+// postgresServer declines TLS and answers the startup message with msg
+func postgresServer(msg []byte) func(net.Conn) {
+	return func(conn net.Conn) {
+		var req [8]byte
+		if _, err := io.ReadFull(conn, req[:]); err != nil || binary.BigEndian.Uint32(req[4:]) != pgSSLRequest {
+			return
+		}
+		conn.Write([]byte{'N'})
+		var length [4]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, binary.BigEndian.Uint32(length[:])-4)); err != nil {
+			return
+		}
+		conn.Write(msg)
+	}
+}
+
+// pgMessage builds a backend message
+func pgMessage(typ byte, body string) []byte {
+	msg := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+// TestBanner tests the greeting checks of each service
+func TestBanner(t *testing.T) {
+	tests := []struct {
+		name  string
+		kind  Kind
+		serve func(net.Conn)
+		ready bool
+	}{
+		{"ssh banner", SSH, greet("SSH-2.0-OpenSSH_9.6\r\n"), true},
+		{"ssh banner after a notice", SSH, greet("Authorized users only\r\nSSH-2.0-dropbear\r\n"), true},
+		{"ssh closed", SSH, func(net.Conn) {}, false},
+		{"ssh wrong protocol", SSH, func(conn net.Conn) { io.WriteString(conn, "220 mail.example ESMTP\r\n") }, false},
+		{"smtp greeting", SMTP, greet("220 mail.example ESMTP Postfix\r\n"), true},
+		{"smtp unavailable", SMTP, greet("554 mail.example no service\r\n"), false},
+		{"redis pong", Redis, redisServer("+PONG\r\n"), true},
+		{"redis with a password", Redis, redisServer("-NOAUTH Authentication required.\r\n"), true},
+		{"redis loading", Redis, redisServer("-LOADING Redis is loading the dataset in memory\r\n"), false},
+		{"postgres auth request", Postgres, postgresServer(pgMessage('R', "\x00\x00\x00\x0a")), true},
+		{"postgres no such user", Postgres, postgresServer(pgMessage('E', "SFATAL\x00C28000\x00Mrole \"muod\" does not exist\x00\x00")), true},
+		{"postgres starting up", Postgres, postgresServer(pgMessage('E', "SFATAL\x00C57P03\x00Mthe database system is starting up\x00\x00")), false},
+	}
+	for _, tt := range tests {
+		port := serveOnce(t, tt.serve)
+		p, err := NewBanner(tt.kind, port)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		rtt, err := p.Ping(net.ParseIP("127.0.0.1"), 2*time.Second)
+		var notReady *NotReadyError
+		switch {
+		case tt.ready && err != nil:
+			t.Errorf("%s: expected ready, got %v", tt.name, err)
+		case tt.ready && rtt <= 0:
+			t.Errorf("%s: expected a positive RTT, got %v", tt.name, rtt)
+		case !tt.ready && !errors.As(err, &notReady):
+			t.Errorf("%s: expected NotReadyError, got %v", tt.name, err)
+		case !tt.ready && notReady.Service != tt.kind.String():
+			t.Errorf("%s: expected the error to name %v, got %q", tt.name, tt.kind, notReady.Service)
+		}
+	}
+}
+
+// TestBannerTimeout tests a service that accepts connections but never
+// greets
+func TestBannerTimeout(t *testing.T) {
+	port := serveOnce(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+	p, _ := NewBanner(SSH, port)
+	_, err := p.Ping(net.ParseIP("127.0.0.1"), 100*time.Millisecond)
+	var timeout *ping.TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Errorf("Expected TimeoutError, got %v", err)
+	}
+}
@@ -0,0 +1,341 @@
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTypes are the query types a DNS probe can ask for
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+// rcodeNames are the names of response codes as dig prints them
+var rcodeNames = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+// rcodeName returns the name of a response code
+func rcodeName(rcode dnsmessage.RCode) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(int(rcode))
+}
+
+// DNSPinger probes a DNS server by sending it a query. The query goes over
+// UDP and is repeated over TCP if the answer was truncated. The RTT is the
+// time until the complete answer arrived.
+//
+// An answer with a response code other than NOERROR fails with an
+// *RcodeError, and one without the expected record with an *AnswerError.
+// A server that does not listen on the port fails with a *RefusedError
+// where the operating system reports the ICMP port unreachable.
+type DNSPinger struct {
+	port   int
+	name   dnsmessage.Name
+	qtype  dnsmessage.Type
+	expect string // Expected answer, empty to accept any
+	tcp    *TCPPinger
+}
+
+// NewDNS returns a Pinger sending the query described by a
+// dns://server[:port]/name?type=A&expect=192.0.2.1 URL. The type defaults
+// to A. With expect, one of the answer records of the type must have that
+// value: an address, a host name, or the text of a TXT record.
+func NewDNS(rawURL string) (*DNSPinger, error) {
+	t, err := ParseTarget(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if t.Kind != DNS {
+		return nil, fmt.Errorf("not a dns URL: %q", rawURL)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	p := &DNSPinger{port: t.Port, tcp: NewTCP(t.Port)}
+	if p.name, p.qtype, p.expect, err = parseDNSQuery(u); err != nil {
+		return nil, fmt.Errorf("invalid target %q: %v", rawURL, err)
+	}
+	return p, nil
+}
+
+// parseDNSQuery returns the query a dns:// URL describes
+func parseDNSQuery(u *url.URL) (dnsmessage.Name, dnsmessage.Type, string, error) {
+	var name dnsmessage.Name
+	host := strings.TrimPrefix(u.Path, "/")
+	if host == "" {
+		return name, 0, "", fmt.Errorf("missing name to query")
+	}
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return name, 0, "", fmt.Errorf("invalid name %q: %v", host, err)
+	}
+
+	q := u.Query()
+	qtype := dnsmessage.TypeA
+	if s := q.Get("type"); s != "" {
+		var ok bool
+		if qtype, ok = dnsTypes[strings.ToUpper(s)]; !ok {
+			return name, 0, "", fmt.Errorf("unsupported query type %q", s)
+		}
+	}
+	expect := q.Get("expect")
+	if expect != "" && (qtype == dnsmessage.TypeA || qtype == dnsmessage.TypeAAAA) && net.ParseIP(expect) == nil {
+		return name, 0, "", fmt.Errorf("expected answer %q is not an address", expect)
+	}
+	return name, qtype, expect, nil
+}
+
+// Query returns the name and type of the query, as dig would print them
+func (p *DNSPinger) Query() (string, string) {
+	for name, t := range dnsTypes {
+		if t == p.qtype {
+			return p.name.String(), name
+		}
+	}
+	return p.name.String(), p.qtype.String()
+}
+
+// PingContext sends the query to the server at ip and checks the answer
+func (p *DNSPinger) PingContext(ctx context.Context, ip net.IP, opts ping.Options) (*ping.Reply, error) {
+	queryCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		queryCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	query, err := p.buildQuery(id)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	answer, err := p.exchangeUDP(queryCtx, ip, id, query)
+	if err == nil && answer.Header.Truncated {
+		answer, err = p.exchangeTCP(queryCtx, ip, id, query)
+	}
+	rtt := time.Since(start)
+	if err != nil {
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case queryCtx.Err() != nil:
+			return nil, &ping.TimeoutError{IP: ip, After: opts.Timeout}
+		default:
+			// The port unreachable of a UDP query only shows on reading
+			var refused *RefusedError
+			if errors.As(err, &refused) && refused.RTT == 0 {
+				refused.RTT = rtt
+			}
+			return nil, err
+		}
+	}
+
+	reply := &ping.Reply{From: ip, RTT: rtt, TTL: -1, Size: answer.size}
+	if answer.Header.RCode != dnsmessage.RCodeSuccess {
+		return reply, &RcodeError{Server: ip, Name: p.name.String(), RCode: rcodeName(answer.Header.RCode)}
+	}
+	if p.expect != "" {
+		got := p.answers(answer.Message)
+		for _, value := range got {
+			if sameAnswer(value, p.expect, p.qtype) {
+				return reply, nil
+			}
+		}
+		_, qtype := p.Query()
+		return reply, &AnswerError{Server: ip, Name: p.name.String(), Type: qtype, Want: p.expect, Got: got}
+	}
+	return reply, nil
+}
+
+// dnsAnswer is a parsed response and its size on the wire
+type dnsAnswer struct {
+	dnsmessage.Message
+	size int
+}
+
+// buildQuery returns the wire format of a recursive query with the given ID
+func (p *DNSPinger) buildQuery(id uint16) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: p.name, Type: p.qtype, Class: dnsmessage.ClassINET}},
+	}
+	return msg.Pack()
+}
+
+// matches reports whether a response answers our query
+func (p *DNSPinger) matches(msg *dnsmessage.Message, id uint16) bool {
+	if !msg.Header.Response || msg.Header.ID != id || len(msg.Questions) != 1 {
+		return false
+	}
+	q := msg.Questions[0]
+	return q.Type == p.qtype && strings.EqualFold(q.Name.String(), p.name.String())
+}
+
+// exchangeUDP sends the query over UDP and waits for the matching
+// response, ignoring others, until ctx is done
+func (p *DNSPinger) exchangeUDP(ctx context.Context, ip net.IP, id uint16, query []byte) (*dnsAnswer, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(ip.String(), strconv.Itoa(p.port)))
+	if err != nil {
+		return nil, &QueryError{Server: ip, Err: err}
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, p.udpError(ip, err)
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, p.udpError(ip, err)
+		}
+		var answer dnsAnswer
+		if err := answer.Unpack(buf[:n]); err != nil || !p.matches(&answer.Message, id) {
+			continue
+		}
+		answer.size = n
+		return &answer, nil
+	}
+}
+
+// udpError converts the error of a UDP exchange
+func (p *DNSPinger) udpError(ip net.IP, err error) error {
+	if isRefused(err) {
+		return &RefusedError{IP: ip, Port: p.port}
+	}
+	return &QueryError{Server: ip, Err: err}
+}
+
+// exchangeTCP sends the query over TCP and reads the response
+func (p *DNSPinger) exchangeTCP(ctx context.Context, ip net.IP, id uint16, query []byte) (*dnsAnswer, error) {
+	conn, _, err := p.tcp.connect(ctx, ip, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	// Over TCP every message is preceded by its length
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, &QueryError{Server: ip, Err: err}
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, &QueryError{Server: ip, Err: err}
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, &QueryError{Server: ip, Err: err}
+	}
+	var answer dnsAnswer
+	if err := answer.Unpack(buf); err != nil {
+		return nil, &QueryError{Server: ip, Err: err}
+	}
+	if !p.matches(&answer.Message, id) {
+		return nil, &QueryError{Server: ip, Err: errors.New("response does not match the query")}
+	}
+	answer.size = len(buf)
+	return &answer, nil
+}
+
+// answers returns the values of the answer records of the query type
+func (p *DNSPinger) answers(msg dnsmessage.Message) []string {
+	var values []string
+	for _, rr := range msg.Answers {
+		if rr.Header.Type != p.qtype {
+			continue
+		}
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			values = append(values, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			values = append(values, net.IP(body.AAAA[:]).String())
+		case *dnsmessage.CNAMEResource:
+			values = append(values, body.CNAME.String())
+		case *dnsmessage.MXResource:
+			values = append(values, body.MX.String())
+		case *dnsmessage.NSResource:
+			values = append(values, body.NS.String())
+		case *dnsmessage.PTRResource:
+			values = append(values, body.PTR.String())
+		case *dnsmessage.SOAResource:
+			values = append(values, body.NS.String())
+		case *dnsmessage.SRVResource:
+			values = append(values, body.Target.String())
+		case *dnsmessage.TXTResource:
+			values = append(values, strings.Join(body.TXT, ""))
+		}
+	}
+	return values
+}
+
+// sameAnswer reports whether an answer has the expected value. Addresses
+// are compared as addresses and names without case or the trailing dot.
+func sameAnswer(got, want string, qtype dnsmessage.Type) bool {
+	switch qtype {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		return net.ParseIP(got).Equal(net.ParseIP(want))
+	case dnsmessage.TypeTXT:
+		return got == want
+	default:
+		return strings.EqualFold(strings.TrimSuffix(got, "."), strings.TrimSuffix(want, "."))
+	}
+}
+
+// Ping sends the query to the server at ip and returns the query latency
+func (p *DNSPinger) Ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	reply, err := p.PingContext(context.Background(), ip, ping.Options{Timeout: timeout})
+	if err != nil {
+		return 0, err
+	}
+	return reply.RTT, nil
+}
+
+// PingMany queries all of the servers concurrently
+func (p *DNSPinger) PingMany(ips []net.IP, timeout time.Duration) []ping.Result {
+	return ping.PingAll(context.Background(), p, ips, ping.Options{Timeout: timeout})
+}
+
+// Close does nothing; sockets are closed after every probe
+func (p *DNSPinger) Close() error {
+	return nil
+}
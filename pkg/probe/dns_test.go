@@ -0,0 +1,198 @@
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsServer is a minimal authoritative server for tests. It knows
+// web1.example. (A 192.0.2.10) and big.example. (a TXT record it only sends
+// in full over TCP), and answers NXDOMAIN for anything else, except that it
+// never answers for silent.example.
+type dnsServer struct {
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+// newDNSServer starts a server on a free localhost port, the same for UDP
+// and TCP
+func newDNSServer(t *testing.T) *dnsServer {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			continue
+		}
+		s := &dnsServer{udp: udp, tcp: tcp}
+		go s.serveUDP()
+		go s.serveTCP()
+		return s
+	}
+	t.Fatalf("No port free for both UDP and TCP")
+	return nil
+}
+
+func (s *dnsServer) port() int {
+	return s.udp.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (s *dnsServer) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+// answer builds the response to a query
+func (s *dnsServer) answer(query []byte, udp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+	msg.Header.Response = true
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}
+	name := strings.ToLower(q.Name.String())
+	switch {
+	case name == "web1.example." && q.Type == dnsmessage.TypeA:
+		msg.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}}}}
+	case name == "web1.example.":
+		// The name exists without records of the type
+	case name == "big.example." && q.Type == dnsmessage.TypeTXT && udp:
+		msg.Header.Truncated = true
+	case name == "big.example." && q.Type == dnsmessage.TypeTXT:
+		msg.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.TXTResource{TXT: []string{strings.Repeat("x", 200), "y"}}}}
+	case name == "silent.example.":
+		return nil
+	default:
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	}
+	packed, _ := msg.Pack()
+	return packed
+}
+
+func (s *dnsServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(buf[:n], true); resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *dnsServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			resp := s.answer(query, false)
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+		}()
+	}
+}
+
+// queryServer probes srv with the query in path
+func queryServer(t *testing.T, port int, path string, timeout time.Duration) (*ping.Reply, error) {
+	t.Helper()
+	p, err := NewDNS(fmt.Sprintf("dns://127.0.0.1:%d/%s", port, path))
+	if err != nil {
+		t.Fatalf("Failed to create DNS probe: %v", err)
+	}
+	return p.PingContext(context.Background(), net.ParseIP("127.0.0.1"), ping.Options{Timeout: timeout})
+}
+
+// TestDNS tests response code and answer checks and the TCP fallback
+func TestDNS(t *testing.T) {
+	srv := newDNSServer(t)
+	defer srv.Close()
+
+	tests := []struct {
+		path string
+		want string // Expected error type, empty for success
+	}{
+		{"web1.example", ""},
+		{"WEB1.example.?type=a&expect=192.0.2.10", ""},
+		{"web1.example?expect=192.0.2.11", "answer"},
+		{"nothere.example", "rcode"},
+		{"web1.example?type=AAAA", ""},
+		{"web1.example?type=AAAA&expect=2001:db8::10", "answer"},
+		{"big.example?type=TXT&expect=" + strings.Repeat("x", 200) + "y", ""},
+	}
+	for _, tt := range tests {
+		reply, err := queryServer(t, srv.port(), tt.path, time.Second)
+		var rcodeErr *RcodeError
+		var answerErr *AnswerError
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: expected success, got %v", tt.path, err)
+		case tt.want == "rcode" && (!errors.As(err, &rcodeErr) || rcodeErr.RCode != "NXDOMAIN"):
+			t.Errorf("%s: expected NXDOMAIN, got %v", tt.path, err)
+		case tt.want == "answer" && !errors.As(err, &answerErr):
+			t.Errorf("%s: expected AnswerError, got %v", tt.path, err)
+		}
+		if reply == nil || reply.RTT <= 0 || reply.Size == 0 {
+			t.Errorf("%s: expected a reply with a positive RTT and size, got %+v", tt.path, reply)
+		}
+	}
+}
+
+// TestDNSFailures tests servers that do not answer or do not listen
+func TestDNSFailures(t *testing.T) {
+	srv := newDNSServer(t)
+	defer srv.Close()
+
+	_, err := queryServer(t, srv.port(), "silent.example", 100*time.Millisecond)
+	var timeout *ping.TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Errorf("Expected TimeoutError from a silent server, got %v", err)
+	}
+
+	port := srv.port()
+	srv.Close()
+	_, err = queryServer(t, port, "web1.example", time.Second)
+	var refused *RefusedError
+	if !errors.As(err, &refused) && !errors.As(err, &timeout) {
+		t.Errorf("Expected RefusedError or TimeoutError from a closed port, got %v", err)
+	}
+}
+
+// TestParseDNSTarget tests the query in dns:// targets
+func TestParseDNSTarget(t *testing.T) {
+	target, err := ParseTarget("dns://ns1/example.com?type=MX")
+	if err != nil || target.Kind != DNS || target.Host != "ns1" || target.Port != 53 {
+		t.Errorf("Expected a DNS target for ns1 port 53, got %+v, %v", target, err)
+	}
+	for _, in := range []string{"dns://ns1", "dns://ns1/", "dns://ns1/example.com?type=BOGUS", "dns://ns1/example.com?expect=web1"} {
+		if _, err := ParseTarget(in); err == nil {
+			t.Errorf("ParseTarget(%q) succeeded, expected an error", in)
+		}
+	}
+}
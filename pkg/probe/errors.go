@@ -0,0 +1,164 @@
+package probe
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RefusedError is returned when the target host answered a TCP connect
+// with a reset: the host is up but nothing listens on the port.
+type RefusedError struct {
+	IP   net.IP        // The address that was probed
+	Port int           // The port that was probed
+	RTT  time.Duration // Time until the reset arrived
+}
+
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("connection to %s refused after %v", net.JoinHostPort(e.IP.String(), strconv.Itoa(e.Port)), e.RTT)
+}
+
+// ConnectError is returned when a TCP connect failed for a reason other
+// than a reset or a timeout, for example because there is no route to the
+// target.
+type ConnectError struct {
+	IP   net.IP // The address that was probed
+	Port int    // The port that was probed
+	Err  error  // The underlying error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("failed to connect to %s: %v", net.JoinHostPort(e.IP.String(), strconv.Itoa(e.Port)), e.Err)
+}
+
+func (e *ConnectError) Unwrap() error { return e.Err }
+
+// StatusError is returned when a web server answered with a status code
+// the probe does not accept
+type StatusError struct {
+	URL    string // The URL that was requested
+	Status int    // The status code of the response
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s answered with status %d %s", e.URL, e.Status, http.StatusText(e.Status))
+}
+
+// BodyError is returned when a response body did not contain the expected
+// text or match the expected regular expression
+type BodyError struct {
+	URL  string // The URL that was requested
+	Want string // The expected substring or regular expression
+}
+
+func (e *BodyError) Error() string {
+	return fmt.Sprintf("response body of %s does not match %q", e.URL, e.Want)
+}
+
+// RequestError is returned when a request failed after connecting, for
+// example because the TLS handshake failed or the response was malformed
+type RequestError struct {
+	URL string // The URL that was requested
+	Err error  // The underlying error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("request for %s failed: %v", e.URL, e.Err)
+}
+
+func (e *RequestError) Unwrap() error { return e.Err }
+
+// RcodeError is returned when a DNS server answered a query with a
+// response code other than NOERROR
+type RcodeError struct {
+	Server net.IP // The server that was queried
+	Name   string // The name that was queried
+	RCode  string // The response code as dig prints it, e.g. NXDOMAIN
+}
+
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("%v answered the query for %s with %s", e.Server, e.Name, e.RCode)
+}
+
+// AnswerError is returned when a DNS answer did not contain the expected
+// record
+type AnswerError struct {
+	Server net.IP   // The server that was queried
+	Name   string   // The name that was queried
+	Type   string   // The query type, e.g. AAAA
+	Want   string   // The expected value
+	Got    []string // The values of the records of the type in the answer
+}
+
+func (e *AnswerError) Error() string {
+	return fmt.Sprintf("%v answered the %s query for %s with %v, expected %s", e.Server, e.Type, e.Name, e.Got, e.Want)
+}
+
+// QueryError is returned when a DNS query could not be sent or its
+// response not read, for reasons other than a timeout
+type QueryError struct {
+	Server net.IP // The server that was queried
+	Err    error  // The underlying error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("DNS query to %v failed: %v", e.Server, e.Err)
+}
+
+func (e *QueryError) Unwrap() error { return e.Err }
+
+// CertificateError is returned when a TLS server's certificate chain does
+// not verify or does not name the server
+type CertificateError struct {
+	Server  net.IP // The server that was probed
+	Problem string // What is wrong: "untrusted", "name mismatch", "expired" or "invalid"
+	Err     error  // The underlying error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("certificate of %v %s: %v", e.Server, e.Problem, e.Err)
+}
+
+func (e *CertificateError) Unwrap() error { return e.Err }
+
+// ExpiringError is returned together with the reply when a TLS server's
+// certificate is valid but expires soon
+type ExpiringError struct {
+	Server   net.IP        // The server that was probed
+	Subject  string        // The common name of the leaf certificate
+	NotAfter time.Time     // When the leaf certificate expires
+	Left     time.Duration // How long until then
+}
+
+func (e *ExpiringError) Error() string {
+	return fmt.Sprintf("certificate %q of %v expires on %s, in %.0f days", e.Subject, e.Server,
+		e.NotAfter.UTC().Format("2006-01-02"), e.Left.Hours()/24)
+}
+
+// HandshakeError is returned when a TLS handshake failed for a reason other
+// than the server's certificate, for example because the server does not
+// speak TLS or supports no common protocol version
+type HandshakeError struct {
+	Server net.IP // The server that was probed
+	Err    error  // The underlying error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("TLS handshake with %v failed: %v", e.Server, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+// NotReadyError is returned when a service accepted the connection but did
+// not answer the way a ready server of its kind would
+type NotReadyError struct {
+	IP      net.IP // The address that was probed
+	Service string // The kind of service, e.g. ssh
+	Reason  string // What the service did instead
+}
+
+func (e *NotReadyError) Error() string {
+	return fmt.Sprintf("%s service at %v not ready: %s", e.Service, e.IP, e.Reason)
+}
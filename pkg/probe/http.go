@@ -0,0 +1,195 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// maxBody is how much of a response body is read for matching
+const maxBody = 1 << 20
+
+// HTTPOptions controls an HTTP probe
+type HTTPOptions struct {
+	// Method is the request method. Empty means GET.
+	Method string
+
+	// Status lists the accepted status codes. Empty accepts 200-399;
+	// redirects are not followed.
+	Status []int
+
+	// Body is a substring the response body must contain, if not empty
+	Body string
+
+	// BodyRegexp must match the response body, if not nil
+	BodyRegexp *regexp.Regexp
+
+	// Timeout caps how long a probe may take, if shorter than the timeout
+	// of the ping.Options it is made with. Zero means no cap.
+	Timeout time.Duration
+
+	// Insecure skips verification of the server's certificate chain and
+	// name
+	Insecure bool
+}
+
+// HTTPPinger probes a web server by requesting a URL from it. The probe
+// connects to the address it is given rather than resolving the URL's
+// host, which is still sent as the Host header and TLS server name. The
+// RTT covers the whole request: connect, TLS handshake, response and body.
+//
+// A response with an unexpected status fails with a *StatusError and a
+// body that does not match with a *BodyError. Connect failures are
+// reported as by TCPPinger, and other failures, such as TLS errors, as a
+// *RequestError.
+type HTTPPinger struct {
+	url    *url.URL
+	opts   HTTPOptions
+	tcp    *TCPPinger
+	client *http.Client
+}
+
+// ipKey is the context key of the address an HTTP probe connects to
+type ipKey struct{}
+
+// NewHTTP returns a Pinger requesting rawURL with the given options
+func NewHTTP(rawURL string, opts HTTPOptions) (*HTTPPinger, error) {
+	t, err := ParseTarget(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if t.Kind != HTTP {
+		return nil, fmt.Errorf("not an http or https URL: %q", rawURL)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Method == "" {
+		opts.Method = http.MethodGet
+	}
+
+	p := &HTTPPinger{url: u, opts: opts, tcp: NewTCP(t.Port)}
+	transport := &http.Transport{
+		// Every probe makes a new connection, so a server that stopped
+		// accepting them is noticed
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, _, err := p.tcp.connect(ctx, ctx.Value(ipKey{}).(net.IP), 0)
+			return conn, err
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: opts.Insecure},
+	}
+	p.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return p, nil
+}
+
+// URL returns the URL the Pinger requests
+func (p *HTTPPinger) URL() string {
+	return p.url.String()
+}
+
+// PingContext requests the URL from ip and checks the response
+func (p *HTTPPinger) PingContext(ctx context.Context, ip net.IP, opts ping.Options) (*ping.Reply, error) {
+	timeout := opts.Timeout
+	if p.opts.Timeout > 0 && (timeout == 0 || p.opts.Timeout < timeout) {
+		timeout = p.opts.Timeout
+	}
+	reqCtx := context.WithValue(ctx, ipKey{}, ip)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(reqCtx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(reqCtx, p.opts.Method, p.url.String(), nil)
+	if err != nil {
+		return nil, &RequestError{URL: p.url.String(), Err: err}
+	}
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(io.LimitReader(resp.Body, maxBody))
+		resp.Body.Close()
+	}
+	rtt := time.Since(start)
+
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case reqCtx.Err() != nil:
+		return nil, &ping.TimeoutError{IP: ip, After: timeout}
+	default:
+		// Connect failures are reported as by TCPPinger
+		var refused *RefusedError
+		var connectErr *ConnectError
+		if errors.As(err, &refused) {
+			return nil, refused
+		}
+		if errors.As(err, &connectErr) {
+			return nil, connectErr
+		}
+		return nil, &RequestError{URL: p.url.String(), Err: err}
+	}
+
+	reply := &ping.Reply{From: ip, RTT: rtt, TTL: -1, Size: len(body)}
+	if !p.statusOK(resp.StatusCode) {
+		return reply, &StatusError{URL: p.url.String(), Status: resp.StatusCode}
+	}
+	if p.opts.Body != "" && !bytes.Contains(body, []byte(p.opts.Body)) {
+		return reply, &BodyError{URL: p.url.String(), Want: p.opts.Body}
+	}
+	if p.opts.BodyRegexp != nil && !p.opts.BodyRegexp.Match(body) {
+		return reply, &BodyError{URL: p.url.String(), Want: p.opts.BodyRegexp.String()}
+	}
+	return reply, nil
+}
+
+// statusOK reports whether a response status is accepted
+func (p *HTTPPinger) statusOK(status int) bool {
+	if len(p.opts.Status) == 0 {
+		return status >= 200 && status < 400
+	}
+	for _, s := range p.opts.Status {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Ping requests the URL from ip and returns the request latency
+func (p *HTTPPinger) Ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	reply, err := p.PingContext(context.Background(), ip, ping.Options{Timeout: timeout})
+	if err != nil {
+		return 0, err
+	}
+	return reply.RTT, nil
+}
+
+// PingMany requests the URL from all of the addresses concurrently
+func (p *HTTPPinger) PingMany(ips []net.IP, timeout time.Duration) []ping.Result {
+	return ping.PingAll(context.Background(), p, ips, ping.Options{Timeout: timeout})
+}
+
+// Close does nothing; connections are closed after every probe
+func (p *HTTPPinger) Close() error {
+	return nil
+}
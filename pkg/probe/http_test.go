@@ -0,0 +1,145 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// newHealthServer starts a server answering /healthz with the given status
+// and body, and redirecting / to /login
+func newHealthServer(t *testing.T, tls bool, status int, body string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+	})
+	srv := httptest.NewUnstartedServer(mux)
+	// Probes that reject the test certificate make the server log errors
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	if tls {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	return srv
+}
+
+// probeURL probes path on srv with opts, connecting to its address while
+// naming it localhost in the URL
+func probeURL(t *testing.T, srv *httptest.Server, path string, opts HTTPOptions) (*ping.Reply, error) {
+	t.Helper()
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+	scheme := "http"
+	if srv.TLS != nil {
+		scheme = "https"
+	}
+	p, err := NewHTTP(fmt.Sprintf("%s://localhost:%d%s", scheme, addr.Port, path), opts)
+	if err != nil {
+		t.Fatalf("Failed to create HTTP probe: %v", err)
+	}
+	return p.PingContext(context.Background(), addr.IP, ping.Options{Timeout: 2 * time.Second})
+}
+
+// TestHTTP tests the status and body checks
+func TestHTTP(t *testing.T) {
+	up := newHealthServer(t, false, http.StatusOK, `{"status": "up"}`)
+	defer up.Close()
+	down := newHealthServer(t, false, http.StatusServiceUnavailable, `{"status": "down"}`)
+	defer down.Close()
+
+	tests := []struct {
+		name   string
+		srv    *httptest.Server
+		path   string
+		opts   HTTPOptions
+		status int // Expected status in a *StatusError, -1 for a *BodyError, 0 for success
+	}{
+		{"healthy", up, "/healthz", HTTPOptions{}, 0},
+		{"unhealthy", down, "/healthz", HTTPOptions{}, http.StatusServiceUnavailable},
+		{"accepted 503", down, "/healthz", HTTPOptions{Status: []int{503}}, 0},
+		{"unexpected 200", up, "/healthz", HTTPOptions{Status: []int{204}}, http.StatusOK},
+		{"redirect not followed", up, "/", HTTPOptions{}, 0},
+		{"redirect rejected", up, "/", HTTPOptions{Status: []int{200}}, http.StatusFound},
+		{"HEAD", up, "/healthz", HTTPOptions{Method: http.MethodHead}, 0},
+		{"body substring", up, "/healthz", HTTPOptions{Body: `"up"`}, 0},
+		{"body substring missing", down, "/healthz", HTTPOptions{Status: []int{503}, Body: `"up"`}, -1},
+		{"body regexp", up, "/healthz", HTTPOptions{BodyRegexp: regexp.MustCompile(`"status":\s*"up"`)}, 0},
+		{"body regexp mismatch", up, "/healthz", HTTPOptions{BodyRegexp: regexp.MustCompile(`^ok$`)}, -1},
+	}
+	for _, tt := range tests {
+		reply, err := probeURL(t, tt.srv, tt.path, tt.opts)
+		var statusErr *StatusError
+		var bodyErr *BodyError
+		switch {
+		case tt.status == 0 && err != nil:
+			t.Errorf("%s: expected success, got %v", tt.name, err)
+		case tt.status == -1 && !errors.As(err, &bodyErr):
+			t.Errorf("%s: expected BodyError, got %v", tt.name, err)
+		case tt.status > 0 && (!errors.As(err, &statusErr) || statusErr.Status != tt.status):
+			t.Errorf("%s: expected status %d error, got %v", tt.name, tt.status, err)
+		}
+		if reply == nil || reply.RTT <= 0 {
+			t.Errorf("%s: expected a reply with a positive RTT, got %+v", tt.name, reply)
+		}
+	}
+}
+
+// TestHTTPS tests certificate verification and skipping it
+func TestHTTPS(t *testing.T) {
+	srv := newHealthServer(t, true, http.StatusOK, "ok")
+	defer srv.Close()
+
+	_, err := probeURL(t, srv, "/healthz", HTTPOptions{})
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Expected a certificate error from the test server, got %v", err)
+	}
+	if _, err := probeURL(t, srv, "/healthz", HTTPOptions{Insecure: true, Body: "ok"}); err != nil {
+		t.Errorf("Expected success without verification, got %v", err)
+	}
+}
+
+// TestHTTPTimeout tests the per-probe timeout and connect failures
+func TestHTTPTimeout(t *testing.T) {
+	srv := newHealthServer(t, false, http.StatusOK, "ok")
+	defer srv.Close()
+
+	start := time.Now()
+	_, err := probeURL(t, srv, "/slow", HTTPOptions{Timeout: 100 * time.Millisecond})
+	var timeout *ping.TimeoutError
+	if !errors.As(err, &timeout) || timeout.After != 100*time.Millisecond {
+		t.Errorf("Expected a 100ms TimeoutError, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the probe to give up after 100ms, took %v", elapsed)
+	}
+
+	srv.Close()
+	_, err = probeURL(t, srv, "/healthz", HTTPOptions{})
+	var refused *RefusedError
+	if !errors.As(err, &refused) {
+		t.Errorf("Expected RefusedError once the server is closed, got %v", err)
+	}
+}
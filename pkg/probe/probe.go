@@ -0,0 +1,213 @@
+// Package probe checks services rather than hosts. Each probe implements
+// ping.Pinger for one kind of service, so it can be monitored, summarized
+// and simulated exactly like an ICMP echo.
+//
+// Targets are written as a hostname for ICMP echo, host:port for a TCP
+// connect, or as a URL naming the probe:
+//
+//	t, err := probe.ParseTarget("https://web1/healthz")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	pinger, err := probe.New(t, probe.Options{})
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	rtt, err := pinger.Ping(ip, timeout)
+package probe
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// Kind is the type of check made against a target
+type Kind int
+
+const (
+	// ICMP is an ICMP echo request, made by a ping.Pinger
+	ICMP Kind = iota
+	// TCP is a TCP connect to a port
+	TCP
+	// HTTP is an HTTP or HTTPS request
+	HTTP
+	// DNS is a DNS query
+	DNS
+	// TLS is a TLS handshake
+	TLS
+	// SSH waits for an SSH server's version banner
+	SSH
+	// SMTP waits for an SMTP server's greeting
+	SMTP
+	// Redis sends a Redis server PING
+	Redis
+	// Postgres starts a PostgreSQL session
+	Postgres
+)
+
+func (k Kind) String() string {
+	switch k {
+	case ICMP:
+		return "icmp"
+	case TCP:
+		return "tcp"
+	case HTTP:
+		return "http"
+	case DNS:
+		return "dns"
+	case TLS:
+		return "tls"
+	case SSH:
+		return "ssh"
+	case SMTP:
+		return "smtp"
+	case Redis:
+		return "redis"
+	case Postgres:
+		return "postgres"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+// Target is a parsed monitoring target
+type Target struct {
+	Raw  string // The target as written
+	Kind Kind
+	Host string // The hostname or address to resolve
+	Port int    // The port to probe, 0 for ICMP targets
+}
+
+// schemes maps the schemes of URL targets to the kind of probe
+var schemes = map[string]Kind{
+	"icmp":       ICMP,
+	"tcp":        TCP,
+	"http":       HTTP,
+	"https":      HTTP,
+	"dns":        DNS,
+	"tls":        TLS,
+	"ssh":        SSH,
+	"smtp":       SMTP,
+	"redis":      Redis,
+	"postgres":   Postgres,
+	"postgresql": Postgres,
+}
+
+// defaultPorts are the ports of URL targets that do not name one; TCP
+// targets must
+var defaultPorts = map[string]string{
+	"http":       "80",
+	"https":      "443",
+	"dns":        "53",
+	"tls":        "443",
+	"ssh":        "22",
+	"smtp":       "25",
+	"redis":      "6379",
+	"postgres":   "5432",
+	"postgresql": "5432",
+}
+
+// Options holds the settings of the probes that have any, keyed by kind
+type Options struct {
+	HTTP HTTPOptions
+	TLS  TLSOptions
+}
+
+// ParseTarget parses a target. A plain hostname or address is probed with
+// ICMP echo and host:port or [v6addr]:port with a TCP connect. URL targets
+// name their probe: tcp://host:port, http:// and https:// URLs,
+// dns://server/name?type=A, tls://host:port, and ssh://, smtp://, redis://
+// and postgres:// followed by host or host:port.
+func ParseTarget(s string) (Target, error) {
+	t := Target{Raw: s}
+	if scheme, _, ok := strings.Cut(s, "://"); ok {
+		u, err := url.Parse(s)
+		if err != nil {
+			return t, fmt.Errorf("invalid target %q: %v", s, err)
+		}
+		scheme = strings.ToLower(scheme)
+		kind, ok := schemes[scheme]
+		if !ok {
+			return t, fmt.Errorf("invalid target %q: unsupported probe %q", s, scheme)
+		}
+		t.Kind, t.Host = kind, u.Hostname()
+		if t.Host == "" {
+			return t, fmt.Errorf("invalid target %q: missing host", s)
+		}
+
+		port := u.Port()
+		switch {
+		case kind == ICMP && port != "":
+			return t, fmt.Errorf("invalid target %q: icmp targets have no port", s)
+		case kind == ICMP:
+		default:
+			if port == "" {
+				port = defaultPorts[scheme]
+			}
+			if t.Port, err = parsePort(port); err != nil {
+				return t, fmt.Errorf("invalid target %q: %v", s, err)
+			}
+		}
+		if kind == DNS {
+			if _, _, _, err := parseDNSQuery(u); err != nil {
+				return t, fmt.Errorf("invalid target %q: %v", s, err)
+			}
+		}
+		return t, nil
+	}
+
+	// A bare IPv6 address has colons too, but no brackets
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		if s == "" {
+			return t, fmt.Errorf("empty target")
+		}
+		t.Kind, t.Host = ICMP, s
+		return t, nil
+	}
+	t.Kind, t.Host = TCP, host
+	if t.Port, err = parsePort(port); err != nil {
+		return t, fmt.Errorf("invalid target %q: %v", s, err)
+	}
+	if t.Host == "" {
+		return t, fmt.Errorf("invalid target %q: missing host", s)
+	}
+	return t, nil
+}
+
+// parsePort parses a port number between 1 and 65535
+func parsePort(s string) (int, error) {
+	if s == "" {
+		return 0, fmt.Errorf("missing port")
+	}
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// New returns a Pinger making the target's check with the options for its
+// kind. ICMP targets are probed with a ping.Pinger, which is shared between
+// targets, so New does not create one.
+func New(t Target, opts Options) (ping.Pinger, error) {
+	switch t.Kind {
+	case TCP:
+		return NewTCP(t.Port), nil
+	case HTTP:
+		return NewHTTP(t.Raw, opts.HTTP)
+	case DNS:
+		return NewDNS(t.Raw)
+	case TLS:
+		return NewTLS(t.Raw, opts.TLS)
+	case SSH, SMTP, Redis, Postgres:
+		return NewBanner(t.Kind, t.Port)
+	default:
+		return nil, fmt.Errorf("no probe for %v targets", t.Kind)
+	}
+}
@@ -0,0 +1,45 @@
+package probe
+
+import "testing"
+
+// TestParseTarget tests the target syntaxes
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		kind Kind
+		host string
+		port int
+	}{
+		{"web1", ICMP, "web1", 0},
+		{"192.0.2.1", ICMP, "192.0.2.1", 0},
+		{"2001:db8::1", ICMP, "2001:db8::1", 0},
+		{"icmp://web1", ICMP, "web1", 0},
+		{"web1:22", TCP, "web1", 22},
+		{"[2001:db8::1]:443", TCP, "2001:db8::1", 443},
+		{"tcp://web1:443", TCP, "web1", 443},
+		{"TCP://[::1]:8080", TCP, "::1", 8080},
+		{"http://web1/healthz", HTTP, "web1", 80},
+		{"https://web1/healthz?full=1", HTTP, "web1", 443},
+		{"https://[2001:db8::1]:8443/", HTTP, "2001:db8::1", 8443},
+		{"ssh://web1", SSH, "web1", 22},
+		{"smtp://mx1:587", SMTP, "mx1", 587},
+		{"redis://cache1", Redis, "cache1", 6379},
+		{"postgresql://db1:5433", Postgres, "db1", 5433},
+	}
+	for _, tt := range tests {
+		got, err := ParseTarget(tt.in)
+		if err != nil {
+			t.Errorf("ParseTarget(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got.Kind != tt.kind || got.Host != tt.host || got.Port != tt.port || got.Raw != tt.in {
+			t.Errorf("ParseTarget(%q) = %+v, expected %v %s port %d", tt.in, got, tt.kind, tt.host, tt.port)
+		}
+	}
+
+	for _, in := range []string{"", "web1:", "web1:ssh", "web1:70000", "tcp://web1", "tcp://:22", "icmp://web1:22", "http:///healthz", "https://web1:0/", "gopher://web1"} {
+		if _, err := ParseTarget(in); err == nil {
+			t.Errorf("ParseTarget(%q) succeeded, expected an error", in)
+		}
+	}
+}
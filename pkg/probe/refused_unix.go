@@ -0,0 +1,12 @@
+//go:build !windows
+package probe
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isRefused reports whether a connect failed because of a reset
+func isRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,14 @@
+//go:build windows
+package probe
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// isRefused reports whether a connect failed because of a reset. Winsock
+// reports it as WSAECONNREFUSED rather than the POSIX error number.
+func isRefused(err error) bool {
+	return errors.Is(err, windows.WSAECONNREFUSED)
+}
@@ -0,0 +1,95 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// TCPPinger probes a TCP port by connecting to it and closing the
+// connection again. The time the handshake took is reported as the RTT. A
+// port answering with a reset fails with a *RefusedError, one that does
+// not answer in time with a *ping.TimeoutError.
+//
+// The IP-level options of ping.Options are not applied to TCP probes; only
+// the timeout is.
+type TCPPinger struct {
+	port   int
+	dialer net.Dialer
+}
+
+// NewTCP returns a Pinger connecting to port
+func NewTCP(port int) *TCPPinger {
+	return &TCPPinger{port: port}
+}
+
+// Port returns the port the Pinger connects to
+func (p *TCPPinger) Port() int {
+	return p.port
+}
+
+// PingContext connects to ip and reports how long the handshake took
+func (p *TCPPinger) PingContext(ctx context.Context, ip net.IP, opts ping.Options) (*ping.Reply, error) {
+	conn, rtt, err := p.connect(ctx, ip, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return &ping.Reply{From: ip, RTT: rtt, TTL: -1}, nil
+}
+
+// connect opens a connection to the port on ip, waiting up to timeout, or
+// until ctx is done if timeout is 0. Other probes build on it to talk to
+// the service once connected.
+func (p *TCPPinger) connect(ctx context.Context, ip net.IP, timeout time.Duration) (net.Conn, time.Duration, error) {
+	dialCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	conn, err := p.dialer.DialContext(dialCtx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(p.port)))
+	rtt := time.Since(start)
+	if err == nil {
+		return conn, rtt, nil
+	}
+
+	var netErr net.Error
+	switch {
+	case ctx.Err() != nil:
+		return nil, rtt, ctx.Err()
+	case dialCtx.Err() != nil:
+		return nil, rtt, &ping.TimeoutError{IP: ip, After: timeout}
+	case isRefused(err):
+		return nil, rtt, &RefusedError{IP: ip, Port: p.port, RTT: rtt}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return nil, rtt, &ping.TimeoutError{IP: ip, After: rtt}
+	default:
+		return nil, rtt, &ConnectError{IP: ip, Port: p.port, Err: err}
+	}
+}
+
+// Ping connects to ip and returns the connect latency
+func (p *TCPPinger) Ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	reply, err := p.PingContext(context.Background(), ip, ping.Options{Timeout: timeout})
+	if err != nil {
+		return 0, err
+	}
+	return reply.RTT, nil
+}
+
+// PingMany connects to all of the addresses concurrently
+func (p *TCPPinger) PingMany(ips []net.IP, timeout time.Duration) []ping.Result {
+	return ping.PingAll(context.Background(), p, ips, ping.Options{Timeout: timeout})
+}
+
+// Close does nothing; connections are closed after every probe
+func (p *TCPPinger) Close() error {
+	return nil
+}
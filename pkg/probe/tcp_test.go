@@ -0,0 +1,63 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// listenLocal starts a TCP listener on a free localhost port
+func listenLocal(t *testing.T) (net.Listener, int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+// TestTCPConnect tests probing an open port
+func TestTCPConnect(t *testing.T) {
+	ln, port := listenLocal(t)
+	defer ln.Close()
+
+	p := NewTCP(port)
+	reply, err := p.PingContext(context.Background(), net.ParseIP("127.0.0.1"), ping.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if reply.RTT <= 0 || !reply.From.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Expected a reply from 127.0.0.1 with a positive RTT, got %+v", reply)
+	}
+}
+
+// TestTCPRefused tests that a closed port is reported as refused rather
+// than as a timeout
+func TestTCPRefused(t *testing.T) {
+	ln, port := listenLocal(t)
+	ln.Close()
+
+	_, err := NewTCP(port).Ping(net.ParseIP("127.0.0.1"), time.Second)
+	var refused *RefusedError
+	if !errors.As(err, &refused) {
+		t.Fatalf("Expected RefusedError, got %T: %v", err, err)
+	}
+	if refused.Port != port {
+		t.Errorf("Expected port %d in the error, got %d", port, refused.Port)
+	}
+}
+
+// TestTCPCancel tests that a cancelled context is reported as such
+func TestTCPCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := NewTCP(9).PingContext(ctx, net.ParseIP("127.0.0.1"), ping.Options{Timeout: time.Second})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// DefaultWarnDays is how many days before its certificate expires a TLS
+// target is reported as expiring, unless TLSOptions says otherwise
+const DefaultWarnDays = 14
+
+// TLSOptions controls a TLS probe
+type TLSOptions struct {
+	// ServerName is sent as SNI and must be named by the certificate.
+	// Empty means the host of the target.
+	ServerName string
+
+	// WarnDays is how many days before the leaf certificate expires the
+	// probe fails with an *ExpiringError. Zero means DefaultWarnDays and a
+	// negative value disables the warning.
+	WarnDays int
+
+	// RootCAs are the certificate authorities trusted to sign the chain.
+	// Nil means the system roots.
+	RootCAs *x509.CertPool
+}
+
+// TLSPinger probes a TLS server by completing a handshake with it and
+// verifying its certificate chain and name. The RTT is the time the
+// handshake took after the TCP connect.
+//
+// A certificate that does not verify fails with a *CertificateError, a
+// valid one about to expire is returned together with an *ExpiringError,
+// and other handshake failures are reported as a *HandshakeError. Connect
+// failures are reported as by TCPPinger.
+type TLSPinger struct {
+	opts TLSOptions
+	tcp  *TCPPinger
+}
+
+// NewTLS returns a Pinger making handshakes with the server named by a
+// tls://host[:port] URL, port 443 by default
+func NewTLS(rawURL string, opts TLSOptions) (*TLSPinger, error) {
+	t, err := ParseTarget(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if t.Kind != TLS {
+		return nil, fmt.Errorf("not a tls URL: %q", rawURL)
+	}
+	if opts.ServerName == "" {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		opts.ServerName = u.Hostname()
+	}
+	if opts.WarnDays == 0 {
+		opts.WarnDays = DefaultWarnDays
+	}
+	return &TLSPinger{opts: opts, tcp: NewTCP(t.Port)}, nil
+}
+
+// PingContext makes a handshake with the server at ip and checks its
+// certificate
+func (p *TLSPinger) PingContext(ctx context.Context, ip net.IP, opts ping.Options) (*ping.Reply, error) {
+	hsCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		hsCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	conn, _, err := p.tcp.connect(hsCtx, ip, 0)
+	var state tls.ConnectionState
+	var rtt time.Duration
+	if err == nil {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: p.opts.ServerName, RootCAs: p.opts.RootCAs})
+		start := time.Now()
+		err = tlsConn.HandshakeContext(hsCtx)
+		rtt = time.Since(start)
+		state = tlsConn.ConnectionState()
+		tlsConn.Close()
+	}
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case hsCtx.Err() != nil:
+		return nil, &ping.TimeoutError{IP: ip, After: opts.Timeout}
+	default:
+		return nil, p.handshakeError(ip, err)
+	}
+
+	reply := &ping.Reply{From: ip, RTT: rtt, TTL: -1}
+	leaf := state.PeerCertificates[0]
+	left := time.Until(leaf.NotAfter)
+	if p.opts.WarnDays > 0 && left < time.Duration(p.opts.WarnDays)*24*time.Hour {
+		return reply, &ExpiringError{Server: ip, Subject: leaf.Subject.CommonName, NotAfter: leaf.NotAfter, Left: left}
+	}
+	return reply, nil
+}
+
+// handshakeError converts an error of the connect or handshake
+func (p *TLSPinger) handshakeError(ip net.IP, err error) error {
+	var (
+		refused     *RefusedError
+		connectErr  *ConnectError
+		hostErr     x509.HostnameError
+		authErr     x509.UnknownAuthorityError
+		invalidErr  x509.CertificateInvalidError
+		verifyError *tls.CertificateVerificationError
+	)
+	switch {
+	case errors.As(err, &refused), errors.As(err, &connectErr):
+		return err
+	case errors.As(err, &hostErr):
+		return &CertificateError{Server: ip, Problem: "name mismatch", Err: err}
+	case errors.As(err, &authErr):
+		return &CertificateError{Server: ip, Problem: "untrusted", Err: err}
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return &CertificateError{Server: ip, Problem: "expired", Err: err}
+	case errors.As(err, &invalidErr), errors.As(err, &verifyError):
+		return &CertificateError{Server: ip, Problem: "invalid", Err: err}
+	default:
+		return &HandshakeError{Server: ip, Err: err}
+	}
+}
+
+// Ping makes a handshake with the server at ip and returns its latency
+func (p *TLSPinger) Ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	reply, err := p.PingContext(context.Background(), ip, ping.Options{Timeout: timeout})
+	if err != nil {
+		return 0, err
+	}
+	return reply.RTT, nil
+}
+
+// PingMany makes handshakes with all of the servers concurrently
+func (p *TLSPinger) PingMany(ips []net.IP, timeout time.Duration) []ping.Result {
+	return ping.PingAll(context.Background(), p, ips, ping.Options{Timeout: timeout})
+}
+
+// Close does nothing; connections are closed after every probe
+func (p *TLSPinger) Close() error {
+	return nil
+}
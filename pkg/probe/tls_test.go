@@ -0,0 +1,182 @@
+package probe
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "muod test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for name valid until notAfter
+func (ca *testCA) issue(t *testing.T, name string, notAfter time.Time) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serveTLS accepts connections with cert and completes their handshakes
+func serveTLS(t *testing.T, cert tls.Certificate) net.Listener {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// TestTLS tests certificate verification and the expiry warning
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	day := 24 * time.Hour
+	valid := serveTLS(t, ca.issue(t, "web1.example", time.Now().Add(90*day)))
+	defer valid.Close()
+	expiring := serveTLS(t, ca.issue(t, "web1.example", time.Now().Add(5*day)))
+	defer expiring.Close()
+	expired := serveTLS(t, ca.issue(t, "web1.example", time.Now().Add(-day)))
+	defer expired.Close()
+
+	tests := []struct {
+		name    string
+		ln      net.Listener
+		target  string
+		opts    TLSOptions
+		problem string // Expected CertificateError problem, "expiring" for an ExpiringError, empty for success
+	}{
+		{"valid", valid, "web1.example", TLSOptions{RootCAs: ca.pool}, ""},
+		{"server name override", valid, "192.0.2.1", TLSOptions{ServerName: "web1.example", RootCAs: ca.pool}, ""},
+		{"name mismatch", valid, "web2.example", TLSOptions{RootCAs: ca.pool}, "name mismatch"},
+		{"untrusted", valid, "web1.example", TLSOptions{}, "untrusted"},
+		{"expires in 5 days", expiring, "web1.example", TLSOptions{RootCAs: ca.pool}, "expiring"},
+		{"warning after 3 days", expiring, "web1.example", TLSOptions{RootCAs: ca.pool, WarnDays: 3}, ""},
+		{"warning disabled", expiring, "web1.example", TLSOptions{RootCAs: ca.pool, WarnDays: -1}, ""},
+		{"expired", expired, "web1.example", TLSOptions{RootCAs: ca.pool}, "expired"},
+	}
+	for _, tt := range tests {
+		addr := tt.ln.Addr().(*net.TCPAddr)
+		p, err := NewTLS(fmt.Sprintf("tls://%s:%d", tt.target, addr.Port), tt.opts)
+		if err != nil {
+			t.Fatalf("%s: failed to create TLS probe: %v", tt.name, err)
+		}
+		reply, err := p.PingContext(context.Background(), addr.IP, ping.Options{Timeout: 2 * time.Second})
+
+		var certErr *CertificateError
+		var expiringErr *ExpiringError
+		switch tt.problem {
+		case "":
+			if err != nil {
+				t.Errorf("%s: expected success, got %v", tt.name, err)
+			}
+		case "expiring":
+			if !errors.As(err, &expiringErr) || expiringErr.Left > 5*day || expiringErr.Left < 4*day {
+				t.Errorf("%s: expected an ExpiringError about 5 days, got %v", tt.name, err)
+			}
+			if reply == nil {
+				t.Errorf("%s: expected the reply with the warning", tt.name)
+			}
+		default:
+			if !errors.As(err, &certErr) || certErr.Problem != tt.problem {
+				t.Errorf("%s: expected a %s certificate, got %v", tt.name, tt.problem, err)
+			}
+		}
+		if err == nil && (reply == nil || reply.RTT <= 0) {
+			t.Errorf("%s: expected a positive handshake time, got %+v", tt.name, reply)
+		}
+	}
+}
+
+// TestTLSHandshakeFailure tests a server that does not speak TLS
+func TestTLSHandshakeFailure(t *testing.T) {
+	ln, port := listenLocal(t)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "SSH-2.0-OpenSSH_9.6\r\n")
+			conn.Close()
+		}
+	}()
+
+	p, err := NewTLS(fmt.Sprintf("tls://localhost:%d", port), TLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Ping(net.ParseIP("127.0.0.1"), 2*time.Second)
+	var hsErr *HandshakeError
+	if !errors.As(err, &hsErr) {
+		t.Errorf("Expected HandshakeError, got %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+// Package state decides whether a host is up or down from its rounds of
+// probes, with hysteresis so that one lost round on a busy link does not
+// mark it down, and detects hosts that flap between the two.
+//
+// Example usage:
+//
+//	m := state.New(state.Thresholds{DownAfter: 3, UpAfter: 2})
+//	for {
+//	    ok := pingRound(host)
+//	    if m.Observe(time.Now(), ok) {
+//	        log.Printf("%s is %v", host, m.State())
+//	    }
+//	}
+package state
+
+import (
+	"fmt"
+	"time"
+)
+
+// State is what is known about a host
+type State int
+
+const (
+	Unknown    State = iota // No round observed yet
+	Up                      // The host answers
+	Suspect                 // Up, but the last rounds failed
+	Down                    // The host does not answer
+	Recovering              // Down, but the last rounds succeeded
+)
+
+func (s State) String() string {
+	switch s {
+	case Unknown:
+		return "unknown"
+	case Up:
+		return "up"
+	case Suspect:
+		return "suspect"
+	case Down:
+		return "down"
+	case Recovering:
+		return "recovering"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// IsUp reports whether a host in state s counts as up: Up or Suspect
+func (s State) IsUp() bool {
+	return s == Up || s == Suspect
+}
+
+// Thresholds control when a host changes between up and down
+type Thresholds struct {
+	// Consecutive failed rounds before an up host is down. Values below 1
+	// mean 1.
+	DownAfter int
+
+	// Consecutive successful rounds before a down host is up. Values below
+	// 1 mean 1.
+	UpAfter int
+
+	// Changes between up and down within FlapWindow that make a host
+	// flapping, 0 to disable flap detection
+	FlapCount  int
+	FlapWindow time.Duration
+}
+
+// Machine tracks the state of one host. A Machine is not safe for
+// concurrent use.
+type Machine struct {
+	th      Thresholds
+	state   State
+	streak  int         // Consecutive rounds contradicting the state
+	began   time.Time   // When the streak began
+	started time.Time   // When the streak that made the last change began
+	since   time.Time   // When the host became up or down
+	changes []time.Time // Changes between up and down within the flap window
+}
+
+// New returns a Machine in the Unknown state
+func New(th Thresholds) *Machine {
+	th.DownAfter = max(th.DownAfter, 1)
+	th.UpAfter = max(th.UpAfter, 1)
+	return &Machine{th: th}
+}
+
+// Observe records whether the round at time at succeeded and reports
+// whether the host changed between up and down. The first round sets the
+// state without counting as a change.
+func (m *Machine) Observe(at time.Time, ok bool) bool {
+	// Forget changes that have left the flap window
+	n := 0
+	for _, t := range m.changes {
+		if at.Sub(t) < m.th.FlapWindow {
+			m.changes[n] = t
+			n++
+		}
+	}
+	m.changes = m.changes[:n]
+
+	if m.state == Unknown {
+		m.state, m.since, m.started = Down, at, at
+		if ok {
+			m.state = Up
+		}
+		return false
+	}
+
+	up := m.state.IsUp()
+	if ok == up {
+		m.streak = 0
+		m.state = Down
+		if up {
+			m.state = Up
+		}
+		return false
+	}
+
+	m.streak++
+	if m.streak == 1 {
+		m.began = at
+	}
+	switch {
+	case up && m.streak < m.th.DownAfter:
+		m.state = Suspect
+		return false
+	case !up && m.streak < m.th.UpAfter:
+		m.state = Recovering
+		return false
+	}
+	m.streak = 0
+	m.state, m.since, m.started = Up, at, m.began
+	if up {
+		m.state = Down
+	}
+	if m.th.FlapCount > 0 {
+		m.changes = append(m.changes, at)
+	}
+	return true
+}
+
+// State returns the current state
+func (m *Machine) State() State {
+	return m.state
+}
+
+// Since returns when the host last became up or down, or when the first
+// round was observed
+func (m *Machine) Since() time.Time {
+	return m.since
+}
+
+// Started returns when the rounds that made the last change began: the
+// first of the DownAfter failed rounds that made the host down, or of the
+// UpAfter successful ones that made it up. Before any change it is the
+// first round, like Since.
+func (m *Machine) Started() time.Time {
+	return m.started
+}
+
+// Flapping reports whether the host changed between up and down at least
+// FlapCount times within FlapWindow of the last round
+func (m *Machine) Flapping() bool {
+	return m.th.FlapCount > 0 && len(m.changes) >= m.th.FlapCount
+}
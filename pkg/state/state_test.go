@@ -0,0 +1,103 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+// TestHysteresis tests that a host changes state only after enough
+// consecutive rounds
+func TestHysteresis(t *testing.T) {
+	m := New(Thresholds{DownAfter: 3, UpAfter: 2})
+	start := time.Now()
+	rounds := []struct {
+		ok      bool
+		state   State
+		changed bool
+	}{
+		{true, Up, false},
+		{false, Suspect, false},
+		{true, Up, false}, // One lost round is forgiven
+		{false, Suspect, false},
+		{false, Suspect, false},
+		{false, Down, true},
+		{true, Recovering, false},
+		{false, Down, false},
+		{true, Recovering, false},
+		{true, Up, true},
+	}
+	for i, r := range rounds {
+		at := start.Add(time.Duration(i) * time.Second)
+		changed := m.Observe(at, r.ok)
+		if m.State() != r.state || changed != r.changed {
+			t.Errorf("Round %d: expected %v (changed %v), got %v (changed %v)", i+1, r.state, r.changed, m.State(), changed)
+		}
+	}
+	if since := m.Since(); !since.Equal(start.Add(9 * time.Second)) {
+		t.Errorf("Expected the host to be up since round 10, got %v", since.Sub(start))
+	}
+	if started := m.Started(); !started.Equal(start.Add(8 * time.Second)) {
+		t.Errorf("Expected the rounds bringing the host up to start at round 9, got %v", started.Sub(start))
+	}
+}
+
+// TestStarted tests that a change is dated back to the first round that
+// led to it
+func TestStarted(t *testing.T) {
+	m := New(Thresholds{DownAfter: 3})
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+
+	m.Observe(at(0), true)
+	if !m.Started().Equal(at(0)) {
+		t.Errorf("Expected the first round before any change, got %v", m.Started().Sub(start))
+	}
+	m.Observe(at(1), true)
+	m.Observe(at(2), false)
+	m.Observe(at(3), false)
+	if !m.Observe(at(4), false) || !m.Started().Equal(at(2)) || !m.Since().Equal(at(4)) {
+		t.Errorf("Expected the host down at 4s after failing since 2s, got %v since %v after failing since %v",
+			m.State(), m.Since().Sub(start), m.Started().Sub(start))
+	}
+}
+
+// TestDefaultThresholds tests that without thresholds every round decides
+func TestDefaultThresholds(t *testing.T) {
+	m := New(Thresholds{})
+	if m.State() != Unknown {
+		t.Errorf("Expected Unknown before the first round, got %v", m.State())
+	}
+	now := time.Now()
+	if m.Observe(now, false) || m.State() != Down {
+		t.Errorf("Expected the first round to set Down without a change, got %v", m.State())
+	}
+	if !m.Observe(now, true) || m.State() != Up {
+		t.Errorf("Expected one round to bring the host up, got %v", m.State())
+	}
+	if !m.Observe(now, false) || m.State() != Down {
+		t.Errorf("Expected one round to take the host down, got %v", m.State())
+	}
+}
+
+// TestFlapping tests that changes are counted within the window only
+func TestFlapping(t *testing.T) {
+	m := New(Thresholds{FlapCount: 3, FlapWindow: 10 * time.Second})
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+
+	m.Observe(at(0), true)
+	m.Observe(at(1), false)
+	m.Observe(at(2), true)
+	if m.Flapping() {
+		t.Errorf("Expected 2 changes not to be flapping")
+	}
+	m.Observe(at(3), false)
+	if !m.Flapping() {
+		t.Errorf("Expected 3 changes in 3s to be flapping")
+	}
+	// Stable for long enough that the first change leaves the window
+	m.Observe(at(11), false)
+	if m.Flapping() {
+		t.Errorf("Expected flapping to end once changes leave the window")
+	}
+}
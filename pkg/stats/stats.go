@@ -0,0 +1,232 @@
+// Package stats accumulates ping results into per-host statistics: loss,
+// min/avg/max/mdev of the round-trip time, percentiles and jitter, as
+// printed by ping and mtr.
+//
+// Example usage:
+//
+//	var set stats.Set
+//	for _, result := range pinger.PingMany(ips, timeout) {
+//	    set.Add(result)
+//	}
+//	for _, host := range set.Hosts() {
+//	    s := set.Get(host).Summary()
+//	    log.Printf("%s: %d/%d received, %.1f%% loss, avg %v, p95 %v",
+//	        host, s.Received, s.Sent, s.Loss, s.Avg, s.P95)
+//	}
+package stats
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// MaxRTTs is how many of the latest RTTs a Stats keeps for percentiles, so
+// that a host monitored for days does not use ever more memory. The other
+// statistics cover every reply.
+const MaxRTTs = 10000
+
+// Stats holds the statistics of one host. The zero Stats is ready to use.
+// A Stats is not safe for concurrent use.
+type Stats struct {
+	sent     int
+	received int
+	rtts     []time.Duration // The latest MaxRTTs RTTs, oldest at next once full
+	next     int             // Where the next RTT goes once rtts is full
+	last     time.Duration   // The latest RTT
+	min      time.Duration
+	max      time.Duration
+	sum      float64
+	sumSq    float64
+	jitter   float64 // Sum of absolute differences between consecutive RTTs
+}
+
+// Add records one ping result; failed results count as lost
+func (s *Stats) Add(r ping.Result) {
+	if r.Success {
+		s.AddRTT(r.RTT)
+	} else {
+		s.AddLoss()
+	}
+}
+
+// AddRTT records a probe answered after rtt
+func (s *Stats) AddRTT(rtt time.Duration) {
+	s.sent++
+	s.received++
+	if s.received > 1 {
+		s.jitter += math.Abs(float64(rtt - s.last))
+	}
+	s.last = rtt
+	if len(s.rtts) < MaxRTTs {
+		s.rtts = append(s.rtts, rtt)
+	} else {
+		s.rtts[s.next] = rtt
+		s.next = (s.next + 1) % MaxRTTs
+	}
+	if s.received == 1 || rtt < s.min {
+		s.min = rtt
+	}
+	if rtt > s.max {
+		s.max = rtt
+	}
+	s.sum += float64(rtt)
+	s.sumSq += float64(rtt) * float64(rtt)
+}
+
+// AddLoss records a probe that was not answered
+func (s *Stats) AddLoss() {
+	s.sent++
+}
+
+// Sent returns the number of probes recorded
+func (s *Stats) Sent() int {
+	return s.sent
+}
+
+// Received returns the number of probes answered
+func (s *Stats) Received() int {
+	return s.received
+}
+
+// Loss returns the percentage of probes that were not answered
+func (s *Stats) Loss() float64 {
+	if s.sent == 0 {
+		return 0
+	}
+	return 100 * float64(s.sent-s.received) / float64(s.sent)
+}
+
+// Last returns the latest RTT, 0 if nothing was received
+func (s *Stats) Last() time.Duration {
+	return s.last
+}
+
+// Min returns the smallest RTT, 0 if nothing was received
+func (s *Stats) Min() time.Duration {
+	return s.min
+}
+
+// Max returns the largest RTT, 0 if nothing was received
+func (s *Stats) Max() time.Duration {
+	return s.max
+}
+
+// Avg returns the mean RTT, 0 if nothing was received
+func (s *Stats) Avg() time.Duration {
+	if s.received == 0 {
+		return 0
+	}
+	return time.Duration(s.sum / float64(s.received))
+}
+
+// Mdev returns the standard deviation of the RTTs, which ping calls mdev
+func (s *Stats) Mdev() time.Duration {
+	if s.received == 0 {
+		return 0
+	}
+	mean := s.sum / float64(s.received)
+	variance := s.sumSq/float64(s.received) - mean*mean
+	if variance < 0 {
+		variance = 0
+	}
+	return time.Duration(math.Sqrt(variance))
+}
+
+// Jitter returns the mean absolute difference between consecutive RTTs
+func (s *Stats) Jitter() time.Duration {
+	if s.received < 2 {
+		return 0
+	}
+	return time.Duration(s.jitter / float64(s.received-1))
+}
+
+// Percentile returns the RTT below or at which p percent of the latest
+// MaxRTTs replies arrived, using the nearest-rank method. It returns 0 if
+// nothing was received.
+func (s *Stats) Percentile(p float64) time.Duration {
+	return percentile(s.sorted(), p)
+}
+
+// sorted returns a sorted copy of the RTTs
+func (s *Stats) sorted() []time.Duration {
+	sorted := append([]time.Duration(nil), s.rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// percentile returns the nearest-rank percentile of sorted RTTs
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	rank = max(1, min(rank, len(sorted)))
+	return sorted[rank-1]
+}
+
+// Summary is a snapshot of a host's statistics
+type Summary struct {
+	Sent     int
+	Received int
+	Loss     float64 // Percentage of probes not answered
+	Min      time.Duration
+	Avg      time.Duration
+	Max      time.Duration
+	Mdev     time.Duration
+	P50      time.Duration
+	P95      time.Duration
+	P99      time.Duration
+	Jitter   time.Duration
+}
+
+// Summary returns every statistic at once
+func (s *Stats) Summary() Summary {
+	sorted := s.sorted()
+	return Summary{
+		Sent:     s.sent,
+		Received: s.received,
+		Loss:     s.Loss(),
+		Min:      s.min,
+		Avg:      s.Avg(),
+		Max:      s.max,
+		Mdev:     s.Mdev(),
+		P50:      percentile(sorted, 50),
+		P95:      percentile(sorted, 95),
+		P99:      percentile(sorted, 99),
+		Jitter:   s.Jitter(),
+	}
+}
+
+// Set holds the statistics of several hosts keyed by Result.Host. The zero
+// Set is ready to use. A Set is not safe for concurrent use.
+type Set struct {
+	hosts []string
+	stats map[string]*Stats
+}
+
+// Add records a result under its Host
+func (s *Set) Add(r ping.Result) {
+	s.Get(r.Host).Add(r)
+}
+
+// Get returns the statistics of host, adding it if it is new
+func (s *Set) Get(host string) *Stats {
+	if s.stats == nil {
+		s.stats = make(map[string]*Stats)
+	}
+	st, ok := s.stats[host]
+	if !ok {
+		st = &Stats{}
+		s.stats[host] = st
+		s.hosts = append(s.hosts, host)
+	}
+	return st
+}
+
+// Hosts returns the hosts in the order they were first added
+func (s *Set) Hosts() []string {
+	return append([]string(nil), s.hosts...)
+}
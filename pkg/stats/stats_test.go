@@ -0,0 +1,112 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// TestStats tests the statistics of a known series of RTTs
+func TestStats(t *testing.T) {
+	var s Stats
+	for _, ms := range []int{10, 20, 30, 40} {
+		s.AddRTT(time.Duration(ms) * time.Millisecond)
+	}
+	s.AddLoss()
+
+	sum := s.Summary()
+	if sum.Sent != 5 || sum.Received != 4 || sum.Loss != 20 {
+		t.Errorf("Expected 4/5 received with 20%% loss, got %d/%d with %.1f%%", sum.Received, sum.Sent, sum.Loss)
+	}
+	if sum.Min != 10*time.Millisecond || sum.Max != 40*time.Millisecond || sum.Avg != 25*time.Millisecond {
+		t.Errorf("Expected min/avg/max 10/25/40ms, got %v/%v/%v", sum.Min, sum.Avg, sum.Max)
+	}
+	// sqrt(((15² + 5² + 5² + 15²) / 4)) ms
+	if sum.Mdev < 11180*time.Microsecond || sum.Mdev > 11181*time.Microsecond {
+		t.Errorf("Expected mdev of about 11.18ms, got %v", sum.Mdev)
+	}
+	if sum.Jitter != 10*time.Millisecond {
+		t.Errorf("Expected jitter 10ms, got %v", sum.Jitter)
+	}
+	if sum.P50 != 20*time.Millisecond || sum.P95 != 40*time.Millisecond || sum.P99 != 40*time.Millisecond {
+		t.Errorf("Expected p50/p95/p99 20/40/40ms, got %v/%v/%v", sum.P50, sum.P95, sum.P99)
+	}
+	if last := s.Last(); last != 40*time.Millisecond {
+		t.Errorf("Expected last RTT 40ms, got %v", last)
+	}
+}
+
+// TestPercentile tests nearest-rank percentiles over many samples
+func TestPercentile(t *testing.T) {
+	var s Stats
+	// Added out of order to check that percentiles do not depend on it
+	for i := 100; i >= 1; i-- {
+		s.AddRTT(time.Duration(i) * time.Millisecond)
+	}
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, 1 * time.Millisecond},
+		{50, 50 * time.Millisecond},
+		{95, 95 * time.Millisecond},
+		{99, 99 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := s.Percentile(tt.p); got != tt.want {
+			t.Errorf("Percentile(%v) = %v, expected %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+// TestPercentileHistory tests that percentiles cover the latest MaxRTTs
+// replies while the other statistics cover all of them
+func TestPercentileHistory(t *testing.T) {
+	var s Stats
+	for i := 0; i < MaxRTTs; i++ {
+		s.AddRTT(time.Second)
+	}
+	for i := 0; i < MaxRTTs/2; i++ {
+		s.AddRTT(time.Millisecond)
+	}
+	if len(s.rtts) != MaxRTTs {
+		t.Errorf("Expected %d RTTs kept, got %d", MaxRTTs, len(s.rtts))
+	}
+	sum := s.Summary()
+	if sum.P50 != time.Millisecond || sum.P99 != time.Second || sum.Min != time.Millisecond || sum.Received != MaxRTTs*3/2 {
+		t.Errorf("Expected p50 1ms and p99 1s over the latest replies, min 1ms of all %d, got %+v", MaxRTTs*3/2, sum)
+	}
+}
+
+// TestEmpty tests that a host with no replies reports zeros
+func TestEmpty(t *testing.T) {
+	var s Stats
+	if sum := s.Summary(); sum != (Summary{}) {
+		t.Errorf("Expected zero summary, got %+v", sum)
+	}
+	s.AddLoss()
+	if sum := s.Summary(); sum.Loss != 100 || sum.Avg != 0 || sum.P99 != 0 {
+		t.Errorf("Expected 100%% loss and zero RTTs, got %+v", sum)
+	}
+}
+
+// TestSet tests grouping results by host
+func TestSet(t *testing.T) {
+	var set Set
+	set.Add(ping.Result{Host: "b", Success: true, RTT: time.Millisecond})
+	set.Add(ping.Result{Host: "a", Error: &ping.TimeoutError{}})
+	set.Add(ping.Result{Host: "b", Error: &ping.TimeoutError{}})
+
+	hosts := set.Hosts()
+	if len(hosts) != 2 || hosts[0] != "b" || hosts[1] != "a" {
+		t.Fatalf("Expected hosts in order of first result, got %v", hosts)
+	}
+	if b := set.Get("b"); b.Sent() != 2 || b.Received() != 1 {
+		t.Errorf("Expected 1/2 received for b, got %d/%d", b.Received(), b.Sent())
+	}
+	if a := set.Get("a"); a.Loss() != 100 {
+		t.Errorf("Expected 100%% loss for a, got %.1f%%", a.Loss())
+	}
+}
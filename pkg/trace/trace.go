@@ -0,0 +1,234 @@
+// Package trace implements an mtr-style traceroute on top of the
+// unprivileged pinger. Each round sends echo requests with increasing TTLs
+// and collects the ICMP Time Exceeded errors routers send back; a Path
+// accumulates per-hop loss and latency over rounds and reports route
+// changes.
+//
+// Example usage:
+//
+//	var path trace.Path
+//	for ctx.Err() == nil {
+//	    probes := trace.Round(ctx, pinger, ip, trace.Options{})
+//	    for _, change := range path.Record(probes) {
+//	        log.Printf("hop %d changed from %v to %v", change.TTL, change.From, change.To)
+//	    }
+//	    for _, hop := range path.Hops() {
+//	        log.Printf("%2d %-15v %5.1f%% %v", hop.TTL, hop.Addr, hop.Loss(), hop.Avg())
+//	    }
+//	}
+package trace
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+	"github.com/fmattheus/muod/pkg/stats"
+)
+
+// Defaults for the zero Options
+const (
+	DefaultMaxHops = 30
+	DefaultTimeout = time.Second
+)
+
+// Options controls a trace round
+type Options struct {
+	// MaxHops is the largest TTL probed, DefaultMaxHops if zero.
+	MaxHops int
+
+	// Timeout is how long to wait for each probe, DefaultTimeout if zero.
+	Timeout time.Duration
+
+	// Probe holds further options for every probe, such as the payload
+	// size or TOS. Its Timeout and TTL are ignored.
+	Probe ping.Options
+}
+
+// Probe is the outcome of one TTL-limited echo request
+type Probe struct {
+	TTL     int
+	From    net.IP        // Router or host that answered, nil if none
+	RTT     time.Duration // Round-trip time of the answer
+	Reached bool          // The destination itself answered
+	Err     error         // Why the probe failed; Time Exceeded is not a failure
+}
+
+// Round probes every TTL up to opts.MaxHops concurrently and returns the
+// probes up to and including the first one that ended the path: the
+// destination answered, or a router reported it unreachable.
+func Round(ctx context.Context, p ping.Pinger, ip net.IP, opts Options) []Probe {
+	if opts.MaxHops <= 0 {
+		opts.MaxHops = DefaultMaxHops
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	probes := make([]Probe, opts.MaxHops)
+	var wg sync.WaitGroup
+	for i := range probes {
+		wg.Add(1)
+		go func(ttl int) {
+			defer wg.Done()
+			po := opts.Probe
+			po.Timeout, po.TTL = opts.Timeout, ttl
+			reply, err := p.PingContext(ctx, ip, po)
+			probes[ttl-1] = newProbe(ttl, reply, err)
+		}(i + 1)
+	}
+	wg.Wait()
+
+	for i, probe := range probes {
+		if probe.final() {
+			return probes[:i+1]
+		}
+	}
+	return probes
+}
+
+// final reports whether no probe with a larger TTL can get further
+func (p Probe) final() bool {
+	return p.Reached || (p.From != nil && p.Err != nil)
+}
+
+// newProbe classifies the result of one probe
+func newProbe(ttl int, reply *ping.Reply, err error) Probe {
+	probe := Probe{TTL: ttl, Err: err}
+	if reply != nil {
+		probe.From, probe.RTT = reply.From, reply.RTT
+		probe.Reached = err == nil
+		return probe
+	}
+	if from, rtt, ok := icmpSource(err); ok {
+		probe.From, probe.RTT = from, rtt
+	}
+	var exceeded *ping.TimeExceededError
+	if errors.As(err, &exceeded) {
+		probe.Err = nil
+	}
+	return probe
+}
+
+// icmpSource returns the sender and RTT of an ICMP error
+func icmpSource(err error) (net.IP, time.Duration, bool) {
+	var (
+		exceeded    *ping.TimeExceededError
+		unreachable *ping.DestinationUnreachableError
+		prohibited  *ping.AdminProhibitedError
+		tooBig      *ping.PacketTooBigError
+		icmpErr     *ping.ICMPError
+	)
+	var e *ping.ICMPError
+	switch {
+	case errors.As(err, &exceeded):
+		e = &exceeded.ICMPError
+	case errors.As(err, &unreachable):
+		e = &unreachable.ICMPError
+	case errors.As(err, &prohibited):
+		e = &prohibited.ICMPError
+	case errors.As(err, &tooBig):
+		e = &tooBig.ICMPError
+	case errors.As(err, &icmpErr):
+		e = icmpErr
+	}
+	if e == nil || e.From == nil {
+		return nil, 0, false
+	}
+	return e.From, e.RTT, true
+}
+
+// Hop holds the statistics of one TTL over all rounds. The embedded Stats
+// counts a probe as received when any router or the destination answered.
+type Hop struct {
+	stats.Stats
+	TTL   int
+	Addr  net.IP   // Address that answered most recently, nil if none yet
+	Addrs []net.IP // Every address that has answered, in order of first answer
+	Err   error    // Error of the most recent probe, other than a timeout
+}
+
+// record adds one probe to the hop
+func (h *Hop) record(probe Probe) {
+	var timeout *ping.TimeoutError
+	if probe.Err != nil && !errors.As(probe.Err, &timeout) {
+		h.Err = probe.Err
+	} else {
+		h.Err = nil
+	}
+	if probe.From == nil {
+		h.AddLoss()
+		return
+	}
+
+	h.AddRTT(probe.RTT)
+	h.Addr = probe.From
+	known := false
+	for _, addr := range h.Addrs {
+		if addr.Equal(probe.From) {
+			known = true
+			break
+		}
+	}
+	if !known {
+		h.Addrs = append(h.Addrs, probe.From)
+	}
+}
+
+// Change is a route change detected between two rounds
+type Change struct {
+	TTL  int
+	From net.IP // Address that answered at this TTL before
+	To   net.IP // Address that answers now
+}
+
+// Path accumulates the hops of a traced path over rounds. The zero Path is
+// ready to use.
+type Path struct {
+	hops    []*Hop
+	length  int  // TTL at which the path ended last, 0 if it never did
+	reached bool // Whether the destination answered in the last round that ended
+	Rounds  int
+}
+
+// Record adds the probes of one round and returns the hops that answered
+// from a different address than in earlier rounds. A path that got longer
+// or shorter shows up as a change where the destination used to answer or
+// now answers.
+func (p *Path) Record(probes []Probe) []Change {
+	p.Rounds++
+	var changes []Change
+	for _, probe := range probes {
+		for len(p.hops) < probe.TTL {
+			p.hops = append(p.hops, &Hop{TTL: len(p.hops) + 1})
+		}
+		hop := p.hops[probe.TTL-1]
+		if probe.From != nil && hop.Addr != nil && !hop.Addr.Equal(probe.From) {
+			changes = append(changes, Change{TTL: probe.TTL, From: hop.Addr, To: probe.From})
+		}
+		hop.record(probe)
+	}
+
+	if n := len(probes); n > 0 && probes[n-1].final() {
+		p.length = n
+		p.reached = probes[n-1].Reached
+	}
+	return changes
+}
+
+// Hops returns the hops up to where the path ended, or every hop probed if
+// it has not ended yet.
+func (p *Path) Hops() []*Hop {
+	if p.length > 0 && p.length <= len(p.hops) {
+		return p.hops[:p.length]
+	}
+	return p.hops
+}
+
+// Reached reports whether the destination answered at the end of the path
+func (p *Path) Reached() bool {
+	return p.reached
+}
@@ -0,0 +1,147 @@
+package trace
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fmattheus/muod/pkg/ping"
+)
+
+// routePinger simulates a path through a list of routers to the destination
+type routePinger struct {
+	mu      sync.Mutex
+	routers []net.IP     // Router at each TTL before the destination
+	silent  map[int]bool // TTLs whose router never answers
+	blocked int          // TTL from which the last router reports unreachable, 0 for none
+}
+
+func (p *routePinger) PingContext(ctx context.Context, ip net.IP, opts ping.Options) (*ping.Reply, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hop := opts.TTL
+	rtt := time.Duration(hop) * time.Millisecond
+	if p.silent[hop] {
+		return nil, &ping.TimeoutError{IP: ip, After: opts.Timeout}
+	}
+	if p.blocked > 0 && hop >= p.blocked {
+		return nil, &ping.DestinationUnreachableError{ICMPError: ping.ICMPError{From: p.routers[p.blocked-1], Type: 3, Code: 1, RTT: rtt}}
+	}
+	if hop <= len(p.routers) {
+		return nil, &ping.TimeExceededError{ICMPError: ping.ICMPError{From: p.routers[hop-1], Type: 11, RTT: rtt}}
+	}
+	return &ping.Reply{From: ip, RTT: rtt}, nil
+}
+
+func (p *routePinger) Ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	return 0, nil
+}
+
+func (p *routePinger) PingMany(ips []net.IP, timeout time.Duration) []ping.Result {
+	return nil
+}
+
+func (p *routePinger) Close() error { return nil }
+
+// TestRound tests that a round stops at the destination
+func TestRound(t *testing.T) {
+	dest := net.ParseIP("198.51.100.1")
+	p := &routePinger{routers: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}, silent: map[int]bool{}}
+
+	probes := Round(context.Background(), p, dest, Options{MaxHops: 10, Timeout: time.Millisecond})
+	if len(probes) != 3 {
+		t.Fatalf("Expected 3 probes up to the destination, got %d", len(probes))
+	}
+	for i, probe := range probes[:2] {
+		if !probe.From.Equal(p.routers[i]) || probe.Reached || probe.Err != nil {
+			t.Errorf("Hop %d: expected Time Exceeded from %v, got %+v", i+1, p.routers[i], probe)
+		}
+	}
+	if !probes[2].Reached || !probes[2].From.Equal(dest) || probes[2].RTT != 3*time.Millisecond {
+		t.Errorf("Expected destination reached at hop 3, got %+v", probes[2])
+	}
+
+	// A destination that never answers is probed up to MaxHops
+	p.silent[3] = true
+	p.silent[4] = true
+	probes = Round(context.Background(), p, dest, Options{MaxHops: 4, Timeout: time.Millisecond})
+	if len(probes) != 4 || probes[3].From != nil {
+		t.Errorf("Expected 4 probes with no answer at hop 4, got %+v", probes)
+	}
+
+	// A router reporting the destination unreachable ends the path
+	p.blocked = 2
+	probes = Round(context.Background(), p, dest, Options{MaxHops: 10, Timeout: time.Millisecond})
+	if len(probes) != 2 || probes[1].Err == nil || probes[1].Reached {
+		t.Errorf("Expected the path to end with an error at hop 2, got %+v", probes)
+	}
+	var path Path
+	path.Record(probes)
+	if len(path.Hops()) != 2 || path.Reached() {
+		t.Errorf("Expected 2 hops without reaching the destination, got %d (%v)", len(path.Hops()), path.Reached())
+	}
+}
+
+// TestPathStatistics tests per-hop loss and latency over rounds
+func TestPathStatistics(t *testing.T) {
+	dest := net.ParseIP("198.51.100.1")
+	router := net.ParseIP("192.0.2.1")
+	var path Path
+
+	rounds := [][]Probe{
+		{{TTL: 1, From: router, RTT: 2 * time.Millisecond}, {TTL: 2, From: dest, RTT: 10 * time.Millisecond, Reached: true}},
+		{{TTL: 1, From: router, RTT: 4 * time.Millisecond}, {TTL: 2, From: dest, RTT: 20 * time.Millisecond, Reached: true}},
+		{{TTL: 1, Err: &ping.TimeoutError{}}, {TTL: 2, From: dest, RTT: 30 * time.Millisecond, Reached: true}},
+		{{TTL: 1, From: router, RTT: 6 * time.Millisecond}, {TTL: 2, Err: &ping.TimeoutError{}}, {TTL: 3}},
+	}
+	for _, probes := range rounds {
+		if changes := path.Record(probes); len(changes) != 0 {
+			t.Errorf("Expected no route changes, got %+v", changes)
+		}
+	}
+
+	hops := path.Hops()
+	if len(hops) != 2 {
+		t.Fatalf("Expected 2 hops to the destination, got %d", len(hops))
+	}
+	first, last := hops[0], hops[1]
+	if first.Sent() != 4 || first.Received() != 3 || first.Loss() != 25 {
+		t.Errorf("Expected 1 of 4 lost at hop 1, got %d/%d (%.0f%%)", first.Received(), first.Sent(), first.Loss())
+	}
+	if first.Min() != 2*time.Millisecond || first.Max() != 6*time.Millisecond || first.Avg() != 4*time.Millisecond || first.Last() != 6*time.Millisecond {
+		t.Errorf("Unexpected hop 1 latency: best %v avg %v worst %v last %v", first.Min(), first.Avg(), first.Max(), first.Last())
+	}
+	if sd := first.Mdev(); sd < 1600*time.Microsecond || sd > 1700*time.Microsecond {
+		t.Errorf("Expected hop 1 standard deviation of about 1.63ms, got %v", sd)
+	}
+	if last.Loss() != 25 || !last.Addr.Equal(dest) {
+		t.Errorf("Expected 25%% loss at the destination, got %.0f%% from %v", last.Loss(), last.Addr)
+	}
+	if path.Rounds != 4 || !path.Reached() {
+		t.Errorf("Expected 4 rounds reaching the destination, got %d (%v)", path.Rounds, path.Reached())
+	}
+}
+
+// TestRouteChange tests that a hop answering from a new address is flagged
+func TestRouteChange(t *testing.T) {
+	dest := net.ParseIP("198.51.100.1")
+	a, b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	var path Path
+
+	path.Record([]Probe{{TTL: 1, From: a}, {TTL: 2, From: dest, Reached: true}})
+	changes := path.Record([]Probe{{TTL: 1, From: b}, {TTL: 2, From: dest, Reached: true}})
+	if len(changes) != 1 || changes[0].TTL != 1 || !changes[0].From.Equal(a) || !changes[0].To.Equal(b) {
+		t.Errorf("Expected hop 1 change from %v to %v, got %+v", a, b, changes)
+	}
+
+	// The path getting longer shows up where the destination used to answer
+	changes = path.Record([]Probe{{TTL: 1, From: b}, {TTL: 2, From: a}, {TTL: 3, From: dest, Reached: true}})
+	if len(changes) != 1 || changes[0].TTL != 2 || !changes[0].To.Equal(a) {
+		t.Errorf("Expected hop 2 change to %v, got %+v", a, changes)
+	}
+	if len(path.Hops()) != 3 || len(path.Hops()[0].Addrs) != 2 {
+		t.Errorf("Expected 3 hops with two addresses seen at hop 1")
+	}
+}